@@ -6,7 +6,7 @@ import os
 import fnmatch, re
 import boto3
 
-lambda_client = boto3.client('lambda')
+sqs_client = boto3.client('sqs')
 
 def lambda_handler(event, context):
     """
@@ -37,7 +37,7 @@ def lambda_handler(event, context):
         return validation_error
 
     repository_name = event['detail']['repository-name']
-    image_digest = event['detail']['image-digest']
+    image_digest = event['detail'].get('image-digest',"")
     image_tag = event['detail'].get('image-tag',"")
 
     try:
@@ -50,23 +50,24 @@ def lambda_handler(event, context):
         regex_matcher = re.compile(soci_repository_image_tag_filter_regex_pattern)
 
         if regex_matcher.fullmatch(f'{repository_name}:{image_tag}'):
-            log_to_cloudwatch("Invoking SOCI index generator Lambda function")
+            log_to_cloudwatch("Sending the event to the SOCI index build queue")
 
-            soci_index_generator_lambda_arn = os.environ['soci_index_generator_lambda_arn']
+            # The SOCI index generator Lambda function consumes the queue in batches
+            soci_index_build_queue_url = os.environ['soci_index_build_queue_url']
 
-            response = lambda_client.invoke(
-                FunctionName = soci_index_generator_lambda_arn,
-                InvocationType = 'Event',
-                Payload = json.dumps(event)
+            response = sqs_client.send_message(
+                QueueUrl = soci_index_build_queue_url,
+                MessageBody = json.dumps(event)
             )
 
-            lambda_status_code = response['ResponseMetadata']['HTTPStatusCode']
-            lambda_request_id = response['ResponseMetadata']['RequestId']
+            sqs_status_code = response['ResponseMetadata']['HTTPStatusCode']
+            sqs_request_id = response['ResponseMetadata']['RequestId']
+            sqs_message_id = response.get('MessageId')
 
-            if lambda_status_code == 202:
-                return log_and_generate_response(200, f'Successfully invoked SOCI index generator Lambda function because the given event contained the image "{repository_name}:{image_tag}" with digest "{image_digest}" which matched SOCI repository image tag filter "{soci_repository_image_tag_filter}". Lambda request id: "{lambda_request_id}"')
+            if sqs_status_code == 200:
+                return log_and_generate_response(200, f'Successfully sent the event to the SOCI index build queue because the given event contained the image "{repository_name}:{image_tag}" with digest "{image_digest}" which matched SOCI repository image tag filter "{soci_repository_image_tag_filter}". SQS message id: "{sqs_message_id}"')
             else:
-                return log_and_generate_response(500, f'Failed to invoke SOCI index generator Lambda function. Lambda status code: "{lambda_status_code}". Lambda request id: "{lambda_request_id}"')
+                return log_and_generate_response(500, f'Failed to send the event to the SOCI index build queue. SQS status code: "{sqs_status_code}". SQS request id: "{sqs_request_id}"')
 
     return log_and_generate_response(200, f'The given event contained the image "{repository_name}:{image_tag}" with digest "{image_digest}" which did not match any SOCI repository image tag filters')
 
@@ -75,17 +76,26 @@ def validate_event(event):
         return log_and_generate_response(400, "The event's 'source' must be 'aws.ecr'")
     if event.get('account') == None:
         return log_and_generate_response(400, "The event's 'account' must not be empty")
-    if event.get('detail-type') != "ECR Image Action":
-        return log_and_generate_response(400, "The event's 'detail-type' must be 'ECR Image Action'")
+    if event.get('detail-type') not in ["ECR Image Action", "ECR Pull Through Cache Action"]:
+        return log_and_generate_response(400, "The event's 'detail-type' must be 'ECR Image Action' or 'ECR Pull Through Cache Action'")
     eventDetail = event.get('detail')
     if eventDetail == None:
         return log_and_generate_response(400, "The event's 'detail' must not be empty")
     if type(eventDetail) is not dict:
         return log_and_generate_response(400, "The event's 'detail' must be a JSON object literal")
-    if eventDetail.get('action-type') != "PUSH":
-        return log_and_generate_response(400, "The event's 'detail.action-type' must be 'PUSH")
-    if eventDetail.get('result') != "SUCCESS":
-        return log_and_generate_response(400, "The event's 'detail.result' must be 'SUCCESS'")
+    if event['detail-type'] == "ECR Pull Through Cache Action":
+        if eventDetail.get('sync-status') == None:
+            return log_and_generate_response(400, "The event's 'detail.sync-status' must not be empty")
+        if eventDetail.get('repository-name') == None:
+            return log_and_generate_response(400, "The event's 'detail.repository-name' must not be empty")
+        # A failed sync is forwarded as is, the generator reports it as an upstream failure
+        if eventDetail['sync-status'] != "SUCCESS":
+            return None
+    else:
+        if eventDetail.get('action-type') not in ["PUSH", "DELETE"]:
+            return log_and_generate_response(400, "The event's 'detail.action-type' must be 'PUSH' or 'DELETE'")
+        if eventDetail.get('result') != "SUCCESS":
+            return log_and_generate_response(400, "The event's 'detail.result' must be 'SUCCESS'")
     if eventDetail.get('repository-name') == None:
         return log_and_generate_response(400, "The event's 'detail.repository-name' must not be empty")
     if eventDetail.get('image-digest') == None:
@@ -0,0 +1,279 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/events"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/filter"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	backfillNotAnImage  = "skipped: not an image"
+	backfillFailed      = "failed"
+	defaultPageSize     = 100
+	defaultConcurrency  = 1
+	maxBackfillPageSize = 1000
+	// No new build is started when the invocation has less time left than this
+	backfillBuildMargin = 5 * time.Minute
+)
+
+// Options of a repository backfill
+type backfillOptions struct {
+	PageSize    int
+	Concurrency int
+	// Maximum number of pages to process, zero for no limit
+	MaxPages int
+}
+
+// The progress of a repository backfill. It is saved after every page, so that an interrupted backfill
+// can be resumed from its next token.
+type backfillReport struct {
+	RegistryURL string `json:"registryUrl"`
+	Repository  string `json:"repository"`
+	// Token of the next page to process, empty once the backfill is complete
+	NextToken string `json:"nextToken"`
+	Complete  bool   `json:"complete"`
+	// Outcome of every processed image by digest
+	Results map[string]string `json:"results,omitempty"`
+	// Number of images by outcome
+	Summary map[string]int `json:"summary"`
+}
+
+func newBackfillReport(registryUrl string, repo string) *backfillReport {
+	return &backfillReport{RegistryURL: registryUrl, Repository: repo, Results: map[string]string{}, Summary: map[string]int{}}
+}
+
+// Record the outcome of an image, replacing the outcome of a previous attempt
+func (report *backfillReport) record(imageDigest string, outcome string) {
+	if previous, ok := report.Results[imageDigest]; ok {
+		report.Summary[outcomeKind(previous)]--
+		if report.Summary[outcomeKind(previous)] == 0 {
+			delete(report.Summary, outcomeKind(previous))
+		}
+	}
+	report.Results[imageDigest] = outcome
+	report.Summary[outcomeKind(outcome)]++
+}
+
+// Failures are summarized together, whatever their error, filtered images whatever their rule, and builds
+// whatever their settings
+func outcomeKind(outcome string) string {
+	for _, kind := range []string{backfillFailed, FilteredMessage, BuildAndPushLegacySuccessMessage, BuildAndPushSuccessMessage} {
+		if strings.HasPrefix(outcome, kind) {
+			return kind
+		}
+	}
+	return outcome
+}
+
+// Check if an image was processed by a previous attempt. Failed images are retried.
+func (report *backfillReport) processed(imageDigest string) bool {
+	outcome, ok := report.Results[imageDigest]
+	return ok && outcomeKind(outcome) != backfillFailed
+}
+
+// Check if a listed manifest is an image, as opposed to an image index or another artifact
+func isIndexableImage(image registryutils.ImageDetail) bool {
+	if image.MediaType != registryutils.MediaTypeDockerManifest && image.MediaType != ocispec.MediaTypeImageManifest {
+		return false
+	}
+	if image.ArtifactMediaType == "" {
+		return true
+	}
+	for _, configMediaType := range registryutils.ImageConfigMediaTypes {
+		if image.ArtifactMediaType == configMediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the outcome of an image which isn't built, or an empty string if the image must be built
+func backfillSkip(image registryutils.ImageDetail, repo string, imageTagFilter *filter.Filter, indexed map[string]bool) string {
+	if !isIndexableImage(image) {
+		return backfillNotAnImage
+	}
+	if decision := imageTagFilter.EvaluateTags(repo, image.Tags); !decision.Included {
+		return filteredMessage(decision)
+	}
+	if indexed[image.Digest] {
+		return AlreadyIndexedMessage
+	}
+	return ""
+}
+
+// Build the missing SOCI indexes of a repository's images, page by page, starting at the report's next token.
+// Processing stops after the maximum number of pages, or when the context is about to expire, in which case the
+// next token is left at the interrupted page. save, if not nil, is called with the report after every page.
+func backfillRepository(ctx context.Context, registry *registryutils.Registry, report *backfillReport, options backfillOptions, save func(*backfillReport) error) error {
+	repo := report.Repository
+	if options.PageSize <= 0 || options.PageSize > maxBackfillPageSize {
+		options.PageSize = defaultPageSize
+	}
+	if options.Concurrency <= 0 {
+		options.Concurrency = defaultConcurrency
+	}
+
+	params, err := loadBuildParameters(repo)
+	if err != nil {
+		return err
+	}
+	imageTagFilter, err := imageFilter()
+	if err != nil {
+		return err
+	}
+
+	// Listing the indexes up front saves building the images known to be indexed. The listing doesn't hold the
+	// SOCI index manifests v2, only found through their image index, and the distribution API can't list indexes
+	// at all, so the other images are still checked for an existing index by their build.
+	indexed := map[string]bool{}
+	indexes, err := registry.ListSociIndexes(ctx, repo)
+	if err != nil && !errors.Is(err, registryutils.ErrManifestListingNotSupported) {
+		return err
+	}
+	for _, index := range indexes {
+		if params.matches(index.Manifest.Annotations) {
+			indexed[index.ImageManifestDigest()] = true
+		}
+	}
+
+	expiring := func() bool {
+		deadline, ok := ctx.Deadline()
+		return ok && time.Until(deadline) < backfillBuildMargin
+	}
+	for pages := 0; !report.Complete; pages++ {
+		if options.MaxPages > 0 && pages >= options.MaxPages {
+			break
+		}
+		if expiring() {
+			log.Info(ctx, "Stopping the backfill before the invocation times out")
+			break
+		}
+
+		page, err := registry.ListImagesPage(ctx, repo, report.NextToken, options.PageSize)
+		if err != nil {
+			return err
+		}
+		finished := backfillPage(report, page.Images, options.Concurrency, expiring, func(image registryutils.ImageDetail) string {
+			if outcome := backfillSkip(image, repo, imageTagFilter, indexed); outcome != "" {
+				return outcome
+			}
+			req := buildRequest{RegistryURL: report.RegistryURL, Repository: repo, Digest: image.Digest}
+			if len(image.Tags) > 0 {
+				req.Tag = image.Tags[0]
+			}
+			msg, err := buildAndPushIndex(log.With(ctx, log.ImageDigest, image.Digest), req)
+			if err != nil {
+				return fmt.Sprintf("%s: %s: %v", backfillFailed, msg, err)
+			}
+			return msg
+		})
+
+		// The images of an interrupted page processed so far are found indexed when the page is resumed
+		if finished {
+			report.NextToken = page.NextToken
+			report.Complete = page.NextToken == ""
+		}
+		if save != nil {
+			if err := save(report); err != nil {
+				return err
+			}
+		}
+		if !finished {
+			log.Info(ctx, "Stopping the backfill in the middle of a page before the invocation times out")
+			break
+		}
+		log.Info(ctx, fmt.Sprintf("Backfilled a page of %d images, %d images processed so far", len(page.Images), len(report.Results)),
+			log.Int("PageImages", len(page.Images)), log.Int("ProcessedImages", len(report.Results)))
+	}
+	return nil
+}
+
+// Process the images of a page which weren't processed yet, at most concurrency at a time. No new image is
+// processed once stop returns true, returns whether every image was processed.
+func backfillPage(report *backfillReport, images []registryutils.ImageDetail, concurrency int, stop func() bool, process func(image registryutils.ImageDetail) string) bool {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, concurrency)
+	seen := map[string]bool{}
+
+	for _, image := range images {
+		// The tags API lists an image once per tag
+		mutex.Lock()
+		skip := seen[image.Digest] || report.processed(image.Digest)
+		mutex.Unlock()
+		if skip {
+			continue
+		}
+		seen[image.Digest] = true
+
+		semaphore <- struct{}{}
+		if stop() {
+			<-semaphore
+			wg.Wait()
+			return false
+		}
+		wg.Add(1)
+		go func(image registryutils.ImageDetail) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			outcome := process(image)
+			mutex.Lock()
+			report.record(image.Digest, outcome)
+			mutex.Unlock()
+		}(image)
+	}
+	wg.Wait()
+	return true
+}
+
+// Backfill a page at a time from a SOCI Index Backfill event. The returned summary holds the token to send in the
+// next event to resume from.
+func HandleBackfillRequest(ctx context.Context, event events.SociIndexBackfillEvent) (string, error) {
+	ctx = log.With(ctx, log.EventId, event.Id)
+	request, err := event.Request()
+	if err != nil {
+		return invalidRequest(ctx, "SociIndexBackfillEvent validation error", err)
+	}
+	return handleRequest(ctx, request)
+}
+
+// Backfill a page at a time from a backfill request, whatever envelope it came in
+func handleBackfill(ctx context.Context, request events.BackfillRequest) (string, error) {
+	ctx = log.With(ctx, log.RepositoryName, request.Repository)
+	ctx = log.With(ctx, log.RegistryURL, request.Registry)
+	registry, err := registryutils.Init(ctx, request.Registry)
+	if err != nil {
+		return lambdaError(ctx, "Remote registry initialization error", err)
+	}
+
+	report := newBackfillReport(request.Registry, request.Repository)
+	report.NextToken = request.NextToken
+	options := backfillOptions{PageSize: request.PageSize, Concurrency: request.Concurrency, MaxPages: request.MaxPages}
+	if err := backfillRepository(ctx, registry, report, options, nil); err != nil {
+		return lambdaError(ctx, "Backfill error", err)
+	}
+
+	// The outcome of each image is logged by its build, the summary is enough to resume
+	report.Results = nil
+	summary, err := json.Marshal(report)
+	if err != nil {
+		return lambdaError(ctx, "Backfill summary encoding error", err)
+	}
+	log.Info(ctx, string(summary))
+	return string(summary), nil
+}
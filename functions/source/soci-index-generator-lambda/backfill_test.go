@@ -0,0 +1,107 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestBackfillSkip(t *testing.T) {
+	t.Setenv(repositoryImageTagFiltersEnv, "repo:v*")
+	imageTagFilter, err := imageFilter()
+	if err != nil {
+		t.Fatalf("Unexpected error reading the filter: %v", err)
+	}
+	indexed := map[string]bool{"sha256:indexed": true}
+
+	tests := []struct {
+		image    registryutils.ImageDetail
+		expected string
+	}{
+		{registryutils.ImageDetail{Digest: "sha256:new", Tags: []string{"v1"}, MediaType: registryutils.MediaTypeDockerManifest, ArtifactMediaType: registryutils.MediaTypeDockerImageConfig}, ""},
+		{registryutils.ImageDetail{Digest: "sha256:new", Tags: []string{"v1"}, MediaType: ocispec.MediaTypeImageManifest}, ""},
+		{registryutils.ImageDetail{Digest: "sha256:indexed", Tags: []string{"v1"}, MediaType: ocispec.MediaTypeImageManifest}, AlreadyIndexedMessage},
+		{registryutils.ImageDetail{Digest: "sha256:new", Tags: []string{"latest"}, MediaType: ocispec.MediaTypeImageManifest}, "skipped: filtered: matched no include rule"},
+		{registryutils.ImageDetail{Digest: "sha256:list", Tags: []string{"v1"}, MediaType: ocispec.MediaTypeImageIndex}, backfillNotAnImage},
+		{registryutils.ImageDetail{Digest: "sha256:soci", MediaType: ocispec.MediaTypeImageManifest, ArtifactMediaType: registryutils.SociIndexArtifactTypeV2}, backfillNotAnImage},
+	}
+	for _, test := range tests {
+		if actual := backfillSkip(test.image, "repo", imageTagFilter, indexed); actual != test.expected {
+			t.Fatalf("Expected %+v to be %q, got %q", test.image, test.expected, actual)
+		}
+	}
+}
+
+func TestBackfillPage(t *testing.T) {
+	report := newBackfillReport("registry", "repo")
+	report.record("sha256:done", BuildAndPushSuccessMessage)
+	report.record("sha256:failed", backfillFailed+": error")
+
+	images := []registryutils.ImageDetail{
+		{Digest: "sha256:done"},
+		{Digest: "sha256:failed"},
+		{Digest: "sha256:new", Tags: []string{"a"}},
+		{Digest: "sha256:new", Tags: []string{"b"}},
+	}
+	var processed int32
+	finished := backfillPage(report, images, 2, func() bool { return false }, func(image registryutils.ImageDetail) string {
+		atomic.AddInt32(&processed, 1)
+		return BuildAndPushSuccessMessage
+	})
+
+	if !finished || processed != 2 {
+		t.Fatalf("Expected the failed and new images to be processed once, got %d builds", processed)
+	}
+	if !reflect.DeepEqual(report.Summary, map[string]int{BuildAndPushSuccessMessage: 3}) {
+		t.Fatalf("Unexpected summary %v", report.Summary)
+	}
+}
+
+func TestBackfillPageStops(t *testing.T) {
+	report := newBackfillReport("registry", "repo")
+	images := []registryutils.ImageDetail{{Digest: "sha256:a"}, {Digest: "sha256:b"}, {Digest: "sha256:c"}}
+	// The invocation is about to time out once the first image is built
+	var processed int32
+	finished := backfillPage(report, images, 1, func() bool { return atomic.LoadInt32(&processed) > 0 }, func(image registryutils.ImageDetail) string {
+		atomic.AddInt32(&processed, 1)
+		return BuildAndPushSuccessMessage
+	})
+
+	if finished || processed != 1 || report.Results["sha256:a"] != BuildAndPushSuccessMessage {
+		t.Fatalf("Expected the page to stop after its first image, got %d builds and results %v", processed, report.Results)
+	}
+}
+
+func TestBackfillState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backfill.json")
+
+	report := newBackfillReport("registry", "repo")
+	if err := loadBackfillState(path, report); err != nil {
+		t.Fatalf("Expected a missing state to start a new backfill, got %v", err)
+	}
+
+	report.NextToken = "token"
+	report.record("sha256:a", AlreadyIndexedMessage)
+	if err := saveBackfillState(path, report); err != nil {
+		t.Fatalf("Unexpected error saving the state: %v", err)
+	}
+
+	resumed := newBackfillReport("registry", "repo")
+	if err := loadBackfillState(path, resumed); err != nil {
+		t.Fatalf("Unexpected error loading the state: %v", err)
+	}
+	if !reflect.DeepEqual(resumed, report) {
+		t.Fatalf("Expected the saved progress %+v, got %+v", report, resumed)
+	}
+
+	if err := loadBackfillState(path, newBackfillReport("registry", "other")); err == nil {
+		t.Fatalf("Expected an error resuming the backfill of another repository")
+	}
+}
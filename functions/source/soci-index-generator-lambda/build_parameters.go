@@ -0,0 +1,149 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// Annotations recording the parameters a SOCI index was built with
+	AnnotationBuildPlatform     = "com.amazon.soci-index-builder.platform"
+	AnnotationBuildSpanSize     = "com.amazon.soci-index-builder.span-size"
+	AnnotationBuildMinLayerSize = "com.amazon.soci-index-builder.min-layer-size"
+	AnnotationBuildIndexVersion = "com.amazon.soci-index-builder.index-version"
+	// The image labels which set build parameters, comma-separated
+	AnnotationBuildLabelDirectives = "com.amazon.soci-index-builder.label-directives"
+
+	// Environment variables overriding the default build parameters
+	spanSizeEnv     = "SOCI_SPAN_SIZE"
+	minLayerSizeEnv = "SOCI_MIN_LAYER_SIZE"
+
+	// Same defaults as the SOCI library
+	defaultSpanSize     = int64(1 << 22)  // 4MiB
+	defaultMinLayerSize = int64(10 << 20) // 10MiB
+)
+
+// The parameters a SOCI index is built with
+type buildParameters struct {
+	Platform     ocispec.Platform
+	SpanSize     int64
+	MinLayerSize int64
+	IndexVersion string
+	// The image labels which set parameters, if any
+	Directives []string
+}
+
+// Read the build parameters of a repository from the environment, falling back to the SOCI library defaults
+func loadBuildParameters(repo string) (buildParameters, error) {
+	params := buildParameters{
+		Platform:     platforms.DefaultSpec(), // TODO: make this a user option
+		SpanSize:     defaultSpanSize,
+		MinLayerSize: defaultMinLayerSize,
+		IndexVersion: indexVersionV1,
+	}
+
+	var err error
+	if params.IndexVersion, err = indexVersionForRepository(repo); err != nil {
+		return params, err
+	}
+	if params.SpanSize, err = sizeFromEnv(spanSizeEnv, defaultSpanSize); err != nil {
+		return params, err
+	}
+	if params.MinLayerSize, err = sizeFromEnv(minLayerSizeEnv, defaultMinLayerSize); err != nil {
+		return params, err
+	}
+	return params, nil
+}
+
+func sizeFromEnv(name string, defaultValue int64) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number of bytes, got %q", name, value)
+	}
+	return size, nil
+}
+
+// Returns the annotations recording the build parameters on a SOCI index
+func (params buildParameters) annotations() map[string]string {
+	annotations := map[string]string{
+		AnnotationBuildPlatform:     platforms.Format(params.Platform),
+		AnnotationBuildSpanSize:     strconv.FormatInt(params.SpanSize, 10),
+		AnnotationBuildMinLayerSize: strconv.FormatInt(params.MinLayerSize, 10),
+		AnnotationBuildIndexVersion: params.IndexVersion,
+	}
+	if len(params.Directives) > 0 {
+		annotations[AnnotationBuildLabelDirectives] = strings.Join(params.Directives, ",")
+	}
+	return annotations
+}
+
+// Returns the parameters as a readable list, for build results
+func (params buildParameters) String() string {
+	description := fmt.Sprintf("platform %s, span size %d, min layer size %d, index version %s",
+		platforms.Format(params.Platform), params.SpanSize, params.MinLayerSize, params.IndexVersion)
+	if len(params.Directives) > 0 {
+		description += ", set by labels " + strings.Join(params.Directives, " ")
+	}
+	return description
+}
+
+// Check if a SOCI index with the given annotations was built with these parameters.
+// Indexes built before the parameters were recorded were built with the defaults. Parameters the image's labels
+// set match whatever their value, as the labels of an image digest never change.
+func (params buildParameters) matches(annotations map[string]string) bool {
+	expected := params.annotations()
+	defaults := buildParameters{Platform: params.Platform, SpanSize: defaultSpanSize, MinLayerSize: defaultMinLayerSize, IndexVersion: indexVersionV1}.annotations()
+	setByLabels := map[string]bool{AnnotationBuildLabelDirectives: true}
+	for _, label := range strings.Split(annotations[AnnotationBuildLabelDirectives], ",") {
+		setByLabels[labelAnnotations[label]] = true
+	}
+	for key, value := range expected {
+		if setByLabels[key] {
+			continue
+		}
+		actual, ok := annotations[key]
+		if !ok {
+			actual = defaults[key]
+		}
+		if actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Find a SOCI index of an image manifest built with the given parameters, returning nil if there is none.
+// SOCI index manifests v2 are looked up in the image index tagged after the image's tag.
+func findExistingIndex(ctx context.Context, registry *registryutils.Registry, repo string, digest string, tag string, params buildParameters) (*registryutils.SociIndexManifest, error) {
+	indexes, err := registry.FindSociIndexes(ctx, repo, digest)
+	if err != nil {
+		return nil, err
+	}
+	if params.IndexVersion == indexVersionV2 && tag != "" {
+		v2Indexes, err := registry.FindSociIndexesV2(ctx, repo, v2Tag(tag), digest)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, v2Indexes...)
+	}
+	for _, index := range indexes {
+		if params.matches(index.Manifest.Annotations) {
+			return &index, nil
+		}
+	}
+	return nil, nil
+}
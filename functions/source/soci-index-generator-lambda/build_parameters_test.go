@@ -0,0 +1,77 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestBuildParametersMatches(t *testing.T) {
+	params := buildParameters{
+		Platform:     ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		SpanSize:     defaultSpanSize,
+		MinLayerSize: defaultMinLayerSize,
+		IndexVersion: indexVersionV1,
+	}
+
+	if !params.matches(params.annotations()) {
+		t.Fatalf("Expected build parameters to match their own annotations")
+	}
+	if !params.matches(map[string]string{}) {
+		t.Fatalf("Expected default build parameters to match an index without build parameter annotations")
+	}
+
+	custom := params
+	custom.SpanSize = 1 << 20
+	if custom.matches(params.annotations()) {
+		t.Fatalf("Expected a different span size not to match")
+	}
+	if custom.matches(map[string]string{}) {
+		t.Fatalf("Expected non default build parameters not to match an index without build parameter annotations")
+	}
+
+	v2 := params
+	v2.IndexVersion = indexVersionV2
+	if v2.matches(params.annotations()) || v2.matches(map[string]string{}) {
+		t.Fatalf("Expected a different index version not to match")
+	}
+
+	arm := params
+	arm.Platform = ocispec.Platform{OS: "linux", Architecture: "arm64"}
+	if arm.matches(params.annotations()) {
+		t.Fatalf("Expected a different platform not to match")
+	}
+
+	labelled := params
+	labelled.SpanSize = 1 << 20
+	labelled.Directives = []string{LabelSpanSize}
+	if !params.matches(labelled.annotations()) {
+		t.Fatalf("Expected a span size set by the image's labels to match")
+	}
+	if !labelled.matches(labelled.annotations()) {
+		t.Fatalf("Expected build parameters set by labels to match their own annotations")
+	}
+	if labelled.matches(params.annotations()) {
+		t.Fatalf("Expected a span size set by labels not to match an index built without them")
+	}
+}
+
+func TestLoadBuildParameters(t *testing.T) {
+	t.Setenv(spanSizeEnv, "1048576")
+	t.Setenv(minLayerSizeEnv, "")
+	params, err := loadBuildParameters("repo")
+	if err != nil {
+		t.Fatalf("Unexpected error loading build parameters: %v", err)
+	}
+	if params.SpanSize != 1048576 || params.MinLayerSize != defaultMinLayerSize {
+		t.Fatalf("Unexpected build parameters %+v", params)
+	}
+
+	t.Setenv(minLayerSizeEnv, "-1")
+	if _, err := loadBuildParameters("repo"); err == nil {
+		t.Fatalf("Expected an error for a negative min layer size")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/events"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/opencontainers/go-digest"
+)
+
+// The result of a build request, naming the image by both its tag and the digest the tag resolved to
+type buildRequestResult struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest"`
+	Force      bool   `json:"force"`
+	Result     string `json:"result"`
+}
+
+// Build the SOCI index of an image named by a build request sent directly or in a CloudEvent.
+// Returns the result as JSON.
+func HandleBuildRequest(ctx context.Context, request events.BuildRequest) (string, error) {
+	result, err := buildByReference(ctx, request, time.Time{})
+	if err != nil {
+		return result.Result, err
+	}
+	return encodeBuildResult(ctx, result)
+}
+
+// Encode the result of a build request as JSON
+func encodeBuildResult(ctx context.Context, result buildRequestResult) (string, error) {
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return lambdaError(ctx, "BuildRequest result encoding error", err)
+	}
+	return string(encoded), nil
+}
+
+// Build the SOCI index of an image named by a tag or a digest, pushed at the given time if known. Tags are resolved
+// to the digest they name when the request is handled.
+func buildByReference(ctx context.Context, request events.BuildRequest, pushedAt time.Time) (buildRequestResult, error) {
+	result := buildRequestResult{Registry: request.Registry, Repository: request.Repository, Force: request.Force}
+	ctx = log.With(ctx, log.RegistryURL, request.Registry)
+	// The tag is resolved and the image built with the same registry client, shared with the other requests of
+	// an SQS batch if any
+	ctx = registryutils.EnsureSharedClients(ctx)
+
+	if _, err := digest.Parse(request.Reference); err == nil {
+		result.Digest = request.Reference
+		result.Tag = request.Tag
+	} else {
+		result.Tag = request.Reference
+	}
+	ctx = log.With(ctx, log.RepositoryName, request.Repository)
+
+	if msg, err := skipNotAllowed(ctx, request.Registry); err != nil {
+		result.Result, _ = lambdaError(ctx, "Registry allowlist error", err)
+		return result, err
+	} else if msg != "" {
+		result.Result = msg
+		return result, nil
+	}
+
+	// The registry client rejects invalid repository names and tags when resolving the tag. The repository
+	// name, digest and tag are all validated once the digest is known.
+	if result.Digest == "" {
+		ctx = log.With(ctx, log.ImageTag, result.Tag)
+		registry, err := registryutils.Init(ctx, request.Registry)
+		if err != nil {
+			result.Result, _ = lambdaError(ctx, "Remote registry initialization error", err)
+			return result, err
+		}
+		descriptor, err := registry.HeadManifest(ctx, request.Repository, result.Tag)
+		if err != nil {
+			result.Result, _ = lambdaError(ctx, "Image tag resolution error", err)
+			return result, err
+		}
+		result.Digest = descriptor.Digest.String()
+		log.Info(log.With(ctx, log.ImageDigest, result.Digest), fmt.Sprintf("Resolved tag %s to %s", result.Tag, result.Digest))
+	}
+	ctx, errors := validateImageDetail(ctx, request.Repository, result.Digest, result.Tag)
+	if len(errors) > 0 {
+		msg, err := invalidRequest(ctx, "BuildRequest validation error", errors[0])
+		result.Result = msg
+		return result, err
+	}
+
+	msg, err := skipFiltered(ctx, request.Repository, result.Tag)
+	if err != nil {
+		result.Result, _ = lambdaError(ctx, "Repository image tag filter error", err)
+		return result, err
+	}
+	if msg != "" {
+		result.Result = msg
+		return result, nil
+	}
+
+	result.Result, err = buildAndPushIndex(ctx, buildRequest{
+		RegistryURL: request.Registry,
+		Repository:  request.Repository,
+		Digest:      result.Digest,
+		Tag:         result.Tag,
+		Force:       request.Force,
+		PushedAt:    pushedAt,
+	})
+	return result, err
+}
+
+// Check if the images of a registry may be built, see SOCI_ALLOWED_REGISTRIES
+func registryAllowed(registry string) (bool, error) {
+	allowlist, err := registryutils.LoadAllowlist()
+	if err != nil {
+		return false, err
+	}
+	return allowlist.Allows(registry), nil
+}
+
+// Requests may name any host, e.g. the registry notifications anyone able to reach the builder sends, so only
+// the allowed registries are reached. Retrying a request for another registry wouldn't help, it is skipped.
+// Returns the result of the skipped request, or an empty string if the registry is allowed.
+func skipNotAllowed(ctx context.Context, registry string) (string, error) {
+	allowed, err := registryAllowed(registry)
+	if err != nil || allowed {
+		return "", err
+	}
+	log.Warn(log.With(ctx, log.RegistryURL, registry), RegistryNotAllowedMessage)
+	return RegistryNotAllowedMessage, nil
+}
+
+// Returns the registry a request builds, cleans up or backfills the images of
+func requestRegistry(request events.Request) string {
+	switch {
+	case request.Build != nil:
+		return request.Build.Registry
+	case request.Backfill != nil:
+		return request.Backfill.Registry
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/events"
+)
+
+func TestHandleBuildRequest(t *testing.T) {
+	t.Setenv(repositoryImageTagFiltersEnv, "repo:v1")
+	t.Setenv(repositoryImageTagExcludeFiltersEnv, "")
+	t.Setenv("SOCI_ALLOWED_REGISTRIES", "localhost:1")
+	ctx := context.Background()
+
+	// A digest is used as is, and filtered as a digest-only push
+	request := events.BuildRequest{Registry: "localhost:1", Repository: "repo", Reference: "sha256:9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d", Force: true}
+	encoded, err := HandleBuildRequest(ctx, request)
+	if err != nil {
+		t.Fatalf("Unexpected error handling the build request: %v", err)
+	}
+	var result buildRequestResult
+	if err := json.Unmarshal([]byte(encoded), &result); err != nil {
+		t.Fatalf("Expected a JSON result, got %s", encoded)
+	}
+	expected := buildRequestResult{Registry: "localhost:1", Repository: "repo", Digest: request.Reference, Force: true, Result: "skipped: filtered: matched no include rule"}
+	if result != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, result)
+	}
+
+	// A tag is resolved through the registry, which isn't listening
+	request.Reference = "v1"
+	result, err = buildByReference(ctx, request, time.Time{})
+	if err == nil || result.Tag != "v1" || result.Digest != "" || result.Result != "Image tag resolution error" {
+		t.Fatalf("Expected the tag resolution to fail, got %+v, %v", result, err)
+	}
+
+	request.Reference = "sha256:invalid"
+	if _, err := buildByReference(ctx, request, time.Time{}); err == nil {
+		t.Fatalf("Expected an error for an invalid digest")
+	}
+
+	// Registries which aren't allowed are never reached
+	request.Registry, request.Reference = "localhost:2", "v1"
+	if result, err := buildByReference(ctx, request, time.Time{}); err != nil || result.Result != RegistryNotAllowedMessage {
+		t.Fatalf("Expected the request of a registry which isn't allowed to be skipped, got %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+)
+
+const (
+	RemoveIndexesSuccessMessage = "Successfully removed orphaned SOCI indexes"
+	NoIndexesToRemoveMessage    = "No orphaned SOCI indexes to remove"
+	ImageStillExistsMessage     = "Skipping SOCI index removal as the image still exists"
+	RemoveIndexesFailedMessage  = "SOCI index removal error"
+)
+
+// Remove the SOCI indexes of a deleted image.
+// Only index manifests are deleted, the registry garbage collects the zTOC blobs they referenced.
+// Running it again for the same image is a no-op.
+func removeOrphanedIndexes(ctx context.Context, registryUrl string, repo string, digest string) (string, error) {
+	ctx = log.With(ctx, log.RegistryURL, registryUrl)
+
+	registry, err := registryutils.Init(ctx, registryUrl)
+	if err != nil {
+		return lambdaError(ctx, "Remote registry initialization error", err)
+	}
+
+	// Deleting a tag also emits a DELETE event, in which case the image and its indexes are still in use
+	exists, err := registry.HasManifest(ctx, repo, digest)
+	if err != nil {
+		return lambdaError(ctx, RemoveIndexesFailedMessage, err)
+	}
+	if exists {
+		log.Info(ctx, ImageStillExistsMessage)
+		return ImageStillExistsMessage, nil
+	}
+
+	indexes, err := registry.FindSociIndexes(ctx, repo, digest)
+	if err != nil {
+		return lambdaError(ctx, RemoveIndexesFailedMessage, err)
+	}
+	if len(indexes) == 0 {
+		log.Info(ctx, NoIndexesToRemoveMessage)
+		return NoIndexesToRemoveMessage, nil
+	}
+
+	for _, index := range indexes {
+		indexCtx := log.With(ctx, log.SOCIIndexDigest, index.Descriptor.Digest.String())
+		if err := registry.DeleteManifest(indexCtx, repo, index.Descriptor); err != nil {
+			return lambdaError(indexCtx, RemoveIndexesFailedMessage, err)
+		}
+		log.Info(indexCtx, "Removed orphaned SOCI index")
+	}
+
+	log.Info(ctx, fmt.Sprintf("%s: removed %d SOCI indexes", RemoveIndexesSuccessMessage, len(indexes)))
+	return RemoveIndexesSuccessMessage, nil
+}
@@ -0,0 +1,333 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/events"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/metrics"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+)
+
+// Address the commands serve their metrics on, e.g. ":9090", for long running commands to be scraped. The serve
+// command serves its metrics with its API.
+const metricsAddrEnv = "SOCI_METRICS_ADDR"
+
+// Subcommands to run the builder from the command line rather than as a Lambda function
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"sweep":    sweepCommand,
+	"reindex":  reindexCommand,
+	"backfill": backfillCommand,
+	"coverage": coverageCommand,
+	"build":    buildCommand,
+	"serve":    serveCommand,
+}
+
+// Run the subcommand named by the first argument and return the process exit code
+func runCommand(ctx context.Context, args []string) int {
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q, expected one of: %s\n", args[0], strings.Join(commandNames(), ", "))
+		return 2
+	}
+	if err := log.Configure(log.FormatConsole); err != nil {
+		log.Error(ctx, "Logging configuration error", err)
+	}
+	if addr := os.Getenv(metricsAddrEnv); addr != "" && args[0] != "serve" {
+		go serveMetrics(ctx, addr)
+	}
+	defer initTracing(ctx)()
+
+	err := command(ctx, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// Serve the metrics of the builds until the process exits
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 30 * time.Second}
+	if err := server.ListenAndServe(); err != nil {
+		log.Error(ctx, "Metrics server error", err)
+	}
+}
+
+func commandNames() []string {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Delete the orphaned and duplicate SOCI indexes of a repository
+func sweepCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("sweep", flag.ContinueOnError)
+	registryUrl := flags.String("registry", "", "Registry url, e.g. 123456789012.dkr.ecr.us-west-2.amazonaws.com")
+	repo := flags.String("repository", "", "Name of the repository to sweep")
+	dryRun := flags.Bool("dry-run", true, "Only report the SOCI indexes to delete, set to false to delete them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *registryUrl == "" || *repo == "" {
+		return errors.New("-registry and -repository are required")
+	}
+
+	ctx = log.With(ctx, log.RegistryURL, *registryUrl)
+	ctx = log.With(ctx, log.RepositoryName, *repo)
+	registry, err := registryutils.Init(ctx, *registryUrl)
+	if err != nil {
+		return err
+	}
+
+	report, err := sweepRepository(ctx, registry, *registryUrl, *repo, *dryRun)
+	if err != nil {
+		return err
+	}
+	return printJSON(report)
+}
+
+// Build the SOCI index of an image named by a tag or a digest
+func buildCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	registryUrl := flags.String("registry", "", "Registry url, e.g. 123456789012.dkr.ecr.us-west-2.amazonaws.com")
+	repo := flags.String("repository", "", "Name of the image's repository")
+	reference := flags.String("reference", "", "Tag or digest of the image, tags are resolved to the digest they name")
+	force := flags.Bool("force", false, "Build even if the image already has a SOCI index built with the current settings")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *registryUrl == "" || *repo == "" || *reference == "" {
+		return errors.New("-registry, -repository and -reference are required")
+	}
+
+	result, err := buildByReference(ctx, events.BuildRequest{Registry: *registryUrl, Repository: *repo, Reference: *reference, Force: *force}, time.Time{})
+	if err != nil {
+		return fmt.Errorf("%s: %w", result.Result, err)
+	}
+	return printJSON(result)
+}
+
+// Serve the build API over HTTP until interrupted. The API doesn't authenticate its clients and must sit behind
+// a proxy or load balancer which does, and it only builds images of the registries allowed by
+// SOCI_ALLOWED_REGISTRIES.
+func serveCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("addr", ":8080", "Address to listen on")
+	workers := flags.Int("workers", 2, "Number of builds run concurrently")
+	queueSize := flags.Int("queue-size", 100, "Maximum number of queued builds, further builds are rejected until the queue drains")
+	maxJobs := flags.Int("max-jobs", 1000, "Number of builds whose status is kept, the oldest finished builds are forgotten first")
+	buildTimeout := flags.Duration("build-timeout", 15*time.Minute, "Maximum duration of a build, 0 for no limit")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 5*time.Minute, "Maximum time to wait for the in-flight builds on shutdown")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *workers < 1 || *queueSize < 1 || *maxJobs < 1 {
+		return errors.New("-workers, -queue-size and -max-jobs must be positive")
+	}
+	if *buildTimeout < 0 || *shutdownTimeout < 0 {
+		return errors.New("-build-timeout and -shutdown-timeout must not be negative")
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return serve(ctx, serverOptions{
+		Addr:            *addr,
+		Workers:         *workers,
+		QueueSize:       *queueSize,
+		MaxJobs:         *maxJobs,
+		BuildTimeout:    *buildTimeout,
+		ShutdownTimeout: *shutdownTimeout,
+	})
+}
+
+// Rebuild the SOCI indexes of a repository built by another builder version or with other settings
+func reindexCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("reindex", flag.ContinueOnError)
+	registryUrl := flags.String("registry", "", "Registry url, e.g. 123456789012.dkr.ecr.us-west-2.amazonaws.com")
+	repo := flags.String("repository", "", "Name of the repository to reindex")
+	dryRun := flags.Bool("dry-run", true, "Only report the outdated SOCI indexes, set to false to rebuild them")
+	rate := flags.Float64("rate", 6, "Maximum number of rebuilds per minute, 0 for no limit")
+	limit := flags.Int("limit", 0, "Maximum number of images to rebuild, 0 for no limit")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *registryUrl == "" || *repo == "" {
+		return errors.New("-registry and -repository are required")
+	}
+	if *rate < 0 || *limit < 0 {
+		return errors.New("-rate and -limit must not be negative")
+	}
+
+	options := reindexOptions{DryRun: *dryRun, Limit: *limit}
+	if *rate > 0 {
+		options.Interval = time.Duration(float64(time.Minute) / *rate)
+	}
+
+	ctx = log.With(ctx, log.RegistryURL, *registryUrl)
+	ctx = log.With(ctx, log.RepositoryName, *repo)
+	registry, err := registryutils.Init(ctx, *registryUrl)
+	if err != nil {
+		return err
+	}
+
+	report, err := reindexRepository(ctx, registry, *registryUrl, *repo, options)
+	if err != nil {
+		return err
+	}
+	return printJSON(report)
+}
+
+// Build the missing SOCI indexes of the images of a repository
+func backfillCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	registryUrl := flags.String("registry", "", "Registry url, e.g. 123456789012.dkr.ecr.us-west-2.amazonaws.com")
+	repo := flags.String("repository", "", "Name of the repository to backfill")
+	pageSize := flags.Int("page-size", defaultPageSize, "Number of images listed per page, at most 1000")
+	concurrency := flags.Int("concurrency", defaultConcurrency, "Number of images built at the same time")
+	maxPages := flags.Int("max-pages", 0, "Maximum number of pages to process, 0 for no limit")
+	statePath := flags.String("state", "", "File to save the progress to after every page, and to resume from if it exists")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *registryUrl == "" || *repo == "" {
+		return errors.New("-registry and -repository are required")
+	}
+
+	report := newBackfillReport(*registryUrl, *repo)
+	var save func(*backfillReport) error
+	if *statePath != "" {
+		if err := loadBackfillState(*statePath, report); err != nil {
+			return err
+		}
+		save = func(report *backfillReport) error {
+			return saveBackfillState(*statePath, report)
+		}
+	}
+	if report.Complete {
+		return printJSON(report)
+	}
+
+	ctx = log.With(ctx, log.RegistryURL, *registryUrl)
+	ctx = log.With(ctx, log.RepositoryName, *repo)
+	registry, err := registryutils.Init(ctx, *registryUrl)
+	if err != nil {
+		return err
+	}
+
+	options := backfillOptions{PageSize: *pageSize, Concurrency: *concurrency, MaxPages: *maxPages}
+	if err := backfillRepository(ctx, registry, report, options, save); err != nil {
+		return err
+	}
+	return printJSON(report)
+}
+
+// Resume a backfill from its saved progress, if there is any
+func loadBackfillState(path string, report *backfillReport) error {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	saved := newBackfillReport("", "")
+	if err := json.Unmarshal(content, saved); err != nil {
+		return fmt.Errorf("Invalid backfill state %s: %w", path, err)
+	}
+	if saved.RegistryURL != report.RegistryURL || saved.Repository != report.Repository {
+		return fmt.Errorf("Backfill state %s is for %s/%s", path, saved.RegistryURL, saved.Repository)
+	}
+	*report = *saved
+	return nil
+}
+
+// Save the progress of a backfill, replacing the file atomically so that an interruption can't corrupt it
+func saveBackfillState(path string, report *backfillReport) error {
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// Report which images of a registry's repositories are covered by SOCI indexes
+func coverageCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("coverage", flag.ContinueOnError)
+	registryUrl := flags.String("registry", "", "Registry url, e.g. 123456789012.dkr.ecr.us-west-2.amazonaws.com")
+	repositories := flags.String("repositories", "", "Comma-separated list of repositories, every repository of the registry if empty")
+	format := flags.String("format", "json", "Output format, json or csv")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *registryUrl == "" {
+		return errors.New("-registry is required")
+	}
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("Unsupported format %q, expected json or csv", *format)
+	}
+
+	ctx = log.With(ctx, log.RegistryURL, *registryUrl)
+	registry, err := registryutils.Init(ctx, *registryUrl)
+	if err != nil {
+		return err
+	}
+
+	var repos []string
+	for _, repo := range strings.Split(*repositories, ",") {
+		if repo = strings.TrimSpace(repo); repo != "" {
+			repos = append(repos, repo)
+		}
+	}
+	if len(repos) == 0 {
+		if repos, err = registry.ListRepositories(ctx); err != nil {
+			return err
+		}
+	}
+
+	report := coverageReport{RegistryURL: *registryUrl, Images: []imageCoverage{}}
+	for _, repo := range repos {
+		if err := coverRepository(ctx, registry, repo, &report); err != nil {
+			return fmt.Errorf("%s: %w", repo, err)
+		}
+	}
+
+	if *format == "csv" {
+		return writeCoverageCSV(os.Stdout, report)
+	}
+	return printJSON(report)
+}
+
+// Write a command's result to stdout
+func printJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
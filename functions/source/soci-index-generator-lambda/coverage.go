@@ -0,0 +1,206 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/awslabs/soci-snapshotter/soci"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Whether an image has a SOCI index, and which of its layers the index covers
+type imageCoverage struct {
+	Repository string   `json:"repository"`
+	Digest     string   `json:"digest"`
+	Tags       []string `json:"tags"`
+	Size       int64    `json:"size"`
+	Indexed    bool     `json:"indexed"`
+	// The newest SOCI index of the image
+	IndexDigest  string `json:"indexDigest,omitempty"`
+	IndexVersion string `json:"indexVersion,omitempty"`
+	ZtocCount    int    `json:"ztocCount"`
+	// Layers which have a zTOC, and the sum of their sizes
+	IndexedLayers   []string `json:"indexedLayers"`
+	UnindexedLayers []string `json:"unindexedLayers"`
+	IndexedBytes    int64    `json:"indexedBytes"`
+}
+
+// Totals of a coverage report
+type coverageSummary struct {
+	ImageCount        int   `json:"imageCount"`
+	IndexedImageCount int   `json:"indexedImageCount"`
+	ImageBytes        int64 `json:"imageBytes"`
+	IndexedImageBytes int64 `json:"indexedImageBytes"`
+	LayerBytes        int64 `json:"layerBytes"`
+	IndexedLayerBytes int64 `json:"indexedLayerBytes"`
+}
+
+// The SOCI index coverage of the images of one or more repositories
+type coverageReport struct {
+	RegistryURL string          `json:"registryUrl"`
+	Summary     coverageSummary `json:"summary"`
+	Images      []imageCoverage `json:"images"`
+}
+
+// Returns the SOCI index manifest version of an index
+func indexFormatVersion(manifest ocispec.Manifest) string {
+	if manifest.ArtifactType == registryutils.SociIndexArtifactTypeV2 || manifest.Config.MediaType == registryutils.SociIndexArtifactTypeV2 {
+		return indexVersionV2
+	}
+	return indexVersionV1
+}
+
+// Compute the coverage of an image by its SOCI index, which is nil if the image has none
+func imageCoverageOf(repo string, image registryutils.ImageDetail, manifest ocispec.Manifest, index *registryutils.SociIndexManifest) imageCoverage {
+	coverage := imageCoverage{
+		Repository:      repo,
+		Digest:          image.Digest,
+		Tags:            image.Tags,
+		Size:            image.Size,
+		IndexedLayers:   []string{},
+		UnindexedLayers: []string{},
+	}
+	if coverage.Tags == nil {
+		coverage.Tags = []string{}
+	}
+
+	ztocs := map[string]bool{}
+	if index != nil {
+		coverage.Indexed = true
+		coverage.IndexDigest = index.Descriptor.Digest.String()
+		coverage.IndexVersion = indexFormatVersion(index.Manifest)
+		coverage.ZtocCount = len(index.Manifest.Layers)
+		for _, ztoc := range index.Manifest.Layers {
+			ztocs[ztoc.Annotations[soci.IndexAnnotationImageLayerDigest]] = true
+		}
+	}
+
+	for _, layer := range manifest.Layers {
+		if ztocs[layer.Digest.String()] {
+			coverage.IndexedLayers = append(coverage.IndexedLayers, layer.Digest.String())
+			coverage.IndexedBytes += layer.Size
+		} else {
+			coverage.UnindexedLayers = append(coverage.UnindexedLayers, layer.Digest.String())
+		}
+	}
+	return coverage
+}
+
+// Returns the newest SOCI index of every image of a repository by image digest
+func newestIndexes(indexes []registryutils.SociIndexManifest) map[string]*registryutils.SociIndexManifest {
+	newest := map[string]*registryutils.SociIndexManifest{}
+	for i := range indexes {
+		index := &indexes[i]
+		imageDigest := index.ImageManifestDigest()
+		if current, ok := newest[imageDigest]; !ok || index.PushedAt.After(current.PushedAt) {
+			newest[imageDigest] = index
+		}
+	}
+	return newest
+}
+
+// Add the coverage of the images of a repository to a report
+func coverRepository(ctx context.Context, registry *registryutils.Registry, repo string, report *coverageReport) error {
+	ctx = log.With(ctx, log.RepositoryName, repo)
+	images, err := registry.ListAllImages(ctx, repo, defaultPageSize)
+	if err != nil {
+		return err
+	}
+
+	// Without the ECR API, indexes can only be found image by image with the referrers API
+	indexes, err := registry.ListSociIndexes(ctx, repo)
+	listed := err == nil
+	if err != nil && !errors.Is(err, registryutils.ErrManifestListingNotSupported) {
+		return err
+	}
+	byImage := newestIndexes(indexes)
+	byDigest := map[string]*registryutils.SociIndexManifest{}
+	for i := range indexes {
+		byDigest[indexes[i].Descriptor.Digest.String()] = &indexes[i]
+	}
+
+	seen := map[string]bool{}
+	for _, image := range images {
+		if seen[image.Digest] || !isIndexableImage(image) {
+			continue
+		}
+		seen[image.Digest] = true
+
+		manifest, err := registry.GetManifest(ctx, repo, image.Digest)
+		if err != nil {
+			return err
+		}
+
+		index := byImage[image.Digest]
+		// Images converted for SOCI index manifest v2 name their index
+		if indexDigest := manifest.Annotations[registryutils.ImageAnnotationSociIndexDigest]; indexDigest != "" && byDigest[indexDigest] != nil {
+			index = byDigest[indexDigest]
+		}
+		if index == nil && !listed {
+			found, err := registry.FindSociIndexes(ctx, repo, image.Digest)
+			if err != nil {
+				return err
+			}
+			index = newestIndexes(found)[image.Digest]
+		}
+
+		coverage := imageCoverageOf(repo, image, manifest, index)
+		report.add(coverage, manifest)
+	}
+	log.Info(ctx, fmt.Sprintf("Computed the SOCI index coverage of %d images", len(seen)))
+	return nil
+}
+
+func (report *coverageReport) add(coverage imageCoverage, manifest ocispec.Manifest) {
+	report.Images = append(report.Images, coverage)
+	report.Summary.ImageCount++
+	report.Summary.ImageBytes += coverage.Size
+	report.Summary.IndexedLayerBytes += coverage.IndexedBytes
+	for _, layer := range manifest.Layers {
+		report.Summary.LayerBytes += layer.Size
+	}
+	if coverage.Indexed {
+		report.Summary.IndexedImageCount++
+		report.Summary.IndexedImageBytes += coverage.Size
+	}
+}
+
+var coverageCSVHeader = []string{"repository", "digest", "tags", "size", "indexed", "indexDigest", "indexVersion", "ztocCount", "indexedLayers", "unindexedLayers", "indexedBytes"}
+
+// Write the images of a coverage report as CSV, one row per image. Lists are space separated.
+func writeCoverageCSV(w io.Writer, report coverageReport) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(coverageCSVHeader); err != nil {
+		return err
+	}
+	for _, image := range report.Images {
+		err := writer.Write([]string{
+			image.Repository,
+			image.Digest,
+			strings.Join(image.Tags, " "),
+			strconv.FormatInt(image.Size, 10),
+			strconv.FormatBool(image.Indexed),
+			image.IndexDigest,
+			image.IndexVersion,
+			strconv.Itoa(image.ZtocCount),
+			strings.Join(image.IndexedLayers, " "),
+			strings.Join(image.UnindexedLayers, " "),
+			strconv.FormatInt(image.IndexedBytes, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,95 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestImageCoverageOf(t *testing.T) {
+	image := registryutils.ImageDetail{Digest: "sha256:image", Tags: []string{"v1"}, Size: 300}
+	manifest := ocispec.Manifest{Layers: []ocispec.Descriptor{
+		{Digest: "sha256:big", Size: 200},
+		{Digest: "sha256:small", Size: 100},
+	}}
+
+	coverage := imageCoverageOf("repo", image, manifest, nil)
+	if coverage.Indexed || coverage.ZtocCount != 0 || len(coverage.IndexedLayers) != 0 || len(coverage.UnindexedLayers) != 2 {
+		t.Fatalf("Unexpected coverage of an image without a SOCI index %+v", coverage)
+	}
+
+	index := &registryutils.SociIndexManifest{
+		Descriptor: ocispec.Descriptor{Digest: "sha256:index"},
+		Manifest: ocispec.Manifest{
+			Config: ocispec.Descriptor{MediaType: soci.SociIndexArtifactType},
+			Layers: []ocispec.Descriptor{{Annotations: map[string]string{soci.IndexAnnotationImageLayerDigest: "sha256:big"}}},
+		},
+	}
+	coverage = imageCoverageOf("repo", image, manifest, index)
+	expected := imageCoverage{
+		Repository:      "repo",
+		Digest:          "sha256:image",
+		Tags:            []string{"v1"},
+		Size:            300,
+		Indexed:         true,
+		IndexDigest:     "sha256:index",
+		IndexVersion:    indexVersionV1,
+		ZtocCount:       1,
+		IndexedLayers:   []string{"sha256:big"},
+		UnindexedLayers: []string{"sha256:small"},
+		IndexedBytes:    200,
+	}
+	if !reflect.DeepEqual(coverage, expected) {
+		t.Fatalf("Expected coverage %+v, got %+v", expected, coverage)
+	}
+
+	var report coverageReport
+	report.add(coverage, manifest)
+	if report.Summary != (coverageSummary{ImageCount: 1, IndexedImageCount: 1, ImageBytes: 300, IndexedImageBytes: 300, LayerBytes: 300, IndexedLayerBytes: 200}) {
+		t.Fatalf("Unexpected summary %+v", report.Summary)
+	}
+
+	var csv bytes.Buffer
+	if err := writeCoverageCSV(&csv, report); err != nil {
+		t.Fatalf("Unexpected error writing CSV: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	if len(lines) != 2 || lines[1] != "repo,sha256:image,v1,300,true,sha256:index,v1,1,sha256:big,sha256:small,200" {
+		t.Fatalf("Unexpected CSV %q", csv.String())
+	}
+}
+
+func TestNewestIndexes(t *testing.T) {
+	now := time.Now()
+	index := func(name string, imageDigest string, pushedAt time.Time) registryutils.SociIndexManifest {
+		return registryutils.SociIndexManifest{
+			Descriptor: ocispec.Descriptor{Digest: digest.Digest("sha256:" + name)},
+			Manifest:   ocispec.Manifest{Subject: &ocispec.Descriptor{Digest: digest.Digest(imageDigest)}},
+			PushedAt:   pushedAt,
+		}
+	}
+
+	newest := newestIndexes([]registryutils.SociIndexManifest{
+		index("old", "sha256:a", now.Add(-time.Hour)),
+		index("new", "sha256:a", now),
+		index("only", "sha256:b", now),
+	})
+	if len(newest) != 2 || newest["sha256:a"].Descriptor.Digest != "sha256:new" || newest["sha256:b"].Descriptor.Digest != "sha256:only" {
+		t.Fatalf("Unexpected newest indexes %v", newest)
+	}
+
+	v2 := ocispec.Manifest{ArtifactType: registryutils.SociIndexArtifactTypeV2}
+	if indexFormatVersion(v2) != indexVersionV2 {
+		t.Fatalf("Expected a v2 index to be reported as v2")
+	}
+}
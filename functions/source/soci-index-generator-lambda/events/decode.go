@@ -0,0 +1,304 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package events
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Envelopes a request may be wrapped in
+const (
+	EnvelopeSQS         = "sqs"
+	EnvelopeSNS         = "sns"
+	EnvelopeEventBridge = "eventbridge"
+	EnvelopeCloudEvents = "cloudevents"
+	EnvelopeDirect      = "direct"
+	// Notifications of self-hosted registries
+	EnvelopeDistribution = "distribution"
+	EnvelopeHarbor       = "harbor"
+
+	sqsEventSource = "aws:sqs"
+	snsEventSource = "aws:sns"
+	// Envelopes nest at most this deep, e.g. an SNS notification delivered to SQS carrying a CloudEvent
+	maxEnvelopeDepth = 4
+)
+
+// Request to build the SOCI index of an image, sent to the function directly
+type BuildRequest struct {
+	// Registry host, e.g. "123456789012.dkr.ecr.us-east-1.amazonaws.com"
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	// Digest or tag of the image
+	Reference string `json:"reference"`
+	// The tag the image was pushed with, when the reference is its digest
+	Tag string `json:"tag,omitempty"`
+	// Build even if the image already has a SOCI index built with the current parameters
+	Force bool `json:"force"`
+}
+
+// What a request asks the function to do
+const (
+	// Build the SOCI index of an image
+	ActionBuild = "build"
+	// Remove the SOCI indexes a deleted image left behind
+	ActionDelete = "delete"
+	// Build the SOCI indexes of the images of a repository, a page at a time
+	ActionBackfill = "backfill"
+	// Report an image a pull through cache failed to sync from its upstream registry
+	ActionUpstreamFailure = "upstream-failure"
+)
+
+// Request to build the SOCI indexes of the images of a repository, a page at a time
+type BackfillRequest struct {
+	Registry   string
+	Repository string
+	// Token returned by the previous invocation to resume from, empty to start from the beginning
+	NextToken   string
+	PageSize    int
+	Concurrency int
+	// Maximum number of pages processed by the invocation, zero to process pages until the invocation times out
+	MaxPages int
+}
+
+// The sync of an image by a pull through cache from its upstream registry
+type UpstreamSync struct {
+	RegistryURL   string
+	Status        string
+	FailureCode   string
+	FailureReason string
+}
+
+// A request decoded from an invocation payload, once unwrapped from its envelopes. Whatever the envelopes, the
+// request names its action and what the action applies to, e.g. the image to build. An SQS message which notifies
+// no image push has no action.
+type Request struct {
+	// The envelopes of the request, outermost first, e.g. [sqs sns eventbridge]
+	Envelopes []string
+	// Id of the SQS message carrying the request, to report it as a batch item failure
+	MessageId string
+	// Id of the innermost envelope which has one
+	Id string
+	// What the request asks for, one of the Action constants, or empty when there is nothing to do
+	Action string
+	// When the event the request was decoded from happened, e.g. when the image was pushed. Zero if the
+	// envelopes don't tell.
+	Time time.Time
+	// The image to build, or whose SOCI indexes to remove, for build, delete and upstream failure requests
+	Build *BuildRequest
+	// The repository to backfill, for backfill requests
+	Backfill *BackfillRequest
+	// The sync of the image by a pull through cache, for the requests of pull through cache action events
+	Upstream *UpstreamSync
+	// Why the request couldn't be decoded. Only the requests of a batch carry their own error, so that the
+	// other requests of the batch are still handled. Retrying the request wouldn't help.
+	Err error
+}
+
+// Returns the envelopes of a request as a path, e.g. "sqs/sns/eventbridge"
+func (request Request) Envelope() string {
+	return strings.Join(request.Envelopes, "/")
+}
+
+// Decode an invocation payload, unwrapping SQS batches, SNS notifications, EventBridge events, CloudEvents 1.0
+// in structured JSON mode and direct build requests, in any nesting. An SQS batch decodes to a request per
+// message, Distribution notifications and Harbor webhooks to a request per pushed image, possibly none, and any
+// other payload to a single request.
+func Decode(payload []byte) ([]Request, error) {
+	return decode(payload, nil, "", 0)
+}
+
+// Check if requests were decoded from an SQS batch, whose failures are reported per message
+func IsSQSBatch(requests []Request) bool {
+	return len(requests) > 0 && len(requests[0].Envelopes) > 0 && requests[0].Envelopes[0] == EnvelopeSQS
+}
+
+func decode(payload []byte, envelopes []string, id string, depth int) ([]Request, error) {
+	if depth >= maxEnvelopeDepth {
+		return nil, fmt.Errorf("Envelopes %s nest deeper than %d levels", strings.Join(envelopes, "/"), maxEnvelopeDepth)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, fmt.Errorf("Payload is not a JSON object: %w", err)
+	}
+	has := func(keys ...string) bool {
+		for _, key := range keys {
+			if _, ok := fields[key]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+
+	switch {
+	case has("Records"):
+		return decodeRecords(fields["Records"], envelopes, depth)
+	case has("Type", "Message") || has("TopicArn", "Message"):
+		// An SNS notification delivered to SQS without raw message delivery
+		var notification struct {
+			MessageId string `json:"MessageId"`
+			Message   string `json:"Message"`
+		}
+		if err := json.Unmarshal(payload, &notification); err != nil {
+			return nil, fmt.Errorf("Invalid SNS notification: %w", err)
+		}
+		return decodeInner([]byte(notification.Message), wrap(envelopes, EnvelopeSNS), notification.MessageId, depth)
+	case has("specversion"):
+		return decodeCloudEvent(payload, envelopes, depth)
+	case has("detail-type", "detail"):
+		return decodeEventBridge(payload, envelopes)
+	case has("events"):
+		return decodeDistribution(payload, envelopes)
+	case has("type", "event_data"):
+		return decodeHarbor(payload, envelopes)
+	case has("registry") || has("repository") || has("reference"):
+		var build BuildRequest
+		if err := json.Unmarshal(payload, &build); err != nil {
+			return nil, fmt.Errorf("Invalid build request: %w", err)
+		}
+		var missing []string
+		for name, value := range map[string]string{"registry": build.Registry, "repository": build.Repository, "reference": build.Reference} {
+			if value == "" {
+				missing = append(missing, "'"+name+"'")
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			return nil, fmt.Errorf("The build request's %s must not be empty", strings.Join(missing, ", "))
+		}
+		return []Request{{Envelopes: wrap(envelopes, EnvelopeDirect), Id: id, Action: ActionBuild, Build: &build}}, nil
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return nil, fmt.Errorf("Unrecognized payload with fields %v: expected SQS or SNS records, an SNS notification, "+
+		"an EventBridge event ('detail-type' and 'detail'), a CloudEvent ('specversion'), a Distribution notification "+
+		"('events'), a Harbor webhook ('type' and 'event_data') or a build request ('registry', 'repository' and 'reference')", keys)
+}
+
+// Returns the envelopes of a payload found inside another envelope
+func wrap(envelopes []string, envelope string) []string {
+	return append(append([]string{}, envelopes...), envelope)
+}
+
+// Decode a payload found inside an envelope, wrapping its errors with the envelopes it was found in
+func decodeInner(payload []byte, envelopes []string, id string, depth int) ([]Request, error) {
+	requests, err := decode(payload, envelopes, id, depth+1)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", strings.Join(envelopes, "/"), err)
+	}
+	return requests, nil
+}
+
+func decodeRecords(payload json.RawMessage, envelopes []string, depth int) ([]Request, error) {
+	var records []struct {
+		// SQS names the event source "eventSource", SNS "EventSource"
+		EventSource    string `json:"eventSource"`
+		SNSEventSource string `json:"EventSource"`
+		MessageId      string `json:"messageId"`
+		Body           string `json:"body"`
+		Sns            struct {
+			MessageId string `json:"MessageId"`
+			Message   string `json:"Message"`
+		} `json:"Sns"`
+	}
+	if err := json.Unmarshal(payload, &records); err != nil {
+		return nil, fmt.Errorf("Invalid 'Records': %w", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("'Records' must not be empty")
+	}
+
+	var requests []Request
+	for i, record := range records {
+		switch {
+		case record.EventSource == sqsEventSource && len(envelopes) == 0:
+			// A message which can't be decoded is dropped alone rather than failing its whole batch, as redelivering
+			// it wouldn't help
+			inner := []string{EnvelopeSQS}
+			decoded, err := decodeInner([]byte(record.Body), inner, record.MessageId, depth)
+			if err != nil {
+				decoded = []Request{{Envelopes: inner, Err: err}}
+			}
+			// A message notifying no image push is a request with nothing to do, which succeeds
+			if len(decoded) == 0 {
+				decoded = []Request{{Envelopes: inner}}
+			}
+			for _, request := range decoded {
+				request.MessageId = record.MessageId
+				requests = append(requests, request)
+			}
+		case record.SNSEventSource == snsEventSource:
+			decoded, err := decodeInner([]byte(record.Sns.Message), wrap(envelopes, EnvelopeSNS), record.Sns.MessageId, depth)
+			if err != nil {
+				return nil, err
+			}
+			requests = append(requests, decoded...)
+		default:
+			return nil, fmt.Errorf("Record %d has the unsupported event source %q, expected %q as the outermost envelope or %q",
+				i, record.EventSource+record.SNSEventSource, sqsEventSource, snsEventSource)
+		}
+	}
+	return requests, nil
+}
+
+func decodeCloudEvent(payload []byte, envelopes []string, depth int) ([]Request, error) {
+	var event struct {
+		SpecVersion     string          `json:"specversion"`
+		Id              string          `json:"id"`
+		Source          string          `json:"source"`
+		Type            string          `json:"type"`
+		Time            string          `json:"time"`
+		DataContentType string          `json:"datacontenttype"`
+		Data            json.RawMessage `json:"data"`
+		DataBase64      string          `json:"data_base64"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("Invalid CloudEvent: %w", err)
+	}
+	if event.SpecVersion != "1.0" {
+		return nil, fmt.Errorf("Unsupported CloudEvents specversion %q, expected \"1.0\"", event.SpecVersion)
+	}
+	if event.Id == "" || event.Source == "" || event.Type == "" {
+		return nil, fmt.Errorf("The CloudEvent's 'id', 'source' and 'type' must not be empty")
+	}
+	if event.DataContentType != "" && !strings.HasPrefix(event.DataContentType, "application/json") && !strings.HasSuffix(event.DataContentType, "+json") {
+		return nil, fmt.Errorf("Unsupported CloudEvent datacontenttype %q, expected JSON", event.DataContentType)
+	}
+
+	data := []byte(event.Data)
+	if event.DataBase64 != "" {
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(event.DataBase64); err != nil {
+			return nil, fmt.Errorf("Invalid CloudEvent 'data_base64': %w", err)
+		}
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("The CloudEvent's 'data' must not be empty")
+	}
+	requests, err := decodeInner(data, wrap(envelopes, EnvelopeCloudEvents), event.Id, depth)
+	if err != nil {
+		return nil, err
+	}
+	// The time of the CloudEvent stands for the time of the requests of its data which don't tell theirs
+	for i := range requests {
+		if requests[i].Time.IsZero() {
+			requests[i].Time = parseTime(event.Time)
+		}
+	}
+	return requests, nil
+}
+
+// Parse the RFC 3339 time of an event, returning the zero time if it is invalid
+func parseTime(value string) time.Time {
+	parsed, _ := time.Parse(time.RFC3339, value)
+	return parsed
+}
@@ -0,0 +1,211 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package events
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testEventBridge = `{"id": "event", "detail-type": "ECR Image Action", "source": "aws.ecr", "account": "123456789012", "region": "us-east-1",
+		"time": "2024-05-01T12:00:00Z", "detail": {"action-type": "PUSH", "result": "SUCCESS", "repository-name": "repo", "image-digest": "sha256:a", "image-tag": "v1"}}`
+	testBuild = `{"registry": "localhost:5000", "repository": "repo", "reference": "v1"}`
+)
+
+func TestDecode(t *testing.T) {
+	snsNotification := `{"Type": "Notification", "MessageId": "notification", "TopicArn": "arn", "Message": ` + strconv.Quote(testEventBridge) + `}`
+	cloudEvent := `{"specversion": "1.0", "id": "cloudevent", "source": "ci", "type": "build", "time": "2024-05-02T12:00:00Z", "data": ` + testBuild + `}`
+	eventTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cloudEventTime := time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+	pushed := BuildRequest{Registry: "123456789012.dkr.ecr.us-east-1.amazonaws.com", Repository: "repo", Reference: "sha256:a", Tag: "v1"}
+	direct := BuildRequest{Registry: "localhost:5000", Repository: "repo", Reference: "v1"}
+
+	// Every envelope normalizes to a build request
+	tests := []struct {
+		name      string
+		payload   string
+		envelopes []string
+		id        string
+		time      time.Time
+		build     BuildRequest
+	}{
+		{"EventBridge event", testEventBridge, []string{EnvelopeEventBridge}, "event", eventTime, pushed},
+		{"build request", testBuild, []string{EnvelopeDirect}, "", time.Time{}, direct},
+		{"CloudEvent", cloudEvent, []string{EnvelopeCloudEvents, EnvelopeDirect}, "cloudevent", cloudEventTime, direct},
+		{"CloudEvent with base64 data", `{"specversion": "1.0", "id": "cloudevent", "source": "ci", "type": "build", "data_base64": "` +
+			base64.StdEncoding.EncodeToString([]byte(testEventBridge)) + `"}`, []string{EnvelopeCloudEvents, EnvelopeEventBridge}, "event", eventTime, pushed},
+		{"SNS record", `{"Records": [{"EventSource": "aws:sns", "Sns": {"MessageId": "sns", "Message": ` + strconv.Quote(cloudEvent) + `}}]}`,
+			[]string{EnvelopeSNS, EnvelopeCloudEvents, EnvelopeDirect}, "cloudevent", cloudEventTime, direct},
+		{"SNS notification in SQS", `{"Records": [{"eventSource": "aws:sqs", "messageId": "message", "body": ` + strconv.Quote(snsNotification) + `}]}`,
+			[]string{EnvelopeSQS, EnvelopeSNS, EnvelopeEventBridge}, "event", eventTime, pushed},
+	}
+	for _, test := range tests {
+		requests, err := Decode([]byte(test.payload))
+		if err != nil {
+			t.Fatalf("Unexpected error decoding the %s: %v", test.name, err)
+		}
+		if len(requests) != 1 {
+			t.Fatalf("Expected the %s to decode to a request, got %d", test.name, len(requests))
+		}
+		request := requests[0]
+		if !reflect.DeepEqual(request.Envelopes, test.envelopes) || request.Id != test.id || request.Action != ActionBuild ||
+			!request.Time.Equal(test.time) || request.Build == nil || *request.Build != test.build {
+			t.Fatalf("Unexpected request decoded from the %s: %+v", test.name, request)
+		}
+	}
+}
+
+func TestDecodeSQSBatch(t *testing.T) {
+	batch := `{"Records": [
+		{"eventSource": "aws:sqs", "messageId": "1", "body": ` + strconv.Quote(testBuild) + `},
+		{"eventSource": "aws:sqs", "messageId": "2", "body": "not json"}]}`
+	requests, err := Decode([]byte(batch))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding the batch: %v", err)
+	}
+	if !IsSQSBatch(requests) || len(requests) != 2 {
+		t.Fatalf("Expected a request per message, got %+v", requests)
+	}
+	if requests[0].MessageId != "1" || requests[0].Err != nil || *requests[0].Build != (BuildRequest{Registry: "localhost:5000", Repository: "repo", Reference: "v1"}) {
+		t.Fatalf("Unexpected first request %+v", requests[0])
+	}
+	if requests[1].MessageId != "2" || requests[1].Err == nil {
+		t.Fatalf("Expected the invalid message to carry its error, got %+v", requests[1])
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		payload  string
+		expected string
+	}{
+		{`[]`, "Payload is not a JSON object"},
+		{`{"image": "repo:tag"}`, "Unrecognized payload with fields [image]"},
+		{`{"registry": "localhost:5000", "reference": ""}`, "The build request's 'reference', 'repository' must not be empty"},
+		{`{"specversion": "0.3", "id": "1", "source": "ci", "type": "build", "data": {}}`, `Unsupported CloudEvents specversion "0.3"`},
+		{`{"specversion": "1.0", "id": "1", "source": "ci", "type": "build", "datacontenttype": "text/plain", "data": "x"}`, "Unsupported CloudEvent datacontenttype"},
+		{`{"specversion": "1.0", "id": "1", "source": "ci", "type": "build"}`, "The CloudEvent's 'data' must not be empty"},
+		{`{"Records": []}`, "'Records' must not be empty"},
+		{`{"Records": [{"eventSource": "aws:kinesis"}]}`, `Record 0 has the unsupported event source "aws:kinesis"`},
+		{`{"Records": [{"EventSource": "aws:sns", "Sns": {"Message": "{}"}}]}`, "sns: Unrecognized payload with fields []"},
+	}
+	for _, test := range tests {
+		_, err := Decode([]byte(test.payload))
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("Expected decoding %s to fail with %q, got %v", test.payload, test.expected, err)
+		}
+	}
+
+	// SQS batches only come first
+	nested := `{"Records": [{"eventSource": "aws:sqs", "messageId": "1", "body": ` + strconv.Quote(`{"Records": [{"eventSource": "aws:sqs", "body": "{}"}]}`) + `}]}`
+	requests, err := Decode([]byte(nested))
+	if err != nil || len(requests) != 1 || requests[0].Err == nil || !strings.Contains(requests[0].Err.Error(), "unsupported event source") {
+		t.Fatalf("Expected an SQS batch in an SQS message to be rejected, got %+v, %v", requests, err)
+	}
+}
+
+func TestDecodeRegistryWebhooks(t *testing.T) {
+	distribution := `{"events": [
+		{"id": "1", "action": "push", "target": {"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:a", "repository": "team/app", "tag": "v1", "url": "http://internal:5000/v2/team/app/manifests/sha256:a"}, "request": {"host": "registry.example.com"}},
+		{"id": "2", "action": "push", "target": {"mediaType": "application/octet-stream", "digest": "sha256:b", "repository": "team/app"}, "request": {"host": "registry.example.com"}},
+		{"id": "3", "action": "pull", "target": {"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:a", "repository": "team/app"}},
+		{"id": "4", "action": "push", "target": {"mediaType": "application/vnd.docker.distribution.manifest.v2+json", "digest": "sha256:c", "repository": "team/app", "url": "http://internal:5000/v2/team/app/manifests/sha256:c"}}]}`
+	requests, err := Decode([]byte(distribution))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding the Distribution notification: %v", err)
+	}
+	expected := []BuildRequest{
+		{Registry: "registry.example.com", Repository: "team/app", Reference: "sha256:a", Tag: "v1"},
+		{Registry: "internal:5000", Repository: "team/app", Reference: "sha256:c"},
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("Expected a request per image manifest push, got %+v", requests)
+	}
+	for i, request := range requests {
+		if *request.Build != expected[i] || request.Envelope() != EnvelopeDistribution || request.Action != ActionBuild {
+			t.Fatalf("Expected %+v, got %+v", expected[i], request)
+		}
+	}
+
+	harbor := `{"type": "PUSH_ARTIFACT", "occur_at": 1680000000, "operator": "admin", "event_data": {
+		"resources": [{"digest": "sha256:d", "tag": "latest", "resource_url": "harbor.example.com/library/app:latest"}],
+		"repository": {"name": "app", "namespace": "library", "repo_full_name": "library/app"}}}`
+	requests, err = Decode([]byte(harbor))
+	if err != nil || len(requests) != 1 || requests[0].Envelope() != EnvelopeHarbor || requests[0].Action != ActionBuild || requests[0].Time.Unix() != 1680000000 ||
+		*requests[0].Build != (BuildRequest{Registry: "harbor.example.com", Repository: "library/app", Reference: "sha256:d", Tag: "latest"}) {
+		t.Fatalf("Unexpected requests decoded from the Harbor webhook: %+v, %v", requests, err)
+	}
+
+	deleted := `{"type": "DELETE_ARTIFACT", "event_data": {"resources": [{"digest": "sha256:d"}]}}`
+	if requests, err := Decode([]byte(deleted)); err != nil || len(requests) != 0 {
+		t.Fatalf("Expected other Harbor webhooks to be ignored, got %+v, %v", requests, err)
+	}
+
+	// A message notifying no push still succeeds on its own
+	batch := `{"Records": [{"eventSource": "aws:sqs", "messageId": "1", "body": ` + strconv.Quote(deleted) + `}]}`
+	requests, err = Decode([]byte(batch))
+	if err != nil || len(requests) != 1 || requests[0].MessageId != "1" || requests[0].Action != "" || requests[0].Build != nil || requests[0].Err != nil {
+		t.Fatalf("Expected an empty request for the message, got %+v, %v", requests, err)
+	}
+
+	if _, err := Decode([]byte(`{"events": [{"action": "push", "target": {"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:a"}}]}`)); err == nil {
+		t.Fatalf("Expected an error for a push without a registry or repository")
+	}
+}
+
+func TestDecodeEventBridge(t *testing.T) {
+	event := func(detailType string, detail string) string {
+		return `{"id": "event", "detail-type": "` + detailType + `", "source": "aws.ecr", "account": "123456789012", "region": "cn-north-1", "detail": ` + detail + `}`
+	}
+	registry := "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn"
+	tests := []struct {
+		name    string
+		payload string
+		action  string
+	}{
+		{"image push", event(ECRImageActionDetailType, `{"action-type": "PUSH", "result": "SUCCESS", "repository-name": "repo", "image-digest": "sha256:a"}`), ActionBuild},
+		{"image deletion", event(ECRImageActionDetailType, `{"action-type": "DELETE", "result": "SUCCESS", "repository-name": "repo", "image-digest": "sha256:a"}`), ActionDelete},
+		{"pull through cache sync", event(ECRPullThroughCacheActionDetailType, `{"sync-status": "SUCCESS", "repository-name": "repo", "image-digest": "sha256:a"}`), ActionBuild},
+		{"failed pull through cache sync", event(ECRPullThroughCacheActionDetailType, `{"sync-status": "FAILED", "repository-name": "repo", "failure-code": "UPSTREAM_UNREACHABLE"}`), ActionUpstreamFailure},
+		{"backfill", event(SociIndexBackfillDetailType, `{"repository-name": "repo", "next-token": "token", "page-size": 10}`), ActionBackfill},
+	}
+	for _, test := range tests {
+		requests, err := Decode([]byte(test.payload))
+		if err != nil || len(requests) != 1 {
+			t.Fatalf("Expected the %s to decode to a request, got %+v, %v", test.name, requests, err)
+		}
+		request := requests[0]
+		if request.Action != test.action || request.Id != "event" {
+			t.Fatalf("Expected the %s to decode to a %s request, got %+v", test.name, test.action, request)
+		}
+		if request.Action == ActionBackfill {
+			if *request.Backfill != (BackfillRequest{Registry: registry, Repository: "repo", NextToken: "token", PageSize: 10}) {
+				t.Fatalf("Unexpected backfill request %+v", request.Backfill)
+			}
+		} else if request.Build.Registry != registry || request.Build.Repository != "repo" {
+			t.Fatalf("Expected the %s to name the image of the ECR registry, got %+v", test.name, request.Build)
+		}
+	}
+	requests, _ := Decode([]byte(tests[3].payload))
+	if upstream := requests[0].Upstream; upstream == nil || upstream.Status != "FAILED" || upstream.FailureCode != "UPSTREAM_UNREACHABLE" {
+		t.Fatalf("Expected the failed sync to be named, got %+v", upstream)
+	}
+
+	for payload, expected := range map[string]string{
+		event(ECRImageActionDetailType, `{"action-type": "PUSH", "result": "FAILURE", "repository-name": "repo", "image-digest": "sha256:a"}`): "The event's 'detail.result' must be 'SUCCESS'",
+		event(ECRPullThroughCacheActionDetailType, `{"sync-status": "SUCCESS", "repository-name": "repo"}`):                                    "The event's 'detail.image-digest' must not be empty",
+		event(SociIndexBackfillDetailType, `{}`):         "'detail.repository-name' must not be empty",
+		event("ECR Image Scan", `{}`):                    `Unsupported EventBridge detail type "ECR Image Scan"`,
+		event(ECRImageActionDetailType, `{"result": 1}`): "Invalid ECR Image Action event",
+	} {
+		if _, err := Decode([]byte(payload)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Expected decoding %s to fail with %q, got %v", payload, expected, err)
+		}
+	}
+}
@@ -3,6 +3,8 @@
 
 package events
 
+import "fmt"
+
 type ECRImageActionEventDetail struct {
 	Result         string `json:"result"`
 	RepositoryName string `json:"repository-name"`
@@ -22,3 +24,53 @@ type ECRImageActionEvent struct {
 	Resources  []string                  `json:"resources"`
 	Detail     ECRImageActionEventDetail `json:"detail"`
 }
+
+// Validate the event and normalize it to a build request for an image push, or a delete request for a deletion.
+// The repository name, digest and tag are validated when the request is handled, as for any other request.
+func (event ECRImageActionEvent) Request() (Request, error) {
+	var errors []error
+
+	if event.Source != "aws.ecr" {
+		errors = append(errors, fmt.Errorf("The event's 'source' must be 'aws.ecr'"))
+	}
+	if event.Account == "" {
+		errors = append(errors, fmt.Errorf("The event's 'account' must not be empty"))
+	}
+	if event.DetailType != ECRImageActionDetailType {
+		errors = append(errors, fmt.Errorf("The event's 'detail-type' must be '%s'", ECRImageActionDetailType))
+	}
+	if event.Detail.ActionType != "PUSH" && event.Detail.ActionType != "DELETE" {
+		errors = append(errors, fmt.Errorf("The event's 'detail.action-type' must be 'PUSH' or 'DELETE'"))
+	}
+	if event.Detail.Result != "SUCCESS" {
+		errors = append(errors, fmt.Errorf("The event's 'detail.result' must be 'SUCCESS'"))
+	}
+	if event.Detail.RepositoryName == "" {
+		errors = append(errors, fmt.Errorf("The event's 'detail.repository-name' must not be empty"))
+	}
+	if event.Detail.ImageDigest == "" {
+		errors = append(errors, fmt.Errorf("The event's 'detail.image-digest' must not be empty"))
+	}
+	if !accountId.MatchString(event.Account) {
+		errors = append(errors, fmt.Errorf("The event's 'account' must be a valid AWS account ID"))
+	}
+	if len(errors) > 0 {
+		return Request{}, errors[0]
+	}
+
+	action := ActionBuild
+	if event.Detail.ActionType == "DELETE" {
+		action = ActionDelete
+	}
+	return Request{
+		Id:     event.Id,
+		Action: action,
+		Time:   parseTime(event.Time),
+		Build: &BuildRequest{
+			Registry:   ECRRegistryURL(event.Account, event.Region),
+			Repository: event.Detail.RepositoryName,
+			Reference:  event.Detail.ImageDigest,
+			Tag:        event.Detail.ImageTag,
+		},
+	}, nil
+}
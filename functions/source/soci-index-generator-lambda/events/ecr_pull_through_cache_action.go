@@ -0,0 +1,84 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package events
+
+import "fmt"
+
+type ECRPullThroughCacheActionEventDetail struct {
+	RuleVersion         string `json:"rule-version"`
+	SyncStatus          string `json:"sync-status"`
+	EcrRepositoryPrefix string `json:"ecr-repository-prefix"`
+	RepositoryName      string `json:"repository-name"`
+	UpstreamRegistryUrl string `json:"upstream-registry-url"`
+	ImageTag            string `json:"image-tag"`
+	ImageDigest         string `json:"image-digest"`
+	FailureCode         string `json:"failure-code"`
+	FailureReason       string `json:"failure-reason"`
+}
+
+type ECRPullThroughCacheActionEvent struct {
+	Version    string                               `json:"version"`
+	Id         string                               `json:"id"`
+	DetailType string                               `json:"detail-type"`
+	Source     string                               `json:"source"`
+	Account    string                               `json:"account"`
+	Time       string                               `json:"time"`
+	Region     string                               `json:"region"`
+	Resources  []string                             `json:"resources"`
+	Detail     ECRPullThroughCacheActionEventDetail `json:"detail"`
+}
+
+// Validate the event and normalize it to a build request for a successful sync, or an upstream failure request
+// for a failed one. The repository name, digest and tag are validated when the request is handled.
+func (event ECRPullThroughCacheActionEvent) Request() (Request, error) {
+	var errors []error
+
+	if event.Source != "aws.ecr" {
+		errors = append(errors, fmt.Errorf("The event's 'source' must be 'aws.ecr'"))
+	}
+	if event.Account == "" {
+		errors = append(errors, fmt.Errorf("The event's 'account' must not be empty"))
+	}
+	if event.DetailType != ECRPullThroughCacheActionDetailType {
+		errors = append(errors, fmt.Errorf("The event's 'detail-type' must be '%s'", ECRPullThroughCacheActionDetailType))
+	}
+	if event.Detail.SyncStatus == "" {
+		errors = append(errors, fmt.Errorf("The event's 'detail.sync-status' must not be empty"))
+	}
+	if event.Detail.RepositoryName == "" {
+		errors = append(errors, fmt.Errorf("The event's 'detail.repository-name' must not be empty"))
+	}
+	if !accountId.MatchString(event.Account) {
+		errors = append(errors, fmt.Errorf("The event's 'account' must be a valid AWS account ID"))
+	}
+	// A failed sync may not carry an image digest
+	action := ActionUpstreamFailure
+	if event.Detail.SyncStatus == "SUCCESS" {
+		action = ActionBuild
+		if event.Detail.ImageDigest == "" {
+			errors = append(errors, fmt.Errorf("The event's 'detail.image-digest' must not be empty"))
+		}
+	}
+	if len(errors) > 0 {
+		return Request{}, errors[0]
+	}
+
+	return Request{
+		Id:     event.Id,
+		Action: action,
+		Time:   parseTime(event.Time),
+		Build: &BuildRequest{
+			Registry:   ECRRegistryURL(event.Account, event.Region),
+			Repository: event.Detail.RepositoryName,
+			Reference:  event.Detail.ImageDigest,
+			Tag:        event.Detail.ImageTag,
+		},
+		Upstream: &UpstreamSync{
+			RegistryURL:   event.Detail.UpstreamRegistryUrl,
+			Status:        event.Detail.SyncStatus,
+			FailureCode:   event.Detail.FailureCode,
+			FailureReason: event.Detail.FailureReason,
+		},
+	}, nil
+}
@@ -0,0 +1,78 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	ECRImageActionDetailType            = "ECR Image Action"
+	ECRPullThroughCacheActionDetailType = "ECR Pull Through Cache Action"
+	SociIndexBackfillDetailType         = "SOCI Index Backfill"
+)
+
+var accountId = regexp.MustCompile(`[0-9]{12}`)
+
+// Event is the EventBridge envelope shared by all ECR events.
+// The detail is left undecoded so that the event can be dispatched on its detail type.
+type Event struct {
+	Version    string          `json:"version"`
+	Id         string          `json:"id"`
+	DetailType string          `json:"detail-type"`
+	Source     string          `json:"source"`
+	Account    string          `json:"account"`
+	Time       string          `json:"time"`
+	Region     string          `json:"region"`
+	Resources  []string        `json:"resources"`
+	Detail     json.RawMessage `json:"detail"`
+}
+
+// Returns the url of the ECR registry of an account in a region
+func ECRRegistryURL(account string, region string) string {
+	var awsDomain = ".amazonaws.com"
+	if strings.HasPrefix(region, "cn") {
+		awsDomain = ".amazonaws.com.cn"
+	}
+	return account + ".dkr.ecr." + region + awsDomain
+}
+
+// Decode an EventBridge event to the request of its detail type
+func decodeEventBridge(payload []byte, envelopes []string) ([]Request, error) {
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("Invalid EventBridge event: %w", err)
+	}
+
+	var request Request
+	var err error
+	switch event.DetailType {
+	case ECRImageActionDetailType:
+		var imageAction ECRImageActionEvent
+		if err = json.Unmarshal(payload, &imageAction); err == nil {
+			request, err = imageAction.Request()
+		}
+	case ECRPullThroughCacheActionDetailType:
+		var pullThroughCacheAction ECRPullThroughCacheActionEvent
+		if err = json.Unmarshal(payload, &pullThroughCacheAction); err == nil {
+			request, err = pullThroughCacheAction.Request()
+		}
+	case SociIndexBackfillDetailType:
+		var backfill SociIndexBackfillEvent
+		if err = json.Unmarshal(payload, &backfill); err == nil {
+			request, err = backfill.Request()
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported EventBridge detail type %q, expected %q, %q or %q", event.DetailType,
+			ECRImageActionDetailType, ECRPullThroughCacheActionDetailType, SociIndexBackfillDetailType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s event: %w", event.DetailType, err)
+	}
+	request.Envelopes = wrap(envelopes, EnvelopeEventBridge)
+	return []Request{request}, nil
+}
@@ -0,0 +1,144 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	HarborPushArtifactType = "PUSH_ARTIFACT"
+
+	distributionPushAction = "push"
+)
+
+// Manifests a SOCI index can be built for. Distribution notifies pushes of blobs, image indexes and
+// artifacts too, and a multi-platform push notifies the push of each platform's manifest.
+var imageManifestMediaTypes = map[string]bool{
+	"application/vnd.docker.distribution.manifest.v2+json": true,
+	"application/vnd.oci.image.manifest.v1+json":           true,
+}
+
+// Notification envelope of a Docker Distribution registry
+// Reference: https://distribution.github.io/distribution/about/notifications/
+type DistributionNotification struct {
+	Events []DistributionEvent `json:"events"`
+}
+
+type DistributionEvent struct {
+	Id        string `json:"id"`
+	Timestamp string `json:"timestamp"`
+	Action    string `json:"action"`
+	Target    struct {
+		MediaType  string `json:"mediaType"`
+		Digest     string `json:"digest"`
+		Repository string `json:"repository"`
+		Tag        string `json:"tag"`
+		URL        string `json:"url"`
+	} `json:"target"`
+	Request struct {
+		// The registry host the client pushed to
+		Host string `json:"host"`
+	} `json:"request"`
+}
+
+// Webhook payload of a Harbor registry
+// Reference: https://goharbor.io/docs/main/working-with-projects/project-configuration/configure-webhooks/
+type HarborWebhook struct {
+	Type string `json:"type"`
+	// Unix time of the event
+	OccurAt   int64 `json:"occur_at"`
+	EventData struct {
+		Resources []struct {
+			Digest string `json:"digest"`
+			Tag    string `json:"tag"`
+			// "<registry host>/<repository>:<tag>"
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+		Repository struct {
+			RepoFullName string `json:"repo_full_name"`
+		} `json:"repository"`
+	} `json:"event_data"`
+}
+
+// Decode the image manifest pushes of a Distribution notification to build requests against the registry
+// the images were pushed to. Other events are ignored.
+func decodeDistribution(payload []byte, envelopes []string) ([]Request, error) {
+	var notification DistributionNotification
+	if err := json.Unmarshal(payload, &notification); err != nil {
+		return nil, fmt.Errorf("Invalid Distribution notification: %w", err)
+	}
+
+	envelopes = wrap(envelopes, EnvelopeDistribution)
+	requests := []Request{}
+	for i, event := range notification.Events {
+		if event.Action != distributionPushAction || !imageManifestMediaTypes[event.Target.MediaType] {
+			continue
+		}
+		registry := event.Request.Host
+		if registry == "" {
+			if targetURL, err := url.Parse(event.Target.URL); err == nil {
+				registry = targetURL.Host
+			}
+		}
+		if registry == "" || event.Target.Repository == "" || event.Target.Digest == "" {
+			return nil, fmt.Errorf("Distribution event %d must have a 'request.host' or 'target.url', a 'target.repository' and a 'target.digest'", i)
+		}
+		requests = append(requests, Request{
+			Envelopes: envelopes,
+			Id:        event.Id,
+			Action:    ActionBuild,
+			Time:      parseTime(event.Timestamp),
+			Build: &BuildRequest{
+				Registry:   registry,
+				Repository: event.Target.Repository,
+				Reference:  event.Target.Digest,
+				Tag:        event.Target.Tag,
+			},
+		})
+	}
+	return requests, nil
+}
+
+// Decode the artifacts of a Harbor PUSH_ARTIFACT webhook to build requests against the Harbor registry.
+// Other webhooks are ignored.
+func decodeHarbor(payload []byte, envelopes []string) ([]Request, error) {
+	var webhook HarborWebhook
+	if err := json.Unmarshal(payload, &webhook); err != nil {
+		return nil, fmt.Errorf("Invalid Harbor webhook: %w", err)
+	}
+
+	envelopes = wrap(envelopes, EnvelopeHarbor)
+	requests := []Request{}
+	if webhook.Type != HarborPushArtifactType {
+		return requests, nil
+	}
+	repository := webhook.EventData.Repository.RepoFullName
+	var occurredAt time.Time
+	if webhook.OccurAt > 0 {
+		occurredAt = time.Unix(webhook.OccurAt, 0).UTC()
+	}
+	for i, resource := range webhook.EventData.Resources {
+		registry, _, _ := strings.Cut(resource.ResourceURL, "/")
+		if registry == "" || repository == "" || resource.Digest == "" {
+			return nil, fmt.Errorf("Harbor resource %d must have a 'resource_url', a 'digest' and the webhook an 'event_data.repository.repo_full_name'", i)
+		}
+		requests = append(requests, Request{
+			Envelopes: envelopes,
+			Action:    ActionBuild,
+			Time:      occurredAt,
+			Build: &BuildRequest{
+				Registry:   registry,
+				Repository: repository,
+				Reference:  resource.Digest,
+				Tag:        resource.Tag,
+			},
+		})
+	}
+	return requests, nil
+}
@@ -0,0 +1,50 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package events
+
+import "fmt"
+
+// Requests indexing the images of a repository which were pushed before the builder was deployed.
+// The registry is the ECR registry of the event's account and region.
+type SociIndexBackfillEventDetail struct {
+	RepositoryName string `json:"repository-name"`
+	// Token returned by the previous invocation to resume from, empty to start from the beginning
+	NextToken   string `json:"next-token"`
+	PageSize    int    `json:"page-size"`
+	Concurrency int    `json:"concurrency"`
+	// Maximum number of pages processed by the invocation, zero to process pages until the invocation times out
+	MaxPages int `json:"max-pages"`
+}
+
+type SociIndexBackfillEvent struct {
+	Version    string                       `json:"version"`
+	Id         string                       `json:"id"`
+	DetailType string                       `json:"detail-type"`
+	Source     string                       `json:"source"`
+	Account    string                       `json:"account"`
+	Time       string                       `json:"time"`
+	Region     string                       `json:"region"`
+	Resources  []string                     `json:"resources"`
+	Detail     SociIndexBackfillEventDetail `json:"detail"`
+}
+
+// Validate the event and normalize it to a backfill request
+func (event SociIndexBackfillEvent) Request() (Request, error) {
+	if event.Account == "" || event.Region == "" || event.Detail.RepositoryName == "" {
+		return Request{}, fmt.Errorf("The event's 'account', 'region' and 'detail.repository-name' must not be empty")
+	}
+	return Request{
+		Id:     event.Id,
+		Action: ActionBackfill,
+		Time:   parseTime(event.Time),
+		Backfill: &BackfillRequest{
+			Registry:    ECRRegistryURL(event.Account, event.Region),
+			Repository:  event.Detail.RepositoryName,
+			NextToken:   event.Detail.NextToken,
+			PageSize:    event.Detail.PageSize,
+			Concurrency: event.Detail.Concurrency,
+			MaxPages:    event.Detail.MaxPages,
+		},
+	}, nil
+}
@@ -0,0 +1,15 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package events
+
+// The response to a batch of SQS messages, listing the messages SQS must redeliver.
+// Requires the ReportBatchItemFailures function response type on the event source mapping.
+type SQSBatchResponse struct {
+	BatchItemFailures []SQSBatchItemFailure `json:"batchItemFailures"`
+}
+
+type SQSBatchItemFailure struct {
+	// The id of the failed message
+	ItemIdentifier string `json:"itemIdentifier"`
+}
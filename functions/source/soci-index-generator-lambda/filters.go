@@ -0,0 +1,57 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/filter"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+const (
+	// Comma-separated list of "<repository>:<tag>" rules, with shell-style wildcards, selecting the images to index.
+	// Same as the filters the event filtering Lambda applies, defaults to every image.
+	repositoryImageTagFiltersEnv = "SOCI_REPOSITORY_IMAGE_TAG_FILTERS"
+	// Comma-separated list of "<repository>:<tag>" rules skipping images the include rules select
+	repositoryImageTagExcludeFiltersEnv = "SOCI_REPOSITORY_IMAGE_TAG_EXCLUDE_FILTERS"
+
+	FilteredMessage = "skipped: filtered"
+)
+
+// Read the repository image tag filter from the environment
+func imageFilter() (*filter.Filter, error) {
+	return filter.New(splitRules(os.Getenv(repositoryImageTagFiltersEnv)), splitRules(os.Getenv(repositoryImageTagExcludeFiltersEnv)))
+}
+
+func splitRules(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// Returns the result of an image skipped by the filter, naming the rule it was skipped by
+func filteredMessage(decision filter.Decision) string {
+	return fmt.Sprintf("%s: %s", FilteredMessage, decision)
+}
+
+// Evaluate the filter for an image pushed with a tag, empty for a digest-only push.
+// Returns the result of the skipped image, or an empty string if the image must be indexed.
+func skipFiltered(ctx context.Context, repo string, tag string) (string, error) {
+	imageTagFilter, err := imageFilter()
+	if err != nil {
+		return "", err
+	}
+	decision := imageTagFilter.Evaluate(repo, tag)
+	if decision.Included {
+		return "", nil
+	}
+	msg := filteredMessage(decision)
+	log.Info(ctx, msg)
+	return msg, nil
+}
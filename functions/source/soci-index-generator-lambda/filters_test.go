@@ -0,0 +1,51 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import "testing"
+
+func TestImageFilter(t *testing.T) {
+	t.Setenv(repositoryImageTagFiltersEnv, "")
+	t.Setenv(repositoryImageTagExcludeFiltersEnv, "")
+	imageTagFilter, err := imageFilter()
+	if err != nil {
+		t.Fatalf("Unexpected error reading the filter: %v", err)
+	}
+	if !imageTagFilter.EvaluateTags("any/repo", nil).Included {
+		t.Fatalf("Expected the default filter to include every image")
+	}
+
+	t.Setenv(repositoryImageTagFiltersEnv, "prod/*:v[0-9]*, dev:latest")
+	t.Setenv(repositoryImageTagExcludeFiltersEnv, "prod/*:*-rc")
+	imageTagFilter, err = imageFilter()
+	if err != nil {
+		t.Fatalf("Unexpected error reading the filter: %v", err)
+	}
+	tests := []struct {
+		repo     string
+		tag      string
+		expected string
+	}{
+		{"prod/app", "v1.2", ""},
+		{"dev", "latest", ""},
+		{"prod/app", "v1.2-rc", `skipped: filtered: matched exclude rule "prod/*:*-rc"`},
+		{"prod/app", "latest", "skipped: filtered: matched no include rule"},
+		{"prod/app", "", "skipped: filtered: matched no include rule"},
+	}
+	for _, test := range tests {
+		decision := imageTagFilter.Evaluate(test.repo, test.tag)
+		actual := ""
+		if !decision.Included {
+			actual = filteredMessage(decision)
+		}
+		if actual != test.expected {
+			t.Fatalf("Expected %s:%s to be %q, got %q", test.repo, test.tag, test.expected, actual)
+		}
+	}
+
+	t.Setenv(repositoryImageTagFiltersEnv, "no-tag")
+	if _, err := imageFilter(); err == nil {
+		t.Fatalf("Expected an error for an invalid rule")
+	}
+}
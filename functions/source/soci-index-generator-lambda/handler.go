@@ -5,6 +5,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"regexp"
@@ -18,17 +19,19 @@ import (
 	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/events"
 	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/fs"
 	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/metrics"
 	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/tracing"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
 	"oras.land/oras-go/v2/content/oci"
 
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/soci/store"
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/content/local"
-	"github.com/containerd/containerd/platforms"
 
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -43,22 +46,187 @@ const (
 	PushFailedMessage           = "SOCI index push error"
 	SkipPushOnEmptyIndexMessage = "Skipping pushing SOCI index as it does not contain any zTOCs"
 	BuildAndPushSuccessMessage  = "Successfully built and pushed SOCI index"
+	// The registry rejected OCI artifacts, so the index was pushed with the legacy registry encoding
+	BuildAndPushLegacySuccessMessage = "Successfully built and pushed SOCI index with the legacy registry encoding"
+	// SOCI index manifest v2 was configured, but the image has no tag to push its image index with
+	BuildAndPushUntaggedV1SuccessMessage = "Successfully built and pushed SOCI index v1, the image has no tag to push a SOCI index manifest v2 with"
+	AlreadyIndexedMessage                = "skipped: already indexed"
+	SociEnabledImageMessage              = "skipped: image is bound to a SOCI index v2"
+	NoImagePushMessage                   = "skipped: no image push in the notification"
+	RegistryNotAllowedMessage            = "skipped: registry not allowed"
+	UpstreamSyncFailedMessage            = "Pull through cache upstream sync error"
+	UpstreamPullFailedMessage            = "Pull through cache upstream registry error"
+
+	// Directory the builds store images and SOCI artifacts in, /tmp by default
+	workDirEnv = "SOCI_WORK_DIR"
 
 	artifactsStoreName = "store"
 	artifactsDbName    = "artifacts.db"
 )
 
 func HandleRequest(ctx context.Context, event events.ECRImageActionEvent) (string, error) {
-	ctx, err := validateEvent(ctx, event)
+	ctx = log.With(ctx, log.EventId, event.Id)
+	request, err := event.Request()
 	if err != nil {
-		return lambdaError(ctx, "ECRImageActionEvent validation error", err)
+		return invalidRequest(ctx, "ECRImageActionEvent validation error", err)
 	}
+	return handleRequest(ctx, request)
+}
 
-	repo := event.Detail.RepositoryName
-	digest := event.Detail.ImageDigest
-	registryUrl := buildEcrRegistryUrl(event)
-	ctx = context.WithValue(ctx, "RegistryURL", registryUrl)
+// Handle an invocation, whatever the envelopes its requests come in. The messages of an SQS batch are handled
+// concurrently and their failures reported per message, any other payload holds a single request.
+func HandleInvocation(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	ctx, span := tracing.Start(tracing.FromLambda(ctx), "invocation")
+	result, err := handleInvocation(ctx, payload)
+	tracing.End(span, err)
+	// The function is frozen once the invocation returns
+	tracing.Flush(ctx)
+	return result, err
+}
 
+func handleInvocation(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	requests, err := events.Decode(payload)
+	if err != nil {
+		return lambdaError(ctx, "Event decoding error", err)
+	}
+	if events.IsSQSBatch(requests) {
+		return handleSQSBatch(ctx, requests)
+	}
+
+	if len(requests) == 0 {
+		log.Info(ctx, NoImagePushMessage)
+		return NoImagePushMessage, nil
+	}
+
+	// SNS invokes the function with a single record, there is a single result
+	var msg string
+	for _, request := range requests {
+		if msg, err = handleDecodedRequest(ctx, request); err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
+}
+
+// Handle a request unwrapped from its envelopes
+func handleDecodedRequest(ctx context.Context, request events.Request) (string, error) {
+	if request.Id != "" {
+		ctx = log.With(ctx, log.EventId, request.Id)
+	}
+	if request.Err != nil {
+		return invalidRequest(ctx, "Event decoding error", request.Err)
+	}
+	switch request.Action {
+	case "":
+		log.Info(ctx, NoImagePushMessage)
+		return NoImagePushMessage, nil
+	case events.ActionBuild:
+		// Build requests name the image in their result, whatever envelope they came in
+		result, err := buildByReference(ctx, *request.Build, request.Time)
+		if err != nil {
+			return result.Result, err
+		}
+		return encodeBuildResult(ctx, result)
+	}
+	return handleRequest(ctx, request)
+}
+
+// Handle a request according to its action, returning the result of the action
+func handleRequest(ctx context.Context, request events.Request) (string, error) {
+	if request.Upstream != nil && request.Upstream.RegistryURL != "" {
+		ctx = log.With(ctx, log.UpstreamRegistryURL, request.Upstream.RegistryURL)
+	}
+
+	switch request.Action {
+	case events.ActionBuild:
+		result, err := buildByReference(ctx, *request.Build, request.Time)
+		return result.Result, err
+	case events.ActionUpstreamFailure:
+		// The image was never cached, so there is nothing to build. This is an upstream failure and
+		// retrying the build would not help, so we report it without returning an error.
+		ctx = log.With(ctx, log.RepositoryName, request.Build.Repository)
+		err := fmt.Errorf("Sync status %s, failure code: %s, failure reason: %s", request.Upstream.Status, request.Upstream.FailureCode, request.Upstream.FailureReason)
+		log.Error(ctx, UpstreamSyncFailedMessage, err)
+		return UpstreamSyncFailedMessage, nil
+	}
+
+	// Builds check the registry of their image themselves
+	if msg, err := skipNotAllowed(ctx, requestRegistry(request)); err != nil {
+		return lambdaError(ctx, "Registry allowlist error", err)
+	} else if msg != "" {
+		return msg, nil
+	}
+	switch request.Action {
+	case events.ActionDelete:
+		ctx = log.With(ctx, log.RegistryURL, request.Build.Registry)
+		ctx, errors := validateImageDetail(ctx, request.Build.Repository, request.Build.Reference, request.Build.Tag)
+		if len(errors) > 0 {
+			return invalidRequest(ctx, "Delete request validation error", errors[0])
+		}
+		return removeOrphanedIndexes(ctx, request.Build.Registry, request.Build.Repository, request.Build.Reference)
+	case events.ActionBackfill:
+		return handleBackfill(ctx, *request.Backfill)
+	}
+	return invalidRequest(ctx, "Request validation error", fmt.Errorf("Unsupported action %q", request.Action))
+}
+
+// An image to build a SOCI index for
+type buildRequest struct {
+	RegistryURL string
+	Repository  string
+	Digest      string
+	// The tag the image was pushed with, if any, which names the image index of SOCI index manifest v2
+	Tag string
+	// Build even if the image already has a SOCI index built with the current parameters
+	Force bool
+	// When the image was pushed, if known
+	PushedAt time.Time
+}
+
+// Pull an image, build its SOCI index and push the index back to the image's repository
+func buildAndPushIndex(ctx context.Context, req buildRequest) (string, error) {
+	ctx, build := metrics.StartBuild(ctx, req.Repository, req.Digest)
+	msg, err := buildAndPushIndexPhases(ctx, req, build)
+	build.Finish(ctx, buildOutcome(msg, err), err)
+	return msg, err
+}
+
+// Returns the outcome of a build from its result
+func buildOutcome(msg string, err error) string {
+	switch {
+	case err != nil:
+		return metrics.OutcomeFailed
+	case strings.HasPrefix(msg, BuildAndPushSuccessMessage):
+		return metrics.OutcomeBuilt
+	}
+	return metrics.OutcomeSkipped
+}
+
+func buildAndPushIndexPhases(ctx context.Context, req buildRequest, build *metrics.Build) (string, error) {
+	registryUrl, repo, digest, tag := req.RegistryURL, req.Repository, req.Digest, req.Tag
+	ctx = log.With(ctx, log.RegistryURL, registryUrl)
+
+	destinations, err := replicationDestinations(registryUrl)
+	if err != nil {
+		return lambdaError(ctx, "Replication configuration error", err)
+	}
+
+	params, err := loadBuildParameters(repo)
+	if err != nil {
+		return lambdaError(ctx, "Build parameters configuration error", err)
+	}
+	ctx = log.With(ctx, log.Platform, platforms.Format(params.Platform))
+	labelLimits, err := loadDirectiveLimits()
+	if err != nil {
+		return lambdaError(ctx, "Label directives configuration error", err)
+	}
+	referrersMode := referrersModeEnabled()
+	indexTagName, err := indexTag(digest, params.Platform)
+	if err != nil {
+		return lambdaError(ctx, "SOCI index tag configuration error", err)
+	}
+
+	ctx = build.StartPhase(ctx, metrics.PhaseValidate)
 	registry, err := registryutils.Init(ctx, registryUrl)
 	if err != nil {
 		return lambdaError(ctx, "Remote registry initialization error", err)
@@ -66,11 +234,64 @@ func HandleRequest(ctx context.Context, event events.ECRImageActionEvent) (strin
 
 	err = registry.ValidateImageManifest(ctx, repo, digest)
 	if err != nil {
+		if registryutils.IsUpstreamError(err) {
+			return lambdaError(ctx, UpstreamPullFailedMessage, err)
+		}
 		log.Warn(ctx, fmt.Sprintf("Image manifest validation error: %v", err))
 		// Returning a non error to skip retries
 		return "Exited early due to manifest validation error", nil
 	}
 
+	// Converting an image for SOCI index manifest v2 pushes a new image manifest, which must not be indexed again
+	manifest, err := registry.GetManifest(ctx, repo, digest)
+	if err != nil {
+		return lambdaError(ctx, "Image manifest fetch error", err)
+	}
+	if manifest.Annotations[registryutils.ImageAnnotationSociIndexDigest] != "" {
+		log.Info(ctx, SociEnabledImageMessage)
+		return SociEnabledImageMessage, nil
+	}
+
+	// Image authors control the build with the labels of the image
+	config, err := registry.GetImageConfig(ctx, repo, manifest)
+	if err != nil {
+		return lambdaError(ctx, "Image config fetch error", err)
+	}
+	params, skipMessage := applyLabelDirectives(ctx, params, config, labelLimits)
+	if skipMessage != "" {
+		log.Info(ctx, skipMessage)
+		return skipMessage, nil
+	}
+
+	// The image index of SOCI index manifest v2 is tagged after the image, an image pushed by digest only gets a
+	// v1 index rather than an untagged image index nothing would ever pull
+	untaggedV1 := params.IndexVersion == indexVersionV2 && v2Tag(tag) == ""
+	if untaggedV1 {
+		log.Warn(ctx, "Image has no tag to push the SOCI index manifest v2 image index with, building a v1 index instead")
+		params.IndexVersion = indexVersionV1
+	}
+
+	// Re-tagging an image emits a new PUSH event for the same digest, which doesn't need a new index
+	if !req.Force {
+		existingIndex, err := findExistingIndex(ctx, registry, repo, digest, tag, params)
+		if err != nil {
+			log.Warn(ctx, fmt.Sprintf("Unable to check for an existing SOCI index, building anyway: %v", err))
+		} else if existingIndex != nil {
+			ctx = log.With(ctx, log.SOCIIndexDigest, existingIndex.Descriptor.Digest.String())
+			// The build which pushed the index may have failed to replicate it, retrying it copies the index
+			if len(destinations) > 0 {
+				ctx = build.StartPhase(ctx, metrics.PhaseReplicate)
+				copyIndex := copyExistingIndex(registry, *existingIndex, repo, digest, tag, indexTagName)
+				outcomes := replicateIndex(ctx, copyIndex, repo, digest, destinations)
+				if err := replicationError(outcomes); err != nil {
+					return lambdaError(ctx, ReplicationFailedMessage, err)
+				}
+			}
+			log.Info(ctx, AlreadyIndexedMessage)
+			return AlreadyIndexedMessage, nil
+		}
+	}
+
 	// Directory in lambda storage to store images and SOCI artifacts
 	dataDir, err := createTempDir(ctx)
 	if err != nil {
@@ -80,9 +301,7 @@ func HandleRequest(ctx context.Context, event events.ECRImageActionEvent) (strin
 
 	// The channel to signal the deadline monitor goroutine to exit early
 	quitChannel := make(chan int)
-	defer func() {
-		quitChannel <- 1
-	}()
+	defer close(quitChannel)
 
 	setDeadline(ctx, quitChannel, dataDir)
 
@@ -91,8 +310,12 @@ func HandleRequest(ctx context.Context, event events.ECRImageActionEvent) (strin
 		return lambdaError(ctx, "OCI storage initialization error", err)
 	}
 
+	ctx = build.StartPhase(ctx, metrics.PhasePull)
 	desc, err := registry.Pull(ctx, repo, sociStore, digest)
 	if err != nil {
+		if registryutils.IsUpstreamError(err) {
+			return lambdaError(ctx, UpstreamPullFailedMessage, err)
+		}
 		return lambdaError(ctx, "Image pull error", err)
 	}
 
@@ -101,7 +324,8 @@ func HandleRequest(ctx context.Context, event events.ECRImageActionEvent) (strin
 		Target: *desc,
 	}
 
-	indexDescriptor, err := buildIndex(ctx, dataDir, sociStore, image)
+	ctx = build.StartPhase(ctx, metrics.PhaseBuild)
+	indexDescriptor, err := buildIndex(ctx, dataDir, sociStore, image, params)
 	if err != nil {
 		if err.Error() == ErrEmptyIndex.Error() {
 			log.Warn(ctx, SkipPushOnEmptyIndexMessage)
@@ -109,120 +333,135 @@ func HandleRequest(ctx context.Context, event events.ECRImageActionEvent) (strin
 		}
 		return lambdaError(ctx, BuildFailedMessage, err)
 	}
-	ctx = context.WithValue(ctx, "SOCIIndexDigest", indexDescriptor.Digest.String())
 
-	err = registry.Push(ctx, sociStore, *indexDescriptor, repo)
-	if err != nil {
-		return lambdaError(ctx, PushFailedMessage, err)
+	var pushIndex pushIndexFunc
+	switch {
+	case params.IndexVersion == indexVersionV2:
+		// SOCI index manifest v2 has no subject, so referrers mode doesn't apply to it, and its image index
+		// is tagged after the image rather than with the SOCI index tag
+		imageIndexDescriptor, err := convertToIndexV2(ctx, sociStore, *desc, *indexDescriptor)
+		if err != nil {
+			return lambdaError(ctx, BuildFailedMessage, err)
+		}
+		indexDescriptor = &imageIndexDescriptor
+		pushIndex = func(ctx context.Context, registry *registryutils.Registry) (string, error) {
+			return pushIndexV2(ctx, registry, sociStore, imageIndexDescriptor, repo, tag)
+		}
+	case referrersMode:
+		referrerDescriptor, err := encodeAsReferrer(ctx, sociStore, *indexDescriptor)
+		if err != nil {
+			return lambdaError(ctx, BuildFailedMessage, err)
+		}
+		indexDescriptor = &referrerDescriptor
+		pushIndex = pushIndexV1(sociStore, referrerDescriptor, repo, digest, indexTagName, true)
+	default:
+		pushIndex = pushIndexV1(sociStore, *indexDescriptor, repo, digest, indexTagName, false)
 	}
+	ctx = log.With(ctx, log.SOCIIndexDigest, indexDescriptor.Digest.String())
 
-	log.Info(ctx, BuildAndPushSuccessMessage)
-	return BuildAndPushSuccessMessage, nil
-}
-
-// Validate the given event, populating the context with relevant valid event properties
-func validateEvent(ctx context.Context, event events.ECRImageActionEvent) (context.Context, error) {
-	var errors []error
-
-	if event.Source != "aws.ecr" {
-		errors = append(errors, fmt.Errorf("The event's 'source' must be 'aws.ecr'"))
-	}
-	if event.Account == "" {
-		errors = append(errors, fmt.Errorf("The event's 'account' must not be empty"))
-	}
-	if event.DetailType != "ECR Image Action" {
-		errors = append(errors, fmt.Errorf("The event's 'detail-type' must be 'ECR Image Action'"))
-	}
-	if event.Detail.ActionType != "PUSH" {
-		errors = append(errors, fmt.Errorf("The event's 'detail.action-type' must be 'PUSH'"))
-	}
-	if event.Detail.Result != "SUCCESS" {
-		errors = append(errors, fmt.Errorf("The event's 'detail.result' must be 'SUCCESS'"))
-	}
-	if event.Detail.RepositoryName == "" {
-		errors = append(errors, fmt.Errorf("The event's 'detail.repository-name' must not be empty"))
+	ctx = build.StartPhase(ctx, metrics.PhasePush)
+	encoding, err := pushIndex(ctx, registry)
+	if err != nil {
+		return lambdaError(ctx, PushFailedMessage, err)
 	}
-	if event.Detail.ImageDigest == "" {
-		errors = append(errors, fmt.Errorf("The event's 'detail.image-digest' must not be empty"))
+	if !req.PushedAt.IsZero() {
+		metrics.ObservePushToIndexLatency(ctx, time.Since(req.PushedAt))
 	}
+	ctx = log.With(ctx, log.SOCIIndexEncoding, encoding)
 
-	validAccountId, err := regexp.MatchString(`[0-9]{12}`, event.Account)
-	if err != nil {
-		errors = append(errors, err)
+	if len(destinations) > 0 {
+		ctx = build.StartPhase(ctx, metrics.PhaseReplicate)
+		outcomes := replicateIndex(ctx, pushIndex, repo, digest, destinations)
+		if err := replicationError(outcomes); err != nil {
+			return lambdaError(ctx, ReplicationFailedMessage, err)
+		}
 	}
-	if !validAccountId {
-		errors = append(errors, fmt.Errorf("The event's 'account' must be a valid AWS account ID"))
+
+	// The result names the settings the index was built with, which the image's labels may have changed
+	msg := BuildAndPushSuccessMessage
+	switch {
+	case encoding == IndexEncodingLegacy:
+		msg = BuildAndPushLegacySuccessMessage
+	case untaggedV1:
+		msg = BuildAndPushUntaggedV1SuccessMessage
 	}
+	msg = fmt.Sprintf("%s (%s)", msg, params)
+	log.Info(ctx, msg)
+	return msg, nil
+}
+
+// Validate the repository name, image digest and optional image tag of an event's detail,
+// populating the context with the valid ones
+func validateImageDetail(ctx context.Context, repositoryName string, imageDigest string, imageTag string) (context.Context, []error) {
+	var errors []error
 
-	validRepositoryName, err := regexp.MatchString(`(?:[a-z0-9]+(?:[._-][a-z0-9]+)*/)*[a-z0-9]+(?:[._-][a-z0-9]+)*`, event.Detail.RepositoryName)
+	validRepositoryName, err := regexp.MatchString(`(?:[a-z0-9]+(?:[._-][a-z0-9]+)*/)*[a-z0-9]+(?:[._-][a-z0-9]+)*`, repositoryName)
 	if err != nil {
 		errors = append(errors, err)
 	}
 	if validRepositoryName {
-		ctx = context.WithValue(ctx, "RepositoryName", event.Detail.RepositoryName)
+		ctx = log.With(ctx, log.RepositoryName, repositoryName)
 	} else {
 		errors = append(errors, fmt.Errorf("The event's 'detail.repository-name' must be a valid repository name"))
 	}
 
-	validImageDigest, err := regexp.MatchString(`[[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*[:][A-Fa-f0-9]{32,}`, event.Detail.ImageDigest)
+	validImageDigest, err := regexp.MatchString(`[[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*[:][A-Fa-f0-9]{32,}`, imageDigest)
 	if err != nil {
 		errors = append(errors, err)
 	}
 	if validImageDigest {
-		ctx = context.WithValue(ctx, "ImageDigest", event.Detail.ImageDigest)
+		ctx = log.With(ctx, log.ImageDigest, imageDigest)
 	} else {
 		errors = append(errors, fmt.Errorf("The event's 'detail.image-digest' must be a valid image digest"))
 	}
 
 	// missing/empty tag is OK
-	if event.Detail.ImageTag != "" {
-		validImageTag, err := regexp.MatchString(`[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}`, event.Detail.ImageTag)
+	if imageTag != "" {
+		validImageTag, err := regexp.MatchString(`[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}`, imageTag)
 		if err != nil {
 			errors = append(errors, err)
 		}
 		if validImageTag {
-			ctx = context.WithValue(ctx, "ImageTag", event.Detail.ImageTag)
+			ctx = log.With(ctx, log.ImageTag, imageTag)
 		} else {
 			errors = append(errors, fmt.Errorf("The event's 'detail.image-tag' must be empty or a valid image tag"))
 		}
 	}
 
-	if len(errors) == 0 {
-		return ctx, nil
-	} else {
-		return ctx, errors[0]
-	}
+	return ctx, errors
 }
 
-// Returns ecr registry url from an image action event
-func buildEcrRegistryUrl(event events.ECRImageActionEvent) string {
-	var awsDomain = ".amazonaws.com"
-	if strings.HasPrefix(event.Region, "cn") {
-		awsDomain = ".amazonaws.com.cn"
+// Create a temp directory in the work directory, /tmp unless SOCI_WORK_DIR is set
+// The directory is prefixed by the Lambda's request id, or by the server's job id
+func createTempDir(ctx context.Context) (string, error) {
+	workDir := os.Getenv(workDirEnv)
+	if workDir == "" {
+		workDir = "/tmp"
 	}
-	return event.Account + ".dkr.ecr." + event.Region + awsDomain
-}
 
-// Create a temp directory in /tmp
-// The directory is prefixed by the Lambda's request id
-func createTempDir(ctx context.Context) (string, error) {
 	// free space in bytes
-	freeSpace := fs.CalculateFreeSpace("/tmp")
-	log.Info(ctx, fmt.Sprintf("There are %d bytes of free space in /tmp directory", freeSpace))
+	freeSpace := fs.CalculateFreeSpace(workDir)
+	log.Debug(ctx, "Checked the free space of the work directory", log.Str("Directory", workDir), log.Int64("FreeBytes", int64(freeSpace)))
 	if freeSpace < 6_000_000_000 {
 		// this is problematic because we support images as big as 6GB
-		log.Warn(ctx, fmt.Sprintf("Free space in /tmp is only %d bytes, which is less than 6GB", freeSpace))
+		log.Warn(ctx, fmt.Sprintf("Free space in %s is only %d bytes, which is less than 6GB", workDir, freeSpace))
 	}
 
-	log.Info(ctx, "Creating a directory to store images and SOCI artifacts")
-	lambdaContext, _ := lambdacontext.FromContext(ctx)
-	tempDir, err := os.MkdirTemp("/tmp", lambdaContext.AwsRequestID) // The temp dir name is prefixed by the request id
+	log.Debug(ctx, "Creating a directory to store images and SOCI artifacts")
+	// The temp dir name is prefixed by the request id when running in Lambda
+	prefix := "soci-index-builder"
+	if lambdaContext, ok := lambdacontext.FromContext(ctx); ok {
+		prefix = lambdaContext.AwsRequestID
+	} else if jobId := log.Value(ctx, log.JobId); jobId != "" {
+		prefix = "soci-build-" + jobId
+	}
+	tempDir, err := os.MkdirTemp(workDir, prefix)
 	return tempDir, err
 }
 
 // Clean up the data written by the Lambda
 func cleanUp(ctx context.Context, dataDir string) {
-	log.Info(ctx, fmt.Sprintf("Removing all files in %s", dataDir))
+	log.Debug(ctx, "Removing all files of the build", log.Str("Directory", dataDir))
 	if err := os.RemoveAll(dataDir); err != nil {
 		log.Error(ctx, "Clean up error", err)
 	}
@@ -235,7 +474,11 @@ func cleanUp(ctx context.Context, dataDir string) {
 func setDeadline(ctx context.Context, quitChannel chan int, dataDir string) {
 	// setting deadline as 10 seconds before lambda timeout.
 	// reference: https://docs.aws.amazon.com/lambda/latest/dg/golang-context.html
-	deadline, _ := ctx.Deadline()
+	// There is no deadline when running from the command line
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
 	deadline = deadline.Add(-10 * time.Second)
 	timeoutChannel := time.After(time.Until(deadline))
 	go func() {
@@ -264,7 +507,7 @@ func initSociStore(ctx context.Context, dataDir string) (*store.SociStore, error
 	// expects a store.Store, an interface that extends the oci.Store to provide support
 	// for garbage collection.
 	ociStore, err := oci.NewWithContext(ctx, path.Join(dataDir, artifactsStoreName))
-	return &store.SociStore{ociStore}, err
+	return &store.SociStore{Store: ociStore}, err
 }
 
 // Init a new instance of SOCI artifacts DB
@@ -278,9 +521,10 @@ func initSociArtifactsDb(dataDir string) (*soci.ArtifactsDb, error) {
 }
 
 // Build soci index for an image and returns its ocispec.Descriptor
-func buildIndex(ctx context.Context, dataDir string, sociStore *store.SociStore, image images.Image) (*ocispec.Descriptor, error) {
+// The build parameters are recorded as annotations on the index
+func buildIndex(ctx context.Context, dataDir string, sociStore *store.SociStore, image images.Image, params buildParameters) (*ocispec.Descriptor, error) {
 	log.Info(ctx, "Building SOCI index")
-	platform := platforms.DefaultSpec() // TODO: make this a user option
+	platform := params.Platform
 
 	artifactsDb, err := initSociArtifactsDb(dataDir)
 	if err != nil {
@@ -292,16 +536,35 @@ func buildIndex(ctx context.Context, dataDir string, sociStore *store.SociStore,
 		return nil, err
 	}
 
-	builder, err := soci.NewIndexBuilder(containerdStore, sociStore, artifactsDb, soci.WithPlatform(platform))
+	builder, err := soci.NewIndexBuilder(ztocTracingStore{containerdStore}, sociStore, artifactsDb,
+		soci.WithPlatform(platform),
+		soci.WithSpanSize(params.SpanSize),
+		soci.WithMinLayerSize(params.MinLayerSize))
 	if err != nil {
 		return nil, err
 	}
 
+	// The builder only logs the layers it skips, which are told apart from the image's layers. They are read first,
+	// as the builder reads the image's manifest in a way which prevents reading it again.
+	layers, err := imageLayers(ctx, containerdStore, image, platform)
+	if err != nil {
+		log.Warn(ctx, fmt.Sprintf("Unable to read the image's layers to count the skipped ones: %v", err))
+	}
+
 	// Build the SOCI index
 	index, err := builder.Build(ctx, image)
+	if err == nil || err.Error() == ErrEmptyIndex.Error() {
+		recordLayerMetrics(ctx, layers, params.MinLayerSize, index)
+	}
 	if err != nil {
 		return nil, err
 	}
+	for key, value := range params.annotations() {
+		index.Index.Annotations[key] = value
+	}
+	for key, value := range provenanceAnnotations(ctx, time.Now()) {
+		index.Index.Annotations[key] = value
+	}
 
 	// Write the SOCI index to the OCI store
 	err = soci.WriteSociIndex(ctx, index, sociStore, artifactsDb)
@@ -325,12 +588,100 @@ func buildIndex(ctx context.Context, dataDir string, sociStore *store.SociStore,
 	return &indexDescriptorInfos[len(indexDescriptorInfos)-1].Descriptor, nil
 }
 
+// Returns the layers of an image stored locally, for a platform
+func imageLayers(ctx context.Context, contentStore content.Store, image images.Image, platform ocispec.Platform) ([]ocispec.Descriptor, error) {
+	manifestDescriptor, err := soci.GetImageManifestDescriptor(ctx, contentStore, image.Target, platforms.OnlyStrict(platform))
+	if err != nil {
+		return nil, err
+	}
+	if manifestDescriptor == nil {
+		return nil, fmt.Errorf("Unexpected image media type %s", image.Target.MediaType)
+	}
+	manifestBytes, err := content.ReadBlob(ctx, contentStore, *manifestDescriptor)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, err
+	}
+	return manifest.Layers, nil
+}
+
+// Count the zTOCs of an index, and the layers which have none by the reason they were skipped.
+// index is nil when all the layers were skipped.
+func recordLayerMetrics(ctx context.Context, layers []ocispec.Descriptor, minLayerSize int64, index *soci.IndexWithMetadata) {
+	var imageSize int64
+	for _, layer := range layers {
+		imageSize += layer.Size
+	}
+	metrics.SetImageSize(ctx, imageSize)
+
+	indexed := map[string]bool{}
+	if index != nil {
+		for _, ztoc := range index.Index.Blobs {
+			indexed[ztoc.Annotations[soci.IndexAnnotationImageLayerDigest]] = true
+		}
+		metrics.AddZtocs(ctx, len(index.Index.Blobs))
+	}
+	// The builder only skips layers without an error when they are too small or in an unsupported format
+	skipped := map[string]int{}
+	for _, layer := range layers {
+		switch {
+		case indexed[layer.Digest.String()]:
+		case layer.Size < minLayerSize:
+			skipped[metrics.LayerSkippedMinLayerSize]++
+		default:
+			skipped[metrics.LayerSkippedUnsupportedFormat]++
+		}
+	}
+	for reason, count := range skipped {
+		metrics.AddSkippedLayers(ctx, reason, count)
+	}
+}
+
 // Log and return the lambda handler error
 func lambdaError(ctx context.Context, msg string, err error) (string, error) {
 	log.Error(ctx, msg, err)
-	return msg, err
+	// The error is reported to the Lambda runtime and in the SQS batch failures
+	return msg, log.RedactError(err)
+}
+
+// The error of a request which would fail again however many times it is retried, e.g. an undecodable or
+// invalid event. SQS batches drop such requests rather than having them redelivered.
+type invalidRequestError struct {
+	err error
+}
+
+func (err *invalidRequestError) Error() string {
+	return err.err.Error()
+}
+
+func (err *invalidRequestError) Unwrap() error {
+	return err.err
+}
+
+// Log and return the error of a request which mustn't be retried
+func invalidRequest(ctx context.Context, msg string, err error) (string, error) {
+	log.Error(ctx, msg, err, log.Bool("Retryable", false))
+	return msg, &invalidRequestError{err: log.RedactError(err)}
+}
+
+// Check if a request failed because it is invalid, retrying it wouldn't help
+func isInvalidRequest(err error) bool {
+	var invalid *invalidRequestError
+	return errors.As(err, &invalid)
 }
 
 func main() {
-	lambda.Start(HandleRequest)
+	// The Lambda runtime starts the function without arguments, anything else is a command line invocation
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(context.Background(), os.Args[1:]))
+	}
+	if err := log.Configure(log.FormatJSON); err != nil {
+		log.Error(context.Background(), "Logging configuration error", err)
+	}
+	// Each invocation flushes its spans, there is nothing left to export once the runtime stops the function
+	initTracing(context.Background())
+	lambda.Start(HandleInvocation)
 }
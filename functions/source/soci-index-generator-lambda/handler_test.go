@@ -5,9 +5,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/events"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/metrics"
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -50,8 +53,9 @@ func TestHandlerHappyPath(t *testing.T) {
 			t.Fatalf("HandleRequest failed %v", err)
 		}
 
-		expected_resp := "Successfully built and pushed SOCI index"
-		if resp != expected_resp {
+		// The response goes on with the settings the index was built with
+		expected_resp := "Successfully built and pushed SOCI index ("
+		if !strings.HasPrefix(resp, expected_resp) {
 			t.Fatalf("Unexpected response. Expected %s but got %s", expected_resp, resp)
 		}
 	}
@@ -101,3 +105,23 @@ func TestHandlerInvalidDigestMediaType(t *testing.T) {
 		t.Fatalf("Unexpected response. Expected %s but got %s", expected_resp, resp)
 	}
 }
+
+func TestBuildOutcome(t *testing.T) {
+	tests := []struct {
+		msg      string
+		err      error
+		expected string
+	}{
+		{BuildAndPushSuccessMessage + " (span size 4MiB)", nil, metrics.OutcomeBuilt},
+		{BuildAndPushLegacySuccessMessage + " (span size 4MiB)", nil, metrics.OutcomeBuilt},
+		{BuildAndPushUntaggedV1SuccessMessage + " (span size 4MiB)", nil, metrics.OutcomeBuilt},
+		{AlreadyIndexedMessage, nil, metrics.OutcomeSkipped},
+		{SkipPushOnEmptyIndexMessage, nil, metrics.OutcomeSkipped},
+		{PushFailedMessage, errors.New("denied"), metrics.OutcomeFailed},
+	}
+	for _, test := range tests {
+		if outcome := buildOutcome(test.msg, test.err); outcome != test.expected {
+			t.Fatalf("Expected the outcome of %q to be %q, got %q", test.msg, test.expected, outcome)
+		}
+	}
+}
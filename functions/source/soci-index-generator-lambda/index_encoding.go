@@ -0,0 +1,149 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// Set this env var to "true" to push SOCI indexes as OCI 1.1 referrers of their image,
+// i.e. with both a subject and an artifact type
+const referrersModeEnv = "SOCI_REFERRERS_MODE"
+
+// The encodings a SOCI index can be pushed with
+const (
+	// OCI image manifest with a subject, as built by the SOCI library
+	IndexEncodingOCI = "oci"
+	// OCI image manifest with a subject and an artifact type
+	IndexEncodingReferrer = "oci-referrer"
+	// SOCI index manifest v2 in an image index next to its image
+	IndexEncodingImageIndexV2 = "oci-image-index-v2"
+	// Docker image manifest without a subject, for registries rejecting OCI artifacts
+	IndexEncodingLegacy = "docker-legacy"
+)
+
+// Check if SOCI indexes are pushed as referrers of their image
+func referrersModeEnabled() bool {
+	return os.Getenv(referrersModeEnv) == "true"
+}
+
+// Re-encode a SOCI index manifest in the local store, returning the descriptor of the new manifest.
+// The zTOCs and config the manifest references are left untouched.
+func reencodeIndex(ctx context.Context, sociStore *store.SociStore, indexDesc ocispec.Descriptor, edit func(manifest *ocispec.Manifest)) (ocispec.Descriptor, error) {
+	var manifest ocispec.Manifest
+	if err := fetchJSON(ctx, sociStore, indexDesc, &manifest); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	edit(&manifest)
+	return pushJSON(ctx, sociStore, manifest.MediaType, manifest)
+}
+
+// Re-encode a SOCI index as an OCI 1.1 referrer, adding the artifact type next to the subject the
+// SOCI library already sets
+func encodeAsReferrer(ctx context.Context, sociStore *store.SociStore, indexDesc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	return reencodeIndex(ctx, sociStore, indexDesc, func(manifest *ocispec.Manifest) {
+		manifest.ArtifactType = soci.SociIndexArtifactType
+	})
+}
+
+// Re-encode a SOCI index as a Docker image manifest for registries which reject OCI artifacts, the same
+// way "soci create --legacy-registry" does. Docker manifests have neither a subject nor an artifact type,
+// so the image is recorded in an annotation instead.
+func encodeForLegacyRegistry(ctx context.Context, sociStore *store.SociStore, indexDesc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	return reencodeIndex(ctx, sociStore, indexDesc, func(manifest *ocispec.Manifest) {
+		if manifest.Subject != nil {
+			if manifest.Annotations == nil {
+				manifest.Annotations = map[string]string{}
+			}
+			manifest.Annotations[registryutils.AnnotationSociImageManifestDigest] = manifest.Subject.Digest.String()
+		}
+		manifest.MediaType = registryutils.MediaTypeDockerManifest
+		manifest.ArtifactType = ""
+		manifest.Subject = nil
+	})
+}
+
+// Push a SOCI index and, if the registry rejects OCI artifacts, push it again with the legacy encoding.
+// Returns the descriptor of the pushed index and the encoding it was pushed with.
+func pushWithLegacyFallback(ctx context.Context, registry *registryutils.Registry, sociStore *store.SociStore, indexDesc ocispec.Descriptor, repo string, encoding string, push func(ctx context.Context, sociStore *store.SociStore, indexDesc ocispec.Descriptor, repo string) error) (ocispec.Descriptor, string, error) {
+	err := push(ctx, sociStore, indexDesc, repo)
+	if !errors.Is(err, registryutils.RegistryNotSupportingOciArtifacts) {
+		return indexDesc, encoding, err
+	}
+
+	log.Warn(ctx, "Registry rejected the SOCI index, pushing it again with the legacy registry encoding")
+	legacyDesc, err := encodeForLegacyRegistry(ctx, sociStore, indexDesc)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	ctx = log.With(ctx, log.SOCIIndexDigest, legacyDesc.Digest.String())
+	if err := registry.Push(ctx, sociStore, legacyDesc, repo); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	log.Info(ctx, "Pushed SOCI index with the legacy registry encoding")
+	return legacyDesc, IndexEncodingLegacy, nil
+}
+
+// Returns the function pushing a v1 SOCI index, with or without referrers mode, and tagging it when tag isn't empty
+func pushIndexV1(sociStore *store.SociStore, indexDesc ocispec.Descriptor, repo string, imageDigest string, tag string, referrersMode bool) pushIndexFunc {
+	return func(ctx context.Context, registry *registryutils.Registry) (string, error) {
+		push, encoding := registry.Push, IndexEncodingOCI
+		if referrersMode {
+			push, encoding = registry.PushReferrer, IndexEncodingReferrer
+		}
+
+		pushedDesc, encoding, err := pushWithLegacyFallback(ctx, registry, sociStore, indexDesc, repo, encoding, push)
+		if err != nil || tag == "" {
+			return encoding, err
+		}
+		return encoding, tagIndex(ctx, registry, repo, imageDigest, pushedDesc, tag)
+	}
+}
+
+// Fetch and decode JSON content from the local store
+func fetchJSON(ctx context.Context, sociStore *store.SociStore, desc ocispec.Descriptor, value interface{}) error {
+	rc, err := sociStore.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	content, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, value)
+}
+
+// Encode and push JSON content to the local store, returning its descriptor
+func pushJSON(ctx context.Context, sociStore *store.SociStore, mediaType string, value interface{}) (ocispec.Descriptor, error) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(content),
+		Size:      int64(len(content)),
+	}
+	err = sociStore.Push(ctx, desc, bytes.NewReader(content))
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
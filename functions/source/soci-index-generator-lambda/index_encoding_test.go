@@ -0,0 +1,129 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Push a SOCI index manifest, as serialized by the SOCI library, to a new local store
+func testSociStoreWithIndex(t *testing.T, ctx context.Context) (*store.SociStore, ocispec.Descriptor) {
+	sociStore, err := initSociStore(ctx, t.TempDir())
+	if err != nil {
+		t.Fatalf("Unexpected error creating SOCI store: %v", err)
+	}
+
+	subject := &ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    "sha256:afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187",
+		Size:      1234,
+	}
+	content, err := soci.MarshalIndex(soci.NewIndex(nil, subject, map[string]string{"key": "value"}))
+	if err != nil {
+		t.Fatalf("Unexpected error marshalling SOCI index: %v", err)
+	}
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(content), Size: int64(len(content))}
+	if err := sociStore.Push(ctx, desc, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Unexpected error pushing SOCI index: %v", err)
+	}
+	return sociStore, desc
+}
+
+// Fetch and decode a manifest from a local store
+func testFetchManifest(t *testing.T, ctx context.Context, sociStore *store.SociStore, desc ocispec.Descriptor) ocispec.Manifest {
+	rc, err := sociStore.Fetch(ctx, desc)
+	if err != nil {
+		t.Fatalf("Unexpected error fetching manifest: %v", err)
+	}
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Unexpected error reading manifest: %v", err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		t.Fatalf("Unexpected error decoding manifest: %v", err)
+	}
+	return manifest
+}
+
+func TestEncodeAsReferrer(t *testing.T) {
+	ctx := context.Background()
+	sociStore, desc := testSociStoreWithIndex(t, ctx)
+
+	referrerDesc, err := encodeAsReferrer(ctx, sociStore, desc)
+	if err != nil {
+		t.Fatalf("Unexpected error encoding SOCI index as a referrer: %v", err)
+	}
+	if referrerDesc.Digest == desc.Digest {
+		t.Fatalf("Expected the referrer to have a new digest")
+	}
+
+	manifest := testFetchManifest(t, ctx, sociStore, referrerDesc)
+	if manifest.ArtifactType != soci.SociIndexArtifactType {
+		t.Fatalf("Unexpected artifact type %q", manifest.ArtifactType)
+	}
+	if manifest.Subject == nil || manifest.Subject.Digest != "sha256:afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187" {
+		t.Fatalf("Expected the subject to be kept, got %v", manifest.Subject)
+	}
+	if manifest.Annotations["key"] != "value" {
+		t.Fatalf("Expected the annotations to be kept, got %v", manifest.Annotations)
+	}
+}
+
+func TestEncodeForLegacyRegistry(t *testing.T) {
+	ctx := context.Background()
+	sociStore, desc := testSociStoreWithIndex(t, ctx)
+
+	legacyDesc, err := encodeForLegacyRegistry(ctx, sociStore, desc)
+	if err != nil {
+		t.Fatalf("Unexpected error encoding SOCI index for a legacy registry: %v", err)
+	}
+	if legacyDesc.MediaType != registryutils.MediaTypeDockerManifest {
+		t.Fatalf("Unexpected legacy descriptor media type %q", legacyDesc.MediaType)
+	}
+
+	manifest := testFetchManifest(t, ctx, sociStore, legacyDesc)
+	if manifest.MediaType != registryutils.MediaTypeDockerManifest || manifest.Subject != nil || manifest.ArtifactType != "" {
+		t.Fatalf("Expected a Docker manifest without a subject nor an artifact type, got %+v", manifest)
+	}
+	if manifest.Annotations[registryutils.AnnotationSociImageManifestDigest] != "sha256:afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187" {
+		t.Fatalf("Expected the image to be recorded in an annotation, got %v", manifest.Annotations)
+	}
+	if !registryutils.IsSociIndexManifest(manifest) {
+		t.Fatalf("Expected the legacy encoding to be recognized as a SOCI index")
+	}
+}
+
+func TestPushWithLegacyFallbackWithoutRejection(t *testing.T) {
+	ctx := context.Background()
+	sociStore, desc := testSociStoreWithIndex(t, ctx)
+
+	push := func(ctx context.Context, sociStore *store.SociStore, indexDesc ocispec.Descriptor, repo string) error {
+		return nil
+	}
+	pushedDesc, encoding, err := pushWithLegacyFallback(ctx, nil, sociStore, desc, "repo", IndexEncodingOCI, push)
+	if err != nil || encoding != IndexEncodingOCI || pushedDesc.Digest != desc.Digest {
+		t.Fatalf("Expected the index to be pushed with its own encoding, got %q, %v", encoding, err)
+	}
+
+	pushErr := errors.New("push error")
+	push = func(ctx context.Context, sociStore *store.SociStore, indexDesc ocispec.Descriptor, repo string) error {
+		return pushErr
+	}
+	if _, _, err := pushWithLegacyFallback(ctx, nil, sociStore, desc, "repo", IndexEncodingOCI, push); !errors.Is(err, pushErr) {
+		t.Fatalf("Expected errors other than OCI artifact rejections to be returned, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// Template of the tag every pushed SOCI index gets, so that lifecycle rules expiring untagged images keep it
+// and it can be found in the console. "{digest}" is replaced by the hex of the image digest, "{algorithm}" by its
+// algorithm and "{platform}" by the platform the index was built for, e.g. "soci-{digest}-{platform}".
+// Leave empty to push indexes untagged.
+const indexTagTemplateEnv = "SOCI_INDEX_TAG_TEMPLATE"
+
+var validTag = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// Returns the tag of the SOCI index of an image, or an empty string if indexes aren't tagged
+func indexTag(imageDigest string, platform ocispec.Platform) (string, error) {
+	template := os.Getenv(indexTagTemplateEnv)
+	if template == "" {
+		return "", nil
+	}
+
+	parsedDigest, err := digest.Parse(imageDigest)
+	if err != nil {
+		return "", err
+	}
+	tag := strings.NewReplacer(
+		"{digest}", parsedDigest.Encoded(),
+		"{algorithm}", parsedDigest.Algorithm().String(),
+		"{platform}", strings.ReplaceAll(platforms.Format(platform), "/", "-"),
+	).Replace(template)
+
+	if !validTag.MatchString(tag) {
+		return "", fmt.Errorf("%s produced the invalid tag %q", indexTagTemplateEnv, tag)
+	}
+	return tag, nil
+}
+
+// Tag a pushed SOCI index. A rebuild for the same image takes the tag over from the previous index, which is left
+// untagged for lifecycle rules and the sweep command to remove. A tag naming anything else is never moved.
+func tagIndex(ctx context.Context, registry *registryutils.Registry, repo string, imageDigest string, indexDesc ocispec.Descriptor, tag string) error {
+	current, err := registry.HeadManifest(ctx, repo, tag)
+	if err != nil && !errors.Is(err, errdef.ErrNotFound) {
+		return err
+	}
+	if err == nil {
+		if current.Digest == indexDesc.Digest {
+			return nil
+		}
+		manifest, err := registry.GetManifest(ctx, repo, current.Digest.String())
+		if err != nil {
+			return err
+		}
+		previous := registryutils.SociIndexManifest{Descriptor: current, Manifest: manifest}
+		if !registryutils.IsSociIndexManifest(manifest) || previous.ImageManifestDigest() != imageDigest {
+			log.Warn(ctx, fmt.Sprintf("Tag %s already names %s, which isn't a SOCI index of this image, leaving the SOCI index untagged", tag, current.Digest))
+			return nil
+		}
+		log.Info(ctx, fmt.Sprintf("Moving tag %s from the previous SOCI index %s", tag, current.Digest))
+	}
+	return registry.Tag(ctx, repo, indexDesc, tag)
+}
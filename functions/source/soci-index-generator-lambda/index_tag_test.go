@@ -0,0 +1,44 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestIndexTag(t *testing.T) {
+	imageDigest := "sha256:afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187"
+	platform := ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+
+	t.Setenv(indexTagTemplateEnv, "")
+	if tag, err := indexTag(imageDigest, platform); err != nil || tag != "" {
+		t.Fatalf("Expected indexes to be untagged by default, got %q, %v", tag, err)
+	}
+
+	t.Setenv(indexTagTemplateEnv, "soci-{digest}-{platform}")
+	tag, err := indexTag(imageDigest, platform)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tag != "soci-afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187-linux-arm64-v8" {
+		t.Fatalf("Unexpected tag %q", tag)
+	}
+
+	t.Setenv(indexTagTemplateEnv, "{algorithm}-{digest}.soci")
+	if tag, err := indexTag(imageDigest, platform); err != nil || tag != "sha256-afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187.soci" {
+		t.Fatalf("Unexpected tag %q, %v", tag, err)
+	}
+
+	// Tags are limited to 128 characters
+	t.Setenv(indexTagTemplateEnv, "soci-{digest}-{digest}")
+	if _, err := indexTag(imageDigest, platform); err == nil {
+		t.Fatalf("Expected an error for a tag longer than 128 characters")
+	}
+	t.Setenv(indexTagTemplateEnv, "soci:{digest}")
+	if _, err := indexTag(imageDigest, platform); err == nil {
+		t.Fatalf("Expected an error for a tag with invalid characters")
+	}
+}
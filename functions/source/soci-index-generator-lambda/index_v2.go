@@ -0,0 +1,187 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	indexVersionV1 = "v1"
+	indexVersionV2 = "v2"
+
+	// The SOCI index manifest version to build, "v1" (default) or "v2"
+	indexVersionEnv = "SOCI_INDEX_VERSION"
+	// Comma-separated list of "<repository pattern>=<version>" overriding the index version per repository.
+	// Patterns may contain wildcards, the first matching pattern wins.
+	indexVersionOverridesEnv = "SOCI_INDEX_VERSION_OVERRIDES"
+	// Template of the tag a converted v2 image is pushed under, where "{tag}" is the tag of the original image.
+	// "{tag}" alone retags the original image in place.
+	v2TagTemplateEnv     = "SOCI_V2_TAG_TEMPLATE"
+	defaultV2TagTemplate = "{tag}-soci"
+)
+
+// Returns the SOCI index manifest version to build for a repository
+func indexVersionForRepository(repo string) (string, error) {
+	version := os.Getenv(indexVersionEnv)
+	if version == "" {
+		version = indexVersionV1
+	}
+
+	overrides := os.Getenv(indexVersionOverridesEnv)
+	for _, override := range strings.Split(overrides, ",") {
+		override = strings.TrimSpace(override)
+		if override == "" {
+			continue
+		}
+		pattern, overrideVersion, found := strings.Cut(override, "=")
+		if !found {
+			return "", fmt.Errorf("Invalid %s entry %q, expected '<repository pattern>=<version>'", indexVersionOverridesEnv, override)
+		}
+		matched, err := path.Match(pattern, repo)
+		if err != nil {
+			return "", fmt.Errorf("Invalid %s pattern %q: %w", indexVersionOverridesEnv, pattern, err)
+		}
+		if matched {
+			version = overrideVersion
+			break
+		}
+	}
+
+	if version != indexVersionV1 && version != indexVersionV2 {
+		return "", fmt.Errorf("Unsupported SOCI index version %q, expected %q or %q", version, indexVersionV1, indexVersionV2)
+	}
+	return version, nil
+}
+
+// Returns the tag to push a converted v2 image under, or an empty string if the original image has no tag
+func v2Tag(tag string) string {
+	if tag == "" {
+		return ""
+	}
+	template := os.Getenv(v2TagTemplateEnv)
+	if template == "" {
+		template = defaultV2TagTemplate
+	}
+	return strings.ReplaceAll(template, "{tag}", tag)
+}
+
+// Convert an image and its v1 SOCI index to a SOCI index manifest v2 and an image index binding the two.
+//
+// The v2 index holds the same zTOCs as the v1 index but has no subject. It is bound to the image by the
+// image manifest's "com.amazon.soci.index-digest" annotation instead, which gives the image a new digest.
+// Both are put side by side in a new image index, so that they're always pulled together. Docker image
+// manifests, which can't carry annotations, are converted to their OCI equivalent.
+//
+// The v2 index and its descriptor in the image index both name the original image with the
+// "com.amazon.soci.image-manifest-digest" annotation, as that is the digest builds are requested for and existing
+// indexes are looked up by. The converted image can't be named, its digest depends on the index's.
+// Returns the descriptor of the image index, which is stored in the local store along with its children.
+func convertToIndexV2(ctx context.Context, sociStore *store.SociStore, imageDesc ocispec.Descriptor, indexDesc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	var v1Index ocispec.Manifest
+	if err := fetchJSON(ctx, sociStore, indexDesc, &v1Index); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var image ocispec.Manifest
+	if err := fetchJSON(ctx, sociStore, imageDesc, &image); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var config ocispec.Image
+	if err := fetchJSON(ctx, sociStore, image.Config, &config); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	platform := &ocispec.Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+
+	annotations := map[string]string{}
+	for key, value := range v1Index.Annotations {
+		annotations[key] = value
+	}
+	annotations[registryutils.AnnotationSociImageManifestDigest] = imageDesc.Digest.String()
+
+	// The empty config of the v1 index is reused with the v2 media type, its content is the same
+	v2Config := v1Index.Config
+	v2Config.MediaType = registryutils.SociIndexArtifactTypeV2
+	v2Index := ocispec.Manifest{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: registryutils.SociIndexArtifactTypeV2,
+		Config:       v2Config,
+		Layers:       v1Index.Layers,
+		Annotations:  annotations,
+	}
+	v2Index.SchemaVersion = 2
+	v2IndexDesc, err := pushJSON(ctx, sociStore, ocispec.MediaTypeImageManifest, v2Index)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	v2IndexDesc.ArtifactType = registryutils.SociIndexArtifactTypeV2
+	v2IndexDesc.Platform = platform
+
+	sociImage := toOCIManifest(image)
+	sociImage.Annotations[registryutils.ImageAnnotationSociIndexDigest] = v2IndexDesc.Digest.String()
+	sociImageDesc, err := pushJSON(ctx, sociStore, ocispec.MediaTypeImageManifest, sociImage)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	sociImageDesc.Platform = platform
+
+	v2IndexDesc.Annotations = map[string]string{registryutils.AnnotationSociImageManifestDigest: imageDesc.Digest.String()}
+	imageIndex := ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{sociImageDesc, v2IndexDesc},
+	}
+	imageIndex.SchemaVersion = 2
+	return pushJSON(ctx, sociStore, ocispec.MediaTypeImageIndex, imageIndex)
+}
+
+// Push the image index of a SOCI index manifest v2 and tag it after the original image's tag. Images without a
+// tag get a v1 index instead, an untagged image index would never be pulled.
+func pushIndexV2(ctx context.Context, registry *registryutils.Registry, sociStore *store.SociStore, imageIndexDesc ocispec.Descriptor, repo string, tag string) (string, error) {
+	v2Tag := v2Tag(tag)
+	if v2Tag == "" {
+		return "", fmt.Errorf("The image has no tag to push the SOCI index manifest v2 image index with")
+	}
+	if err := registry.Push(ctx, sociStore, imageIndexDesc, repo); err != nil {
+		return "", err
+	}
+	return IndexEncodingImageIndexV2, registry.Tag(ctx, repo, imageIndexDesc, v2Tag)
+}
+
+// Returns a copy of an image manifest using OCI media types, Docker and OCI layers and configs share the same content
+func toOCIManifest(image ocispec.Manifest) ocispec.Manifest {
+	dockerToOCI := map[string]string{
+		registryutils.MediaTypeDockerManifest:                       ocispec.MediaTypeImageManifest,
+		registryutils.MediaTypeDockerImageConfig:                    ocispec.MediaTypeImageConfig,
+		"application/vnd.docker.image.rootfs.diff.tar.gzip":         ocispec.MediaTypeImageLayerGzip,
+		"application/vnd.docker.image.rootfs.diff.tar":              ocispec.MediaTypeImageLayer,
+		"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip": ocispec.MediaTypeImageLayerNonDistributableGzip,
+	}
+	convert := func(mediaType string) string {
+		if ociMediaType, ok := dockerToOCI[mediaType]; ok {
+			return ociMediaType
+		}
+		return mediaType
+	}
+
+	converted := image
+	converted.MediaType = ocispec.MediaTypeImageManifest
+	converted.Config.MediaType = convert(image.Config.MediaType)
+	converted.Layers = make([]ocispec.Descriptor, len(image.Layers))
+	for i, layer := range image.Layers {
+		layer.MediaType = convert(layer.MediaType)
+		converted.Layers[i] = layer
+	}
+	converted.Annotations = map[string]string{}
+	for key, value := range image.Annotations {
+		converted.Annotations[key] = value
+	}
+	return converted
+}
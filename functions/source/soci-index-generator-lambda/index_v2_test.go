@@ -0,0 +1,159 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestIndexVersionForRepository(t *testing.T) {
+	t.Setenv(indexVersionEnv, "")
+	t.Setenv(indexVersionOverridesEnv, "")
+	if version, err := indexVersionForRepository("app"); err != nil || version != indexVersionV1 {
+		t.Fatalf("Expected the default index version to be v1, got %q, %v", version, err)
+	}
+
+	t.Setenv(indexVersionEnv, indexVersionV2)
+	t.Setenv(indexVersionOverridesEnv, "legacy/*=v1, app=v2")
+	tests := map[string]string{
+		"legacy/app": indexVersionV1,
+		"app":        indexVersionV2,
+		"other":      indexVersionV2,
+	}
+	for repo, expected := range tests {
+		version, err := indexVersionForRepository(repo)
+		if err != nil {
+			t.Fatalf("Unexpected error for repository %q: %v", repo, err)
+		}
+		if version != expected {
+			t.Fatalf("Expected index version %q for repository %q, got %q", expected, repo, version)
+		}
+	}
+
+	for _, overrides := range []string{"app", "app=v3", "[=v1"} {
+		t.Setenv(indexVersionOverridesEnv, overrides)
+		if _, err := indexVersionForRepository("app"); err == nil {
+			t.Fatalf("Expected an error for overrides %q", overrides)
+		}
+	}
+}
+
+func TestV2Tag(t *testing.T) {
+	t.Setenv(v2TagTemplateEnv, "")
+	if tag := v2Tag("1.0"); tag != "1.0-soci" {
+		t.Fatalf("Unexpected default v2 tag %q", tag)
+	}
+	if tag := v2Tag(""); tag != "" {
+		t.Fatalf("Expected no v2 tag for an untagged image, got %q", tag)
+	}
+
+	t.Setenv(v2TagTemplateEnv, "{tag}")
+	if tag := v2Tag("1.0"); tag != "1.0" {
+		t.Fatalf("Expected the original tag for an in place retag, got %q", tag)
+	}
+}
+
+func TestConvertToIndexV2(t *testing.T) {
+	ctx := context.Background()
+	sociStore, indexDesc := testSociStoreWithIndex(t, ctx)
+
+	configDesc, err := pushJSON(ctx, sociStore, registryutils.MediaTypeDockerImageConfig, ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: "arm64"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error pushing image config: %v", err)
+	}
+	image := ocispec.Manifest{
+		MediaType: registryutils.MediaTypeDockerManifest,
+		Config:    configDesc,
+		Layers: []ocispec.Descriptor{{
+			MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip",
+			Digest:    "sha256:4ff4c52b6ec3e2fd2fc4f3b0a1ad1bec6e1b0b8bd1f1a5fd04a6c4f0bdbf3d2e",
+			Size:      4321,
+		}},
+	}
+	image.SchemaVersion = 2
+	imageDesc, err := pushJSON(ctx, sociStore, registryutils.MediaTypeDockerManifest, image)
+	if err != nil {
+		t.Fatalf("Unexpected error pushing image manifest: %v", err)
+	}
+
+	imageIndexDesc, err := convertToIndexV2(ctx, sociStore, imageDesc, indexDesc)
+	if err != nil {
+		t.Fatalf("Unexpected error converting to SOCI index v2: %v", err)
+	}
+	if imageIndexDesc.MediaType != ocispec.MediaTypeImageIndex {
+		t.Fatalf("Unexpected image index media type %q", imageIndexDesc.MediaType)
+	}
+
+	var imageIndex ocispec.Index
+	if err := fetchJSON(ctx, sociStore, imageIndexDesc, &imageIndex); err != nil {
+		t.Fatalf("Unexpected error fetching image index: %v", err)
+	}
+	if len(imageIndex.Manifests) != 2 {
+		t.Fatalf("Expected the image index to hold the image and its SOCI index, got %d manifests", len(imageIndex.Manifests))
+	}
+	sociImageDesc, v2IndexDesc := imageIndex.Manifests[0], imageIndex.Manifests[1]
+	if v2IndexDesc.ArtifactType != registryutils.SociIndexArtifactTypeV2 {
+		t.Fatalf("Unexpected SOCI index artifact type %q", v2IndexDesc.ArtifactType)
+	}
+	if v2IndexDesc.Annotations[registryutils.AnnotationSociImageManifestDigest] != imageDesc.Digest.String() {
+		t.Fatalf("Expected the SOCI index descriptor to name the original image, got %v", v2IndexDesc.Annotations)
+	}
+	for _, desc := range imageIndex.Manifests {
+		if desc.Platform == nil || desc.Platform.Architecture != "arm64" {
+			t.Fatalf("Expected the platform of the image, got %v", desc.Platform)
+		}
+	}
+
+	v2Index := testFetchManifest(t, ctx, sociStore, v2IndexDesc)
+	if v2Index.Subject != nil {
+		t.Fatalf("Expected SOCI index v2 not to have a subject")
+	}
+	if !registryutils.IsSociIndexManifest(v2Index) {
+		t.Fatalf("Expected SOCI index v2 to be recognized as a SOCI index")
+	}
+	if v2Index.Annotations["key"] != "value" || v2Index.Annotations[registryutils.AnnotationSociImageManifestDigest] != imageDesc.Digest.String() {
+		t.Fatalf("Unexpected SOCI index v2 annotations %v", v2Index.Annotations)
+	}
+
+	sociImage := testFetchManifest(t, ctx, sociStore, sociImageDesc)
+	if sociImage.MediaType != ocispec.MediaTypeImageManifest || sociImage.Config.MediaType != ocispec.MediaTypeImageConfig {
+		t.Fatalf("Expected the image to be converted to OCI media types, got %q and %q", sociImage.MediaType, sociImage.Config.MediaType)
+	}
+	if sociImage.Layers[0].MediaType != ocispec.MediaTypeImageLayerGzip || sociImage.Layers[0].Digest != image.Layers[0].Digest {
+		t.Fatalf("Unexpected converted layer %v", sociImage.Layers[0])
+	}
+	if sociImage.Annotations[registryutils.ImageAnnotationSociIndexDigest] != v2IndexDesc.Digest.String() {
+		t.Fatalf("Expected the image to be bound to its SOCI index, got %v", sociImage.Annotations)
+	}
+}
+
+func TestUntaggedImagesGetV1Indexes(t *testing.T) {
+	t.Setenv(indexVersionEnv, indexVersionV2)
+	t.Setenv(indexVersionOverridesEnv, "")
+	if _, err := pushIndexV2(context.Background(), nil, nil, ocispec.Descriptor{}, "repo", ""); err == nil {
+		t.Fatalf("Expected an error pushing the image index of an untagged image")
+	}
+
+	// An image pushed by digest only is looked up for, and would be built, a v1 index
+	fake := newTestRegistryServer()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	registryUrl := strings.TrimPrefix(server.URL, "http://")
+	t.Setenv("SOCI_PLAIN_HTTP_REGISTRIES", registryUrl)
+	imageDesc := fake.addImage(t)
+	fake.addSociIndex(t, imageDesc)
+
+	req := buildRequest{RegistryURL: registryUrl, Repository: "repo", Digest: imageDesc.Digest.String()}
+	if result, err := buildAndPushIndex(context.Background(), req); err != nil || result != AlreadyIndexedMessage {
+		t.Fatalf("Expected the v1 index of the untagged image to be found, got %v, %v", result, err)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// Image labels with which image authors control how the SOCI index of their image is built
+	LabelSkip         = "soci.skip"
+	LabelSpanSize     = "soci.span-size"
+	LabelMinLayerSize = "soci.min-layer-size"
+	LabelPlatforms    = "soci.platforms"
+
+	// Comma-separated list of the labels which are honoured, all of them by default. "none" honours none.
+	labelDirectivesEnv = "SOCI_LABEL_DIRECTIVES"
+	// Bounds of the sizes the labels may set, as "<min>-<max>" in bytes. Sizes out of bounds are clamped.
+	labelSpanSizeLimitsEnv     = "SOCI_LABEL_SPAN_SIZE_LIMITS"
+	labelMinLayerSizeLimitsEnv = "SOCI_LABEL_MIN_LAYER_SIZE_LIMITS"
+
+	SkippedByLabelMessage       = "skipped: soci.skip label"
+	PlatformNotRequestedMessage = "skipped: image platform not in soci.platforms label"
+)
+
+var (
+	defaultSpanSizeLimits     = sizeLimits{Min: 1 << 20, Max: 64 << 20} // 1MiB to 64MiB
+	defaultMinLayerSizeLimits = sizeLimits{Min: 1 << 20, Max: 1 << 30}  // 1MiB to 1GiB
+
+	// The build parameter annotation each size label sets
+	labelAnnotations = map[string]string{
+		LabelSpanSize:     AnnotationBuildSpanSize,
+		LabelMinLayerSize: AnnotationBuildMinLayerSize,
+	}
+)
+
+type sizeLimits struct {
+	Min int64
+	Max int64
+}
+
+func (limits sizeLimits) clamp(size int64) int64 {
+	if size < limits.Min {
+		return limits.Min
+	}
+	if size > limits.Max {
+		return limits.Max
+	}
+	return size
+}
+
+// The labels the operator lets image authors set, and the bounds of the sizes they may set
+type directiveLimits struct {
+	Allowed      map[string]bool
+	SpanSize     sizeLimits
+	MinLayerSize sizeLimits
+}
+
+// Read the label directive limits from the environment
+func loadDirectiveLimits() (directiveLimits, error) {
+	limits := directiveLimits{Allowed: map[string]bool{}}
+
+	value := os.Getenv(labelDirectivesEnv)
+	if value == "" {
+		value = strings.Join([]string{LabelSkip, LabelSpanSize, LabelMinLayerSize, LabelPlatforms}, ",")
+	}
+	for _, label := range strings.Split(value, ",") {
+		switch label = strings.TrimSpace(label); label {
+		case "", "none":
+		case LabelSkip, LabelSpanSize, LabelMinLayerSize, LabelPlatforms:
+			limits.Allowed[label] = true
+		default:
+			return limits, fmt.Errorf("%s contains the unknown label %q", labelDirectivesEnv, label)
+		}
+	}
+
+	var err error
+	if limits.SpanSize, err = sizeLimitsFromEnv(labelSpanSizeLimitsEnv, defaultSpanSizeLimits); err != nil {
+		return limits, err
+	}
+	if limits.MinLayerSize, err = sizeLimitsFromEnv(labelMinLayerSizeLimitsEnv, defaultMinLayerSizeLimits); err != nil {
+		return limits, err
+	}
+	return limits, nil
+}
+
+func sizeLimitsFromEnv(name string, defaultValue sizeLimits) (sizeLimits, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	lower, upper, found := strings.Cut(value, "-")
+	limits := sizeLimits{}
+	var minErr, maxErr error
+	limits.Min, minErr = strconv.ParseInt(strings.TrimSpace(lower), 10, 64)
+	limits.Max, maxErr = strconv.ParseInt(strings.TrimSpace(upper), 10, 64)
+	if !found || minErr != nil || maxErr != nil || limits.Min <= 0 || limits.Max < limits.Min {
+		return limits, fmt.Errorf("%s must be '<min>-<max>' positive numbers of bytes, got %q", name, value)
+	}
+	return limits, nil
+}
+
+// Apply the directives of an image's labels to the build parameters. Invalid labels are ignored, as retrying
+// wouldn't fix them. Returns the effective parameters, and the result of the build if the labels skip it.
+func applyLabelDirectives(ctx context.Context, params buildParameters, config ocispec.Image, limits directiveLimits) (buildParameters, string) {
+	labels := config.Config.Labels
+	label := func(name string) (string, bool) {
+		value, ok := labels[name]
+		return strings.TrimSpace(value), ok && limits.Allowed[name]
+	}
+
+	if value, ok := label(LabelSkip); ok {
+		skip, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Warn(ctx, fmt.Sprintf("Ignoring the invalid label %s=%q", LabelSkip, value))
+		} else if skip {
+			return params, SkippedByLabelMessage
+		}
+	}
+
+	if value, ok := label(LabelPlatforms); ok {
+		imagePlatform := ocispec.Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+		requested, err := parsePlatforms(value)
+		if err != nil {
+			log.Warn(ctx, fmt.Sprintf("Ignoring the invalid label %s=%q: %v", LabelPlatforms, value, err))
+		} else if !platforms.Any(requested...).Match(imagePlatform) {
+			return params, PlatformNotRequestedMessage
+		}
+	}
+
+	sizes := []struct {
+		label  string
+		limits sizeLimits
+		size   *int64
+	}{
+		{LabelSpanSize, limits.SpanSize, &params.SpanSize},
+		{LabelMinLayerSize, limits.MinLayerSize, &params.MinLayerSize},
+	}
+	for _, directive := range sizes {
+		value, ok := label(directive.label)
+		if !ok {
+			continue
+		}
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size <= 0 {
+			log.Warn(ctx, fmt.Sprintf("Ignoring the invalid label %s=%q", directive.label, value))
+			continue
+		}
+		if clamped := directive.limits.clamp(size); clamped != size {
+			log.Warn(ctx, fmt.Sprintf("Label %s=%d is out of the allowed range %d-%d, using %d", directive.label, size, directive.limits.Min, directive.limits.Max, clamped))
+			size = clamped
+		}
+		*directive.size = size
+		params.Directives = append(params.Directives, directive.label)
+	}
+	return params, ""
+}
+
+func parsePlatforms(value string) ([]ocispec.Platform, error) {
+	var parsed []ocispec.Platform
+	for _, specifier := range strings.Split(value, ",") {
+		if specifier = strings.TrimSpace(specifier); specifier == "" {
+			continue
+		}
+		platform, err := platforms.Parse(specifier)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, platform)
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("no platform")
+	}
+	return parsed, nil
+}
@@ -0,0 +1,93 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func testImageConfig(labels map[string]string) ocispec.Image {
+	config := ocispec.Image{Config: ocispec.ImageConfig{Labels: labels}}
+	config.OS = "linux"
+	config.Architecture = "arm64"
+	return config
+}
+
+func TestApplyLabelDirectives(t *testing.T) {
+	t.Setenv(labelDirectivesEnv, "")
+	t.Setenv(labelSpanSizeLimitsEnv, "")
+	t.Setenv(labelMinLayerSizeLimitsEnv, "")
+	limits, err := loadDirectiveLimits()
+	if err != nil {
+		t.Fatalf("Unexpected error loading the directive limits: %v", err)
+	}
+	params := testReindexParameters()
+	ctx := context.Background()
+
+	tests := []struct {
+		labels       map[string]string
+		spanSize     int64
+		minLayerSize int64
+		directives   []string
+		skipped      string
+	}{
+		{nil, defaultSpanSize, defaultMinLayerSize, nil, ""},
+		{map[string]string{LabelSkip: "true"}, defaultSpanSize, defaultMinLayerSize, nil, SkippedByLabelMessage},
+		{map[string]string{LabelSkip: "false"}, defaultSpanSize, defaultMinLayerSize, nil, ""},
+		{map[string]string{LabelSkip: "maybe"}, defaultSpanSize, defaultMinLayerSize, nil, ""},
+		{map[string]string{LabelPlatforms: "linux/amd64, linux/arm64"}, defaultSpanSize, defaultMinLayerSize, nil, ""},
+		{map[string]string{LabelPlatforms: "linux/amd64"}, defaultSpanSize, defaultMinLayerSize, nil, PlatformNotRequestedMessage},
+		{map[string]string{LabelSpanSize: "2097152", LabelMinLayerSize: "5242880"}, 2 << 20, 5 << 20, []string{LabelSpanSize, LabelMinLayerSize}, ""},
+		// Sizes out of bounds are clamped, invalid ones ignored
+		{map[string]string{LabelSpanSize: "1", LabelMinLayerSize: "big"}, defaultSpanSizeLimits.Min, defaultMinLayerSize, []string{LabelSpanSize}, ""},
+		{map[string]string{LabelSpanSize: "1099511627776"}, defaultSpanSizeLimits.Max, defaultMinLayerSize, []string{LabelSpanSize}, ""},
+	}
+	for _, test := range tests {
+		actual, skipped := applyLabelDirectives(ctx, params, testImageConfig(test.labels), limits)
+		if skipped != test.skipped {
+			t.Fatalf("Expected labels %v to skip with %q, got %q", test.labels, test.skipped, skipped)
+		}
+		if actual.SpanSize != test.spanSize || actual.MinLayerSize != test.minLayerSize || !reflect.DeepEqual(actual.Directives, test.directives) {
+			t.Fatalf("Unexpected build parameters %+v for labels %v", actual, test.labels)
+		}
+	}
+}
+
+func TestDirectiveLimits(t *testing.T) {
+	t.Setenv(labelDirectivesEnv, LabelSpanSize)
+	t.Setenv(labelSpanSizeLimitsEnv, "1048576-2097152")
+	t.Setenv(labelMinLayerSizeLimitsEnv, "")
+	limits, err := loadDirectiveLimits()
+	if err != nil {
+		t.Fatalf("Unexpected error loading the directive limits: %v", err)
+	}
+
+	labels := map[string]string{LabelSkip: "true", LabelSpanSize: "4194304", LabelMinLayerSize: "1048576"}
+	actual, skipped := applyLabelDirectives(context.Background(), testReindexParameters(), testImageConfig(labels), limits)
+	if skipped != "" {
+		t.Fatalf("Expected a label which isn't honoured not to skip the build")
+	}
+	if actual.SpanSize != 2097152 || actual.MinLayerSize != defaultMinLayerSize {
+		t.Fatalf("Unexpected build parameters %+v", actual)
+	}
+
+	t.Setenv(labelDirectivesEnv, "none")
+	if limits, err := loadDirectiveLimits(); err != nil || len(limits.Allowed) != 0 {
+		t.Fatalf("Expected no label to be honoured, got %v, %v", limits.Allowed, err)
+	}
+
+	t.Setenv(labelDirectivesEnv, "soci.unknown")
+	if _, err := loadDirectiveLimits(); err == nil {
+		t.Fatalf("Expected an error for an unknown label")
+	}
+	t.Setenv(labelDirectivesEnv, "")
+	t.Setenv(labelSpanSizeLimitsEnv, "2097152-1048576")
+	if _, err := loadDirectiveLimits(); err == nil {
+		t.Fatalf("Expected an error for reversed limits")
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/version"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// Annotations recording how and why a SOCI index was built, next to the build parameters
+const (
+	AnnotationBuilderVersion = "com.amazon.soci-index-builder.version"
+	AnnotationSociVersion    = "com.amazon.soci-index-builder.soci-version"
+	AnnotationBuildTime      = "com.amazon.soci-index-builder.build-time"
+	AnnotationEventId        = "com.amazon.soci-index-builder.event-id"
+	AnnotationRequestId      = "com.amazon.soci-index-builder.request-id"
+)
+
+// Returns the provenance annotations of a SOCI index built now. The event and request ids are only
+// recorded when the build was triggered by an event, respectively run in Lambda.
+func provenanceAnnotations(ctx context.Context, buildTime time.Time) map[string]string {
+	annotations := map[string]string{
+		AnnotationBuilderVersion: version.Builder(),
+		AnnotationSociVersion:    version.Soci(),
+		AnnotationBuildTime:      buildTime.UTC().Format(time.RFC3339),
+	}
+	if eventId := log.Value(ctx, log.EventId); eventId != "" {
+		annotations[AnnotationEventId] = eventId
+	}
+	if lambdaCtx, ok := lambdacontext.FromContext(ctx); ok {
+		annotations[AnnotationRequestId] = lambdaCtx.AwsRequestID
+	}
+	return annotations
+}
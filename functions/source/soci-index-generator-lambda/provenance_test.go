@@ -0,0 +1,38 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+func TestProvenanceAnnotations(t *testing.T) {
+	buildTime := time.Date(2023, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	annotations := provenanceAnnotations(context.Background(), buildTime)
+	if annotations[AnnotationBuildTime] != "2023-06-01T12:30:00Z" {
+		t.Fatalf("Unexpected build time %q", annotations[AnnotationBuildTime])
+	}
+	if annotations[AnnotationBuilderVersion] == "" || annotations[AnnotationSociVersion] == "" {
+		t.Fatalf("Expected the builder and SOCI versions to be recorded, got %v", annotations)
+	}
+	if _, ok := annotations[AnnotationEventId]; ok {
+		t.Fatalf("Expected no event id without an event")
+	}
+	if _, ok := annotations[AnnotationRequestId]; ok {
+		t.Fatalf("Expected no request id outside of Lambda")
+	}
+
+	ctx := log.With(context.Background(), log.EventId, "d1a2c3b4-0000-1111-2222-333344445555")
+	ctx = lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{AwsRequestID: "request-id"})
+	annotations = provenanceAnnotations(ctx, buildTime)
+	if annotations[AnnotationEventId] != "d1a2c3b4-0000-1111-2222-333344445555" || annotations[AnnotationRequestId] != "request-id" {
+		t.Fatalf("Expected the event and request ids to be recorded, got %v", annotations)
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/events"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+// Build a SOCI index for an image cached by an ECR pull through cache rule.
+// The index is built from the cached copy in the private registry, never from the upstream registry.
+func HandlePullThroughCacheRequest(ctx context.Context, event events.ECRPullThroughCacheActionEvent) (string, error) {
+	ctx = log.With(ctx, log.EventId, event.Id)
+	request, err := event.Request()
+	if err != nil {
+		return invalidRequest(ctx, "ECRPullThroughCacheActionEvent validation error", err)
+	}
+	return handleRequest(ctx, request)
+}
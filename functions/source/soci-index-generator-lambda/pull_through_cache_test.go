@@ -0,0 +1,66 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+func pullThroughCacheEvent(syncStatus string, imageDigest string) events.ECRPullThroughCacheActionEvent {
+	return events.ECRPullThroughCacheActionEvent{
+		Version:    "0",
+		Id:         "id",
+		DetailType: "ECR Pull Through Cache Action",
+		Source:     "aws.ecr",
+		Account:    "123456789012",
+		Time:       "time",
+		Region:     "us-west-2",
+		Detail: events.ECRPullThroughCacheActionEventDetail{
+			RuleVersion:         "1",
+			SyncStatus:          syncStatus,
+			EcrRepositoryPrefix: "docker-hub",
+			RepositoryName:      "docker-hub/library/redis",
+			UpstreamRegistryUrl: "registry-1.docker.io",
+			ImageTag:            "7",
+			ImageDigest:         imageDigest,
+		},
+	}
+}
+
+// This test ensures that a failed upstream sync is reported as an upstream error without triggering retries
+func TestHandlePullThroughCacheUpstreamSyncFailure(t *testing.T) {
+	event := pullThroughCacheEvent("FAILED", "")
+	event.Detail.FailureCode = "UPSTREAM_UNREACHABLE"
+	event.Detail.FailureReason = "Unable to reach upstream registry"
+
+	lc := lambdacontext.LambdaContext{}
+	lc.AwsRequestID = "abcd-1234"
+	ctx := lambdacontext.NewContext(context.Background(), &lc)
+
+	resp, err := HandlePullThroughCacheRequest(ctx, event)
+	if err != nil {
+		t.Fatalf("Upstream sync failure is not expected to fail")
+	}
+	if resp != UpstreamSyncFailedMessage {
+		t.Fatalf("Unexpected response. Expected %s but got %s", UpstreamSyncFailedMessage, resp)
+	}
+}
+
+func TestValidatePullThroughCacheEvent(t *testing.T) {
+	digest := "sha256:afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187"
+
+	if request, err := pullThroughCacheEvent("SUCCESS", digest).Request(); err != nil || request.Action != events.ActionBuild {
+		t.Fatalf("Valid pull through cache event is expected to be a build request, got %q: %v", request.Action, err)
+	}
+	if _, err := pullThroughCacheEvent("SUCCESS", "").Request(); err == nil {
+		t.Fatalf("Pull through cache event without an image digest is expected to fail validation")
+	}
+	if request, err := pullThroughCacheEvent("FAILED", "").Request(); err != nil || request.Action != events.ActionUpstreamFailure {
+		t.Fatalf("Failed sync event without an image digest is expected to be an upstream failure, got %q: %v", request.Action, err)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/version"
+)
+
+const (
+	outdatedBuildParameters = "build parameters"
+	outdatedBuilderVersion  = "builder version"
+	outdatedSociVersion     = "soci version"
+	outdatedIndexFormat     = "index format"
+)
+
+// A SOCI index built by another builder version or with other settings than the current ones
+type outdatedIndex struct {
+	Digest      string   `json:"digest"`
+	ImageDigest string   `json:"imageDigest"`
+	Reasons     []string `json:"reasons"`
+}
+
+// An image whose SOCI index couldn't be rebuilt or replaced
+type reindexFailure struct {
+	ImageDigest string `json:"imageDigest"`
+	Error       string `json:"error"`
+}
+
+// The outdated SOCI indexes of a repository, and the ones a reindex replaced
+type reindexReport struct {
+	RegistryURL string           `json:"registryUrl"`
+	Repository  string           `json:"repository"`
+	DryRun      bool             `json:"dryRun"`
+	IndexCount  int              `json:"indexCount"`
+	Outdated    []outdatedIndex  `json:"outdated"`
+	Rebuilt     []string         `json:"rebuilt"`
+	Replaced    []string         `json:"replaced"`
+	Failed      []reindexFailure `json:"failed"`
+}
+
+// Options of a repository reindex
+type reindexOptions struct {
+	DryRun bool
+	// Minimum time between two rebuilds, zero for no limit
+	Interval time.Duration
+	// Maximum number of images to rebuild, zero for no limit
+	Limit int
+}
+
+// Returns why a SOCI index is outdated compared to the current builder and configuration, or nil if it is current
+func outdatedReasons(index registryutils.SociIndexManifest, params buildParameters, referrersMode bool) []string {
+	annotations := index.Manifest.Annotations
+	var reasons []string
+	if !params.matches(annotations) {
+		reasons = append(reasons, outdatedBuildParameters)
+	}
+	// Indexes built before provenance was recorded are outdated too
+	if annotations[AnnotationBuilderVersion] != version.Builder() {
+		reasons = append(reasons, outdatedBuilderVersion)
+	}
+	if annotations[AnnotationSociVersion] != version.Soci() {
+		reasons = append(reasons, outdatedSociVersion)
+	}
+	// The index version is a build parameter. Legacy encoded indexes are left alone, as the registry would
+	// reject any other encoding again.
+	if params.IndexVersion == indexVersionV1 && index.Manifest.MediaType != registryutils.MediaTypeDockerManifest {
+		if (index.Manifest.ArtifactType != "") != referrersMode {
+			reasons = append(reasons, outdatedIndexFormat)
+		}
+	}
+	return reasons
+}
+
+// Find the images whose SOCI indexes are all outdated. Images which have a current index are skipped, their
+// outdated indexes are duplicates for the sweep command to delete. So are the indexes of deleted images.
+// Returns the outdated indexes by image digest.
+func planReindex(indexes []registryutils.SociIndexManifest, images map[string]registryutils.ImageDetail, params buildParameters, referrersMode bool) map[string][]outdatedIndex {
+	plan := map[string][]outdatedIndex{}
+	current := map[string]bool{}
+	for _, index := range indexes {
+		imageDigest := index.ImageManifestDigest()
+		if _, exists := images[imageDigest]; !exists {
+			continue
+		}
+		reasons := outdatedReasons(index, params, referrersMode)
+		if len(reasons) == 0 {
+			current[imageDigest] = true
+			continue
+		}
+		plan[imageDigest] = append(plan[imageDigest], outdatedIndex{
+			Digest:      index.Descriptor.Digest.String(),
+			ImageDigest: imageDigest,
+			Reasons:     reasons,
+		})
+	}
+	for imageDigest := range current {
+		delete(plan, imageDigest)
+	}
+	return plan
+}
+
+// Rebuild the outdated SOCI indexes of a repository and delete the indexes they replace, unless it is a dry run
+func reindexRepository(ctx context.Context, registry *registryutils.Registry, registryUrl string, repo string, options reindexOptions) (reindexReport, error) {
+	report := reindexReport{RegistryURL: registryUrl, Repository: repo, DryRun: options.DryRun, Outdated: []outdatedIndex{}, Rebuilt: []string{}, Replaced: []string{}, Failed: []reindexFailure{}}
+
+	params, err := loadBuildParameters(repo)
+	if err != nil {
+		return report, err
+	}
+
+	imageList, err := registry.ListImages(ctx, repo)
+	if err != nil {
+		return report, err
+	}
+	images := map[string]registryutils.ImageDetail{}
+	for _, image := range imageList {
+		images[image.Digest] = image
+	}
+
+	indexes, err := registry.ListSociIndexes(ctx, repo)
+	if err != nil {
+		return report, err
+	}
+	report.IndexCount = len(indexes)
+
+	plan := planReindex(indexes, images, params, referrersModeEnabled())
+	var imageDigests []string
+	for imageDigest, outdated := range plan {
+		imageDigests = append(imageDigests, imageDigest)
+		report.Outdated = append(report.Outdated, outdated...)
+	}
+	sort.Strings(imageDigests)
+	sort.Slice(report.Outdated, func(i, j int) bool { return report.Outdated[i].Digest < report.Outdated[j].Digest })
+
+	if options.DryRun {
+		log.Info(ctx, fmt.Sprintf("Dry run: found %d outdated SOCI indexes of %d images", len(report.Outdated), len(imageDigests)))
+		return report, nil
+	}
+
+	var lastBuild time.Time
+	for i, imageDigest := range imageDigests {
+		if options.Limit > 0 && i >= options.Limit {
+			log.Info(ctx, fmt.Sprintf("Reached the limit of %d rebuilds, %d images left", options.Limit, len(imageDigests)-i))
+			break
+		}
+		if wait := options.Interval - time.Since(lastBuild); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return report, ctx.Err()
+			}
+		}
+		lastBuild = time.Now()
+
+		imageCtx := log.With(ctx, log.ImageDigest, imageDigest)
+		replaced, err := reindexImage(imageCtx, registry, registryUrl, repo, images[imageDigest], plan[imageDigest])
+		report.Replaced = append(report.Replaced, replaced...)
+		if err != nil {
+			log.Error(imageCtx, "SOCI index rebuild error", err)
+			report.Failed = append(report.Failed, reindexFailure{ImageDigest: imageDigest, Error: err.Error()})
+			continue
+		}
+		report.Rebuilt = append(report.Rebuilt, imageDigest)
+	}
+	return report, nil
+}
+
+// Rebuild the SOCI index of an image and delete the outdated indexes it replaces.
+// Returns the digests of the deleted indexes.
+func reindexImage(ctx context.Context, registry *registryutils.Registry, registryUrl string, repo string, image registryutils.ImageDetail, outdated []outdatedIndex) ([]string, error) {
+	req := buildRequest{RegistryURL: registryUrl, Repository: repo, Digest: image.Digest, Force: true}
+	if len(image.Tags) > 0 {
+		req.Tag = image.Tags[0]
+	}
+
+	msg, err := buildAndPushIndex(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(msg, BuildAndPushSuccessMessage) {
+		return nil, fmt.Errorf("SOCI index not rebuilt: %s", msg)
+	}
+
+	var replaced []string
+	for _, index := range outdated {
+		descriptor, err := registry.HeadManifest(ctx, repo, index.Digest)
+		if err != nil {
+			return replaced, err
+		}
+		if err := registry.DeleteManifest(ctx, repo, descriptor); err != nil {
+			return replaced, err
+		}
+		log.Info(log.With(ctx, log.SOCIIndexDigest, index.Digest), "Deleted outdated SOCI index")
+		replaced = append(replaced, index.Digest)
+	}
+	return replaced, nil
+}
@@ -0,0 +1,99 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/version"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func testReindexParameters() buildParameters {
+	return buildParameters{
+		Platform:     ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		SpanSize:     defaultSpanSize,
+		MinLayerSize: defaultMinLayerSize,
+		IndexVersion: indexVersionV1,
+	}
+}
+
+// Returns a SOCI index of an image, with the annotations of an index built now with the given parameters
+func testIndexOf(name string, imageDigest string, params buildParameters) registryutils.SociIndexManifest {
+	annotations := params.annotations()
+	annotations[AnnotationBuilderVersion] = version.Builder()
+	annotations[AnnotationSociVersion] = version.Soci()
+	return registryutils.SociIndexManifest{
+		Descriptor: ocispec.Descriptor{Digest: digest.Digest("sha256:" + name)},
+		Manifest: ocispec.Manifest{
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Subject:     &ocispec.Descriptor{Digest: digest.Digest(imageDigest)},
+			Annotations: annotations,
+		},
+	}
+}
+
+func TestOutdatedReasons(t *testing.T) {
+	params := testReindexParameters()
+
+	current := testIndexOf("current", "sha256:image", params)
+	if reasons := outdatedReasons(current, params, false); len(reasons) != 0 {
+		t.Fatalf("Expected an index built now to be current, got %v", reasons)
+	}
+	if reasons := outdatedReasons(current, params, true); !reflect.DeepEqual(reasons, []string{outdatedIndexFormat}) {
+		t.Fatalf("Expected an index without an artifact type to be outdated in referrers mode, got %v", reasons)
+	}
+
+	custom := params
+	custom.SpanSize = 1 << 20
+	if reasons := outdatedReasons(current, custom, false); !reflect.DeepEqual(reasons, []string{outdatedBuildParameters}) {
+		t.Fatalf("Expected a span size change to outdate the index, got %v", reasons)
+	}
+
+	old := testIndexOf("old", "sha256:image", params)
+	old.Manifest.Annotations[AnnotationBuilderVersion] = "v0.0.1"
+	delete(old.Manifest.Annotations, AnnotationSociVersion)
+	if reasons := outdatedReasons(old, params, false); !reflect.DeepEqual(reasons, []string{outdatedBuilderVersion, outdatedSociVersion}) {
+		t.Fatalf("Expected an index of another builder version to be outdated, got %v", reasons)
+	}
+
+	legacy := testIndexOf("legacy", "sha256:image", params)
+	legacy.Manifest.MediaType = registryutils.MediaTypeDockerManifest
+	if reasons := outdatedReasons(legacy, params, true); len(reasons) != 0 {
+		t.Fatalf("Expected a legacy encoded index not to be outdated by its format, got %v", reasons)
+	}
+}
+
+func TestPlanReindex(t *testing.T) {
+	params := testReindexParameters()
+	outdatedParams := params
+	outdatedParams.SpanSize = 1 << 20
+
+	images := map[string]registryutils.ImageDetail{
+		"sha256:a": {Digest: "sha256:a"},
+		"sha256:b": {Digest: "sha256:b"},
+	}
+	indexes := []registryutils.SociIndexManifest{
+		// Image a only has outdated indexes
+		testIndexOf("a1", "sha256:a", outdatedParams),
+		testIndexOf("a2", "sha256:a", outdatedParams),
+		// Image b has a current index next to an outdated one
+		testIndexOf("b1", "sha256:b", outdatedParams),
+		testIndexOf("b2", "sha256:b", params),
+		// Image c was deleted
+		testIndexOf("c1", "sha256:c", outdatedParams),
+	}
+
+	plan := planReindex(indexes, images, params, false)
+	if len(plan) != 1 || len(plan["sha256:a"]) != 2 {
+		t.Fatalf("Expected only image a to be reindexed, got %v", plan)
+	}
+	if plan["sha256:a"][0].Digest != "sha256:a1" || plan["sha256:a"][1].Digest != "sha256:a2" {
+		t.Fatalf("Expected both indexes of image a to be replaced, got %v", plan["sha256:a"])
+	}
+}
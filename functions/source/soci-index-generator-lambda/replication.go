@@ -0,0 +1,182 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/events"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+)
+
+const (
+	// Comma-separated list of registries the SOCI index is copied to after it is pushed.
+	// Each destination is either an ECR registry given as "<account id>:<region>" or a registry url.
+	replicationDestinationsEnv = "SOCI_REPLICATION_DESTINATIONS"
+
+	ReplicationFailedMessage = "SOCI index replication error"
+
+	replicationStatusReplicated    = "replicated"
+	replicationStatusImageNotFound = "skipped: image not found in destination"
+	replicationStatusFailed        = "failed"
+)
+
+// The outcome of copying a SOCI index to one replication destination
+type replicationOutcome struct {
+	RegistryURL string
+	Status      string
+	Encoding    string
+	Err         error
+}
+
+// Parse replication destinations into registry urls. The source registry is never a destination.
+func parseReplicationDestinations(value string, sourceRegistryUrl string) ([]string, error) {
+	accountAndRegion := regexp.MustCompile(`^([0-9]{12}):([a-z0-9-]+)$`)
+
+	var registryUrls []string
+	seen := map[string]bool{sourceRegistryUrl: true}
+	for _, destination := range strings.Split(value, ",") {
+		destination = strings.TrimSpace(destination)
+		if destination == "" {
+			continue
+		}
+
+		registryUrl := destination
+		if match := accountAndRegion.FindStringSubmatch(destination); match != nil {
+			registryUrl = events.ECRRegistryURL(match[1], match[2])
+		} else if !strings.Contains(destination, ".") {
+			return nil, fmt.Errorf("Invalid replication destination %q, expected '<account id>:<region>' or a registry url", destination)
+		}
+
+		if !seen[registryUrl] {
+			seen[registryUrl] = true
+			registryUrls = append(registryUrls, registryUrl)
+		}
+	}
+	return registryUrls, nil
+}
+
+// Read the replication destinations from the environment
+func replicationDestinations(sourceRegistryUrl string) ([]string, error) {
+	return parseReplicationDestinations(os.Getenv(replicationDestinationsEnv), sourceRegistryUrl)
+}
+
+// Pushes a SOCI index from the local store to a registry, the same way it was pushed to the source registry.
+// Returns the encoding the index was pushed with.
+type pushIndexFunc func(ctx context.Context, registry *registryutils.Registry) (string, error)
+
+// Push a SOCI index to the same repository in every destination registry which already contains
+// the indexed image. Returns the outcome for each destination.
+func replicateIndex(ctx context.Context, pushIndex pushIndexFunc, repo string, digest string, registryUrls []string) []replicationOutcome {
+	var outcomes []replicationOutcome
+	for _, registryUrl := range registryUrls {
+		destCtx := log.With(ctx, log.ReplicationRegistryURL, registryUrl)
+		outcome := replicateIndexTo(destCtx, pushIndex, repo, digest, registryUrl)
+		if outcome.Err != nil {
+			log.Error(destCtx, "SOCI index replication to destination failed", outcome.Err)
+		} else {
+			log.Info(log.With(destCtx, log.SOCIIndexEncoding, outcome.Encoding), fmt.Sprintf("SOCI index replication to destination: %s", outcome.Status))
+		}
+		outcomes = append(outcomes, outcome)
+	}
+	return outcomes
+}
+
+func replicateIndexTo(ctx context.Context, pushIndex pushIndexFunc, repo string, digest string, registryUrl string) replicationOutcome {
+	outcome := replicationOutcome{RegistryURL: registryUrl}
+
+	registry, err := registryutils.Init(ctx, registryUrl)
+	if err != nil {
+		outcome.Status, outcome.Err = replicationStatusFailed, err
+		return outcome
+	}
+
+	exists, err := registry.HasManifest(ctx, repo, digest)
+	if err != nil {
+		outcome.Status, outcome.Err = replicationStatusFailed, err
+		return outcome
+	}
+	if !exists {
+		outcome.Status = replicationStatusImageNotFound
+		return outcome
+	}
+
+	if outcome.Encoding, err = pushIndex(ctx, registry); err != nil {
+		outcome.Status, outcome.Err = replicationStatusFailed, err
+		return outcome
+	}
+
+	outcome.Status = replicationStatusReplicated
+	return outcome
+}
+
+// Summarize replication outcomes, returning an error if any destination failed
+func replicationError(outcomes []replicationOutcome) error {
+	var failed []string
+	for _, outcome := range outcomes {
+		if outcome.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", outcome.RegistryURL, outcome.Err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Replication failed for %d of %d destinations: %s", len(failed), len(outcomes), strings.Join(failed, "; "))
+}
+
+// Returns the function copying a SOCI index the source registry already has to a destination, in the encoding it
+// was pushed with, for builds which find the index of a previous build whose replication failed. Destinations
+// which already have the index are left untouched.
+func copyExistingIndex(source *registryutils.Registry, index registryutils.SociIndexManifest, repo string, imageDigest string, tag string, indexTagName string) pushIndexFunc {
+	return func(ctx context.Context, registry *registryutils.Registry) (string, error) {
+		desc, encoding, copyTag := index.Descriptor, existingIndexEncoding(index), indexTagName
+		// SOCI index manifests v2 are copied with their image index, which is what the v2 tag names
+		if encoding == IndexEncodingImageIndexV2 {
+			copyTag = v2Tag(tag)
+			imageIndexDesc, err := source.HeadManifest(ctx, repo, copyTag)
+			if err != nil {
+				return "", err
+			}
+			desc = imageIndexDesc
+		}
+
+		exists, err := registry.HasManifest(ctx, repo, desc.Digest.String())
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			log.Info(ctx, "Destination already has the SOCI index")
+			return encoding, nil
+		}
+
+		if err := source.Copy(ctx, repo, desc, registry); err != nil {
+			return "", err
+		}
+		switch {
+		case encoding == IndexEncodingImageIndexV2:
+			return encoding, registry.Tag(ctx, repo, desc, copyTag)
+		case copyTag != "":
+			return encoding, tagIndex(ctx, registry, repo, imageDigest, desc, copyTag)
+		}
+		return encoding, nil
+	}
+}
+
+// Returns the encoding a SOCI index was pushed with
+func existingIndexEncoding(index registryutils.SociIndexManifest) string {
+	switch {
+	case index.Manifest.ArtifactType == registryutils.SociIndexArtifactTypeV2 || index.Manifest.Config.MediaType == registryutils.SociIndexArtifactTypeV2:
+		return IndexEncodingImageIndexV2
+	case index.Descriptor.MediaType == registryutils.MediaTypeDockerManifest:
+		return IndexEncodingLegacy
+	case index.Manifest.ArtifactType != "":
+		return IndexEncodingReferrer
+	}
+	return IndexEncodingOCI
+}
@@ -0,0 +1,236 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParseReplicationDestinations(t *testing.T) {
+	source := "123456789012.dkr.ecr.us-west-2.amazonaws.com"
+
+	destinations, err := parseReplicationDestinations(" 123456789012:us-east-1, 210987654321:cn-north-1,123456789012:us-west-2,registry.example.com,123456789012:us-east-1", source)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing replication destinations: %v", err)
+	}
+	expected := []string{
+		"123456789012.dkr.ecr.us-east-1.amazonaws.com",
+		"210987654321.dkr.ecr.cn-north-1.amazonaws.com.cn",
+		"registry.example.com",
+	}
+	if !reflect.DeepEqual(destinations, expected) {
+		t.Fatalf("Unexpected replication destinations. Expected %v but got %v", expected, destinations)
+	}
+
+	destinations, err = parseReplicationDestinations("", source)
+	if err != nil || len(destinations) != 0 {
+		t.Fatalf("Expected no replication destinations, got %v, %v", destinations, err)
+	}
+
+	if _, err = parseReplicationDestinations("us-east-1", source); err == nil {
+		t.Fatalf("Expected an error for an invalid replication destination")
+	}
+}
+
+func TestReplicationError(t *testing.T) {
+	outcomes := []replicationOutcome{
+		{RegistryURL: "a", Status: replicationStatusReplicated},
+		{RegistryURL: "b", Status: replicationStatusImageNotFound},
+	}
+	if err := replicationError(outcomes); err != nil {
+		t.Fatalf("Expected no replication error, got %v", err)
+	}
+
+	outcomes = append(outcomes, replicationOutcome{RegistryURL: "c", Status: replicationStatusFailed, Err: errors.New("denied")})
+	if err := replicationError(outcomes); err == nil {
+		t.Fatalf("Expected a replication error")
+	}
+}
+
+// Fake registry storing the manifests and blobs pushed to it, without the referrers API
+type testRegistryServer struct {
+	mutex     sync.Mutex
+	manifests map[digest.Digest][]byte
+	blobs     map[digest.Digest][]byte
+	tags      map[string]digest.Digest
+	// Manifest pushes are denied when set
+	denyManifests bool
+	manifestPuts  int
+}
+
+func newTestRegistryServer() *testRegistryServer {
+	return &testRegistryServer{manifests: map[digest.Digest][]byte{}, blobs: map[digest.Digest][]byte{}, tags: map[string]digest.Digest{}}
+}
+
+func (server *testRegistryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	switch path := r.URL.Path; {
+	case strings.HasPrefix(path, "/v2/repo/manifests/"):
+		reference := strings.TrimPrefix(path, "/v2/repo/manifests/")
+		if r.Method == http.MethodPut {
+			server.manifestPuts++
+			if server.denyManifests {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			content, _ := io.ReadAll(r.Body)
+			dgst := digest.FromBytes(content)
+			server.manifests[dgst] = content
+			if _, err := digest.Parse(reference); err != nil {
+				server.tags[reference] = dgst
+			}
+			w.Header().Set("Docker-Content-Digest", dgst.String())
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		dgst := digest.Digest(reference)
+		if tagged, ok := server.tags[reference]; ok {
+			dgst = tagged
+		}
+		content, ok := server.manifests[dgst]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var mediaType struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(content, &mediaType)
+		w.Header().Set("Content-Type", mediaType.MediaType)
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method == http.MethodGet {
+			w.Write(content)
+		}
+	case strings.HasPrefix(path, "/v2/repo/blobs/uploads/"):
+		if r.Method == http.MethodPost {
+			w.Header().Set("Location", "/v2/repo/blobs/uploads/1")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		content, _ := io.ReadAll(r.Body)
+		server.blobs[digest.FromBytes(content)] = content
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(path, "/v2/repo/blobs/"):
+		dgst := digest.Digest(strings.TrimPrefix(path, "/v2/repo/blobs/"))
+		content, ok := server.blobs[dgst]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method == http.MethodGet {
+			w.Write(content)
+		}
+	default:
+		// Including the referrers API, for indexes to be found with the referrers tag schema
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Store a blob or a manifest in the fake registry, returning its descriptor
+func (server *testRegistryServer) add(t *testing.T, mediaType string, value interface{}, manifest bool) ocispec.Descriptor {
+	content, err := json.Marshal(value)
+	if err != nil {
+		t.Fatalf("Unexpected error encoding %s: %v", mediaType, err)
+	}
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(content), Size: int64(len(content))}
+	if manifest {
+		server.manifests[desc.Digest] = content
+	} else {
+		server.blobs[desc.Digest] = content
+	}
+	return desc
+}
+
+// Store an image in the fake registry, returning its descriptor
+func (server *testRegistryServer) addImage(t *testing.T) ocispec.Descriptor {
+	image := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    server.add(t, ocispec.MediaTypeImageConfig, ocispec.Image{Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"}}, false),
+		Layers:    []ocispec.Descriptor{server.add(t, ocispec.MediaTypeImageLayerGzip, "layer", false)},
+	}
+	image.SchemaVersion = 2
+	return server.add(t, ocispec.MediaTypeImageManifest, image, true)
+}
+
+// Store a v1 SOCI index of an image in the fake registry, in the referrers tag of the image, returning its descriptor
+func (server *testRegistryServer) addSociIndex(t *testing.T, imageDesc ocispec.Descriptor) ocispec.Descriptor {
+	index := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    server.add(t, soci.SociIndexArtifactType, map[string]string{}, false),
+		Layers:    []ocispec.Descriptor{server.add(t, soci.SociLayerMediaType, "ztoc", false)},
+		Subject:   &imageDesc,
+	}
+	index.SchemaVersion = 2
+	indexDesc := server.add(t, ocispec.MediaTypeImageManifest, index, true)
+	indexDesc.ArtifactType = soci.SociIndexArtifactType
+	referrers := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: []ocispec.Descriptor{indexDesc}}
+	referrers.SchemaVersion = 2
+	server.tags["sha256-"+imageDesc.Digest.Encoded()] = server.add(t, ocispec.MediaTypeImageIndex, referrers, true).Digest
+	return indexDesc
+}
+
+func TestReplicationIsRetriedForExistingIndexes(t *testing.T) {
+	source, destination := newTestRegistryServer(), newTestRegistryServer()
+	sourceServer, destinationServer := httptest.NewServer(source), httptest.NewServer(destination)
+	defer sourceServer.Close()
+	defer destinationServer.Close()
+	sourceUrl := strings.TrimPrefix(sourceServer.URL, "http://")
+	destinationUrl := strings.TrimPrefix(destinationServer.URL, "http://")
+	t.Setenv("SOCI_PLAIN_HTTP_REGISTRIES", sourceUrl+","+destinationUrl)
+	t.Setenv(replicationDestinationsEnv, destinationUrl)
+	t.Setenv(indexTagTemplateEnv, "soci-{digest}")
+
+	// The image is in both registries
+	imageDesc := source.addImage(t)
+	destination.addImage(t)
+
+	// A previous build pushed the SOCI index to the source registry, but failed to replicate it
+	indexDesc := source.addSociIndex(t, imageDesc)
+
+	req := buildRequest{RegistryURL: sourceUrl, Repository: "repo", Digest: imageDesc.Digest.String()}
+	destination.denyManifests = true
+	if result, err := buildAndPushIndex(context.Background(), req); err == nil || result != ReplicationFailedMessage {
+		t.Fatalf("Expected the replication to fail again, got %v, %v", result, err)
+	}
+
+	// Retrying once the destination accepts the index replicates it without building it again
+	destination.denyManifests = false
+	if result, err := buildAndPushIndex(context.Background(), req); err != nil || result != AlreadyIndexedMessage {
+		t.Fatalf("Expected the existing index to be replicated, got %v, %v", result, err)
+	}
+	if _, ok := destination.manifests[indexDesc.Digest]; !ok {
+		t.Fatalf("Expected the destination to have the SOCI index")
+	}
+	if destination.tags["soci-"+imageDesc.Digest.Encoded()] != indexDesc.Digest {
+		t.Fatalf("Expected the SOCI index to be tagged in the destination, got tags %v", destination.tags)
+	}
+	if _, ok := destination.tags["sha256-"+imageDesc.Digest.Encoded()]; !ok {
+		t.Fatalf("Expected the SOCI index to be added to the referrers tag of the destination, got tags %v", destination.tags)
+	}
+
+	// Destinations which already have the index are left untouched
+	puts := destination.manifestPuts
+	if result, err := buildAndPushIndex(context.Background(), req); err != nil || result != AlreadyIndexedMessage || destination.manifestPuts != puts {
+		t.Fatalf("Expected the replicated index to be left untouched, got %v, %v and %d pushes", result, err, destination.manifestPuts-puts)
+	}
+}
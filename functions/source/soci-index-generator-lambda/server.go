@@ -0,0 +1,403 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/events"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/metrics"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+
+	// Largest request body the server reads, registry notifications included
+	maxRequestBodySize = 1 << 20
+	// Seconds after which clients retry a request rejected because the queue is full or the server is draining
+	retryAfter = "30"
+)
+
+var errQueueFull = errors.New("The build queue is full")
+
+// A build request queued by the server, and its outcome once built
+type buildJob struct {
+	Id       string `json:"id"`
+	Status   string `json:"status"`
+	Envelope string `json:"envelope"`
+	// The result of a build request, or the message of an EventBridge event's handler
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	StartedAt  *time.Time  `json:"startedAt,omitempty"`
+	FinishedAt *time.Time  `json:"finishedAt,omitempty"`
+
+	request events.Request
+	// Trace context of the request queuing the job, the job's span continues its trace
+	trace trace.SpanContext
+}
+
+// Runs the build of a job, returning its result
+type buildFunc func(ctx context.Context, request events.Request) (interface{}, error)
+
+// Build server queuing build requests in process and building them with a fixed number of workers
+type buildServer struct {
+	queue chan *buildJob
+	build buildFunc
+	// Maximum duration of a build, zero for no limit
+	buildTimeout time.Duration
+
+	mutex sync.Mutex
+	jobs  map[string]*buildJob
+	// Job ids in creation order, the oldest finished jobs are forgotten past maxJobs
+	order    []string
+	maxJobs  int
+	running  int
+	draining bool
+}
+
+// Options of the build server
+type serverOptions struct {
+	Addr            string
+	Workers         int
+	QueueSize       int
+	MaxJobs         int
+	BuildTimeout    time.Duration
+	ShutdownTimeout time.Duration
+}
+
+func newBuildServer(queueSize int, maxJobs int, buildTimeout time.Duration, build buildFunc) *buildServer {
+	return &buildServer{
+		queue:        make(chan *buildJob, queueSize),
+		build:        build,
+		buildTimeout: buildTimeout,
+		jobs:         map[string]*buildJob{},
+		maxJobs:      maxJobs,
+	}
+}
+
+// Build a decoded request, returning the structured result of build requests
+func buildDecodedRequest(ctx context.Context, request events.Request) (interface{}, error) {
+	if request.Action != events.ActionBuild {
+		return handleDecodedRequest(ctx, request)
+	}
+	if request.Id != "" {
+		ctx = log.With(ctx, log.EventId, request.Id)
+	}
+	return buildByReference(ctx, *request.Build, request.Time)
+}
+
+func newJobId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// Queue a job per request, failing without queuing any if the queue can't take them all
+func (server *buildServer) enqueue(requests []events.Request, traceContext trace.SpanContext) ([]buildJob, error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.draining {
+		return nil, errors.New("The server is shutting down")
+	}
+	if len(requests) > cap(server.queue)-len(server.queue) {
+		return nil, errQueueFull
+	}
+
+	jobs := []buildJob{}
+	for _, request := range requests {
+		job := &buildJob{Id: newJobId(), Status: jobQueued, Envelope: request.Envelope(), CreatedAt: time.Now().UTC(), request: request, trace: traceContext}
+		server.jobs[job.Id] = job
+		server.order = append(server.order, job.Id)
+		server.queue <- job
+		jobs = append(jobs, *job)
+	}
+	metrics.SetQueueDepth(len(server.queue))
+	server.forgetOldJobs()
+	return jobs, nil
+}
+
+// Forget the oldest finished jobs past the maximum number of jobs. Must be called with the mutex held.
+func (server *buildServer) forgetOldJobs() {
+	excess := len(server.order) - server.maxJobs
+	kept := server.order[:0]
+	for _, id := range server.order {
+		job := server.jobs[id]
+		if excess > 0 && job.FinishedAt != nil {
+			delete(server.jobs, id)
+			excess--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	server.order = kept
+}
+
+// Returns a copy of a job, safe to encode while the job runs
+func (server *buildServer) job(id string) (buildJob, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	job, ok := server.jobs[id]
+	if !ok {
+		return buildJob{}, false
+	}
+	return *job, true
+}
+
+func (server *buildServer) update(job *buildJob, update func(job *buildJob)) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	update(job)
+}
+
+// Build queued jobs until the queue is closed. Builds run in the context of abort, jobs still queued once the
+// server drains are canceled.
+func (server *buildServer) work(abort context.Context) {
+	for job := range server.queue {
+		server.mutex.Lock()
+		metrics.SetQueueDepth(len(server.queue))
+		now := time.Now().UTC()
+		if server.draining {
+			job.Status, job.Error, job.FinishedAt = jobCanceled, "The server shut down before the build started", &now
+			server.mutex.Unlock()
+			continue
+		}
+		job.Status, job.StartedAt = jobRunning, &now
+		server.running++
+		server.mutex.Unlock()
+
+		result, err := server.run(abort, job)
+
+		server.mutex.Lock()
+		now = time.Now().UTC()
+		job.Result, job.FinishedAt = result, &now
+		if err != nil {
+			job.Status, job.Error = jobFailed, log.Redact(err.Error())
+		} else {
+			job.Status = jobSucceeded
+		}
+		server.running--
+		server.mutex.Unlock()
+	}
+}
+
+func (server *buildServer) run(ctx context.Context, job *buildJob) (interface{}, error) {
+	ctx = log.With(ctx, log.JobId, job.Id)
+	if server.buildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, server.buildTimeout)
+		defer cancel()
+	}
+	ctx, span := tracing.Start(trace.ContextWithRemoteSpanContext(ctx, job.trace), "build job",
+		attribute.String("soci.job.id", job.Id), attribute.String("soci.envelope", job.Envelope))
+	result, err := server.build(ctx, job.request)
+	tracing.End(span, err)
+	return result, err
+}
+
+// Stop accepting jobs and cancel the queued ones. The workers return once their in-flight builds are done.
+func (server *buildServer) drain() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if !server.draining {
+		server.draining = true
+		close(server.queue)
+	}
+}
+
+// Returns the HTTP API of the server:
+//
+//	POST /v1/builds       queue the requests of a payload, e.g. a build request or a registry notification
+//	GET  /v1/builds/{id}  status and result of a job
+//	GET  /healthz         health of the server
+//	GET  /metrics         metrics of the builds, in the Prometheus format
+//
+// The API doesn't authenticate its clients, it must only be reachable through a proxy or load balancer which
+// does. Builds run with the server's registry credentials and AWS role, so they are restricted to the registries
+// of the allowlist.
+func (server *buildServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/builds", server.handleBuilds)
+	mux.HandleFunc("/v1/builds/", server.handleBuild)
+	mux.HandleFunc("/healthz", server.handleHealth)
+	mux.Handle("/metrics", metrics.Handler())
+	return mux
+}
+
+func (server *buildServer) handleBuilds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed, expected POST", r.Method))
+		return
+	}
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	requests, err := events.Decode(payload)
+	if err == nil && events.IsSQSBatch(requests) {
+		err = errors.New("SQS batches are only accepted from the SQS event source mapping")
+	}
+	if err == nil {
+		err = checkRegistries(requests)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	jobs, err := server.enqueue(requests, trace.SpanContextFromContext(tracing.FromHeaders(r.Context(), r.Header)))
+	if err != nil {
+		w.Header().Set("Retry-After", retryAfter)
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	for _, job := range jobs {
+		log.Info(log.With(r.Context(), log.JobId, job.Id), fmt.Sprintf("Queued a build from %s", job.Envelope))
+	}
+	if len(jobs) == 1 {
+		w.Header().Set("Location", "/v1/builds/"+jobs[0].Id)
+	}
+	// A registry notification may queue no build, or several
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"builds": jobs})
+}
+
+// Reject requests naming registries which aren't allowed up front, rather than queuing builds which would be
+// skipped. The builds check the registries again.
+func checkRegistries(requests []events.Request) error {
+	for _, request := range requests {
+		registry := requestRegistry(request)
+		if registry == "" {
+			continue
+		}
+		if allowed, err := registryAllowed(registry); err != nil {
+			return err
+		} else if !allowed {
+			return fmt.Errorf("Registry %q is not allowed, the allowed registries are set with SOCI_ALLOWED_REGISTRIES", registry)
+		}
+	}
+	return nil
+}
+
+func (server *buildServer) handleBuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed, expected GET", r.Method))
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/v1/builds/")
+	job, ok := server.job(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Unknown build %q", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (server *buildServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	server.mutex.Lock()
+	health := map[string]interface{}{"status": "ok", "queued": len(server.queue), "running": server.running}
+	draining := server.draining
+	server.mutex.Unlock()
+
+	if draining {
+		health["status"] = "draining"
+		writeJSON(w, http.StatusServiceUnavailable, health)
+		return
+	}
+	writeJSON(w, http.StatusOK, health)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": log.Redact(err.Error())})
+}
+
+// Serve the build API until ctx is done, then stop accepting builds, cancel the queued ones and wait up to the
+// shutdown timeout for the in-flight ones before canceling them
+func serve(ctx context.Context, options serverOptions) error {
+	allowlist, err := registryutils.LoadAllowlist()
+	if err != nil {
+		return err
+	}
+	if allowlist.IsEmpty() {
+		log.Warn(ctx, "No registry is allowed, every build will be rejected until SOCI_ALLOWED_REGISTRIES is set")
+	}
+	server := newBuildServer(options.QueueSize, options.MaxJobs, options.BuildTimeout, buildDecodedRequest)
+	abort, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var workers sync.WaitGroup
+	for i := 0; i < options.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			server.work(abort)
+		}()
+	}
+
+	httpServer := &http.Server{Addr: options.Addr, Handler: server.handler(), ReadHeaderTimeout: 30 * time.Second}
+	served := make(chan error, 1)
+	go func() {
+		served <- httpServer.ListenAndServe()
+	}()
+	log.Info(ctx, fmt.Sprintf("Serving the build API on %s with %d workers", options.Addr, options.Workers))
+
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+		log.Info(ctx, "Shutting down, draining the in-flight builds")
+	}
+
+	// The health check fails from now on, for load balancers to stop routing to the server
+	server.drain()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), options.ShutdownTimeout)
+	defer cancelShutdown()
+	if shutdownErr := httpServer.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+		err = shutdownErr
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		log.Warn(ctx, "The in-flight builds didn't finish before the shutdown timeout, canceling them")
+		cancel()
+		<-drained
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,214 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/events"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+const testServerBuild = `{"registry": "localhost:5000", "repository": "repo", "reference": "v1"}`
+
+func testRequest(t *testing.T, server *httptest.Server, method string, path string, body string, response interface{}) int {
+	request, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Unexpected error creating the request: %v", err)
+	}
+	resp, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatalf("Unexpected error sending the request: %v", err)
+	}
+	defer resp.Body.Close()
+	if response != nil {
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+			t.Fatalf("Unexpected error decoding the response: %v", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// Wait for a job to finish, returning it as served by the API
+func testWaitForJob(t *testing.T, server *httptest.Server, id string) buildJob {
+	for i := 0; i < 100; i++ {
+		var job buildJob
+		if status := testRequest(t, server, http.MethodGet, "/v1/builds/"+id, "", &job); status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+		}
+		if job.FinishedAt != nil {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for build %s", id)
+	return buildJob{}
+}
+
+func TestBuildServer(t *testing.T) {
+	t.Setenv("SOCI_ALLOWED_REGISTRIES", "localhost:5000")
+	server := newBuildServer(10, 10, time.Minute, func(ctx context.Context, request events.Request) (interface{}, error) {
+		if log.Value(ctx, log.JobId) == "" {
+			return nil, errors.New("missing job id")
+		}
+		if request.Build.Reference == "fail" {
+			return "Build failed", errors.New("failed")
+		}
+		return "Built " + request.Build.Reference, nil
+	})
+	httpServer := httptest.NewServer(server.handler())
+	defer httpServer.Close()
+	go server.work(context.Background())
+	defer server.drain()
+
+	var queued struct{ Builds []buildJob }
+	if status := testRequest(t, httpServer, http.MethodPost, "/v1/builds", testServerBuild, &queued); status != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d", http.StatusAccepted, status)
+	}
+	failing := strings.Replace(testServerBuild, `"v1"`, `"fail"`, 1)
+	var queuedFailing struct{ Builds []buildJob }
+	testRequest(t, httpServer, http.MethodPost, "/v1/builds", failing, &queuedFailing)
+	if len(queued.Builds) != 1 || len(queuedFailing.Builds) != 1 || queued.Builds[0].Status != jobQueued || queued.Builds[0].Envelope != events.EnvelopeDirect {
+		t.Fatalf("Expected a queued direct build per request, got %+v and %+v", queued.Builds, queuedFailing.Builds)
+	}
+
+	job := testWaitForJob(t, httpServer, queued.Builds[0].Id)
+	if job.Status != jobSucceeded || job.Result != "Built v1" || job.StartedAt == nil || job.FinishedAt == nil {
+		t.Fatalf("Expected a succeeded build, got %+v", job)
+	}
+	job = testWaitForJob(t, httpServer, queuedFailing.Builds[0].Id)
+	if job.Status != jobFailed || job.Error != "failed" || job.Result != "Build failed" {
+		t.Fatalf("Expected a failed build, got %+v", job)
+	}
+
+	if status := testRequest(t, httpServer, http.MethodGet, "/v1/builds/unknown", "", nil); status != http.StatusNotFound {
+		t.Fatalf("Expected status %d for an unknown build, got %d", http.StatusNotFound, status)
+	}
+}
+
+func TestBuildServerRejectsRequests(t *testing.T) {
+	t.Setenv("SOCI_ALLOWED_REGISTRIES", "localhost:5000")
+	server := newBuildServer(1, 10, 0, func(ctx context.Context, request events.Request) (interface{}, error) {
+		return nil, nil
+	})
+	httpServer := httptest.NewServer(server.handler())
+	defer httpServer.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		status int
+	}{
+		{"invalid payload", http.MethodPost, "{", http.StatusBadRequest},
+		{"unrecognized payload", http.MethodPost, `{"foo": "bar"}`, http.StatusBadRequest},
+		{"SQS batch", http.MethodPost, `{"Records": [{"eventSource": "aws:sqs", "messageId": "1", "body": "{}"}]}`, http.StatusBadRequest},
+		{"method", http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"registry not allowed", http.MethodPost, strings.Replace(testServerBuild, "localhost:5000", "169.254.169.254", 1), http.StatusBadRequest},
+		{"port not allowed", http.MethodPost, strings.Replace(testServerBuild, "localhost:5000", "localhost:22", 1), http.StatusBadRequest},
+		{"ECR registry not allowed", http.MethodPost, `{"detail-type": "ECR Image Action", "source": "aws.ecr", "account": "123456789012", "region": "us-east-1", "detail": {}}`, http.StatusBadRequest},
+		{"notification of a registry not allowed", http.MethodPost, `{"events": [{"action": "push", "target": {"mediaType": "application/vnd.oci.image.manifest.v1+json", ` +
+			`"repository": "repo", "digest": "sha256:0000000000000000000000000000000000000000000000000000000000000000", "url": "http://internal.example.com/v2/repo/manifests/v1"}}]}`, http.StatusBadRequest},
+		{"first build", http.MethodPost, testServerBuild, http.StatusAccepted},
+		{"full queue", http.MethodPost, testServerBuild, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		var response map[string]interface{}
+		if status := testRequest(t, httpServer, test.method, "/v1/builds", test.body, &response); status != test.status {
+			t.Fatalf("%s: expected status %d, got %d: %v", test.name, test.status, status, response)
+		}
+	}
+}
+
+func TestBuildServerDrain(t *testing.T) {
+	t.Setenv("SOCI_ALLOWED_REGISTRIES", "localhost:5000")
+	started, release := make(chan struct{}), make(chan struct{})
+	server := newBuildServer(10, 10, 0, func(ctx context.Context, request events.Request) (interface{}, error) {
+		close(started)
+		<-release
+		return "Built", nil
+	})
+	httpServer := httptest.NewServer(server.handler())
+	defer httpServer.Close()
+
+	var health map[string]interface{}
+	if status := testRequest(t, httpServer, http.MethodGet, "/healthz", "", &health); status != http.StatusOK || health["status"] != "ok" {
+		t.Fatalf("Expected a healthy server, got %d: %v", status, health)
+	}
+
+	var inFlight, queued struct{ Builds []buildJob }
+	testRequest(t, httpServer, http.MethodPost, "/v1/builds", testServerBuild, &inFlight)
+	testRequest(t, httpServer, http.MethodPost, "/v1/builds", testServerBuild, &queued)
+	done := make(chan struct{})
+	go func() {
+		server.work(context.Background())
+		close(done)
+	}()
+	<-started
+
+	server.drain()
+	if status := testRequest(t, httpServer, http.MethodGet, "/healthz", "", &health); status != http.StatusServiceUnavailable || health["status"] != "draining" || health["running"] != 1.0 {
+		t.Fatalf("Expected a draining server with a running build, got %d: %v", status, health)
+	}
+	if status := testRequest(t, httpServer, http.MethodPost, "/v1/builds", testServerBuild, nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected builds to be rejected while draining, got %d", status)
+	}
+	close(release)
+	<-done
+
+	if job := testWaitForJob(t, httpServer, inFlight.Builds[0].Id); job.Status != jobSucceeded {
+		t.Fatalf("Expected the in-flight build to finish, got %+v", job)
+	}
+	if job := testWaitForJob(t, httpServer, queued.Builds[0].Id); job.Status != jobCanceled || job.StartedAt != nil {
+		t.Fatalf("Expected the queued build to be canceled, got %+v", job)
+	}
+}
+
+func TestBuildServerForgetsOldJobs(t *testing.T) {
+	t.Setenv("SOCI_ALLOWED_REGISTRIES", "localhost:5000")
+	release := make(chan struct{})
+	server := newBuildServer(10, 2, 0, func(ctx context.Context, request events.Request) (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	httpServer := httptest.NewServer(server.handler())
+	defer httpServer.Close()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		var queued struct{ Builds []buildJob }
+		testRequest(t, httpServer, http.MethodPost, "/v1/builds", testServerBuild, &queued)
+		ids = append(ids, queued.Builds[0].Id)
+	}
+	// Unfinished jobs are never forgotten
+	for _, id := range ids {
+		if _, ok := server.job(id); !ok {
+			t.Fatalf("Expected the unfinished build %s to be kept", id)
+		}
+	}
+
+	go server.work(context.Background())
+	defer server.drain()
+	close(release)
+	for _, id := range ids {
+		testWaitForJob(t, httpServer, id)
+	}
+	testRequest(t, httpServer, http.MethodPost, "/v1/builds", testServerBuild, nil)
+	if _, ok := server.job(ids[0]); ok {
+		t.Fatalf("Expected the oldest finished build to be forgotten")
+	}
+	if _, ok := server.job(ids[1]); ok {
+		t.Fatalf("Expected the second oldest finished build to be forgotten")
+	}
+	if _, ok := server.job(ids[2]); !ok {
+		t.Fatalf("Expected the newest finished build to be kept")
+	}
+}
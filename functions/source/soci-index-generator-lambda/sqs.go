@@ -0,0 +1,86 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/events"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+)
+
+const (
+	// Maximum number of messages of an SQS batch processed at the same time. Every build takes space in /tmp,
+	// so this is bounded by the ephemeral storage of the function.
+	sqsConcurrencyEnv     = "SOCI_SQS_CONCURRENCY"
+	defaultSQSConcurrency = 2
+)
+
+// Read the SQS batch concurrency from the environment
+func sqsConcurrency() (int, error) {
+	value := os.Getenv(sqsConcurrencyEnv)
+	if value == "" {
+		return defaultSQSConcurrency, nil
+	}
+	concurrency, err := strconv.Atoi(value)
+	if err != nil || concurrency <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number, got %q", sqsConcurrencyEnv, value)
+	}
+	return concurrency, nil
+}
+
+// Handle the requests of a batch of SQS messages, a bounded number at a time. The builds of the batch share
+// their registry clients. Failed messages are reported so that SQS redelivers them, and only them. Messages which
+// can't be decoded or carry invalid requests would fail again, they are logged and dropped instead.
+func handleSQSBatch(ctx context.Context, requests []events.Request) (events.SQSBatchResponse, error) {
+	response := events.SQSBatchResponse{BatchItemFailures: []events.SQSBatchItemFailure{}}
+	concurrency, err := sqsConcurrency()
+	if err != nil {
+		// Failing the whole batch has SQS redeliver every message once the configuration is fixed
+		log.Error(ctx, "SQS configuration error", err)
+		return response, err
+	}
+
+	ctx = registryutils.WithSharedClients(ctx)
+	failed, dropped := make([]bool, len(requests)), make([]bool, len(requests))
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, concurrency)
+	for i, request := range requests {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(i int, request events.Request) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			requestCtx := log.With(ctx, log.SQSMessageId, request.MessageId)
+			// The handlers log their errors, and return none or an invalid request error for events which mustn't be retried
+			_, err := handleDecodedRequest(requestCtx, request)
+			dropped[i] = isInvalidRequest(err)
+			failed[i] = err != nil && !dropped[i]
+		}(i, request)
+	}
+	wg.Wait()
+
+	// A message carrying an SNS notification may hold several requests, it is redelivered if any failed
+	reported := map[string]bool{}
+	invalid := 0
+	for i, request := range requests {
+		if dropped[i] {
+			invalid++
+		}
+		if failed[i] && !reported[request.MessageId] {
+			reported[request.MessageId] = true
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: request.MessageId})
+		}
+	}
+	log.Info(ctx, fmt.Sprintf("Processed a batch of %d SQS requests, %d messages failed, %d invalid requests dropped", len(requests), len(response.BatchItemFailures), invalid),
+		log.Int("Requests", len(requests)), log.Int("FailedMessages", len(response.BatchItemFailures)), log.Int("InvalidRequests", invalid))
+	return response, nil
+}
@@ -0,0 +1,127 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/events"
+	lambdaevents "github.com/aws/aws-lambda-go/events"
+)
+
+func testImageActionBody(t *testing.T, repo string) string {
+	body, err := json.Marshal(events.ECRImageActionEvent{
+		Id:         "id-" + repo,
+		DetailType: events.ECRImageActionDetailType,
+		Source:     "aws.ecr",
+		Account:    "123456789012",
+		Region:     "us-east-1",
+		Detail: events.ECRImageActionEventDetail{
+			ActionType:     "PUSH",
+			Result:         "SUCCESS",
+			RepositoryName: repo,
+			ImageDigest:    "sha256:9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d",
+			ImageTag:       "latest",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error encoding the event: %v", err)
+	}
+	return string(body)
+}
+
+func testSQSBatch(t *testing.T, messages ...lambdaevents.SQSMessage) json.RawMessage {
+	for i := range messages {
+		messages[i].EventSource = "aws:sqs"
+	}
+	batch, err := json.Marshal(lambdaevents.SQSEvent{Records: messages})
+	if err != nil {
+		t.Fatalf("Unexpected error encoding the batch: %v", err)
+	}
+	return batch
+}
+
+func TestHandleSQSBatch(t *testing.T) {
+	// Filtered images are skipped before reaching the registry
+	t.Setenv(repositoryImageTagFiltersEnv, "other:*")
+	t.Setenv(repositoryImageTagExcludeFiltersEnv, "")
+	t.Setenv(sqsConcurrencyEnv, "2")
+	t.Setenv("SOCI_ALLOWED_REGISTRIES", "127.0.0.1:1,*.dkr.ecr.*.amazonaws.com")
+
+	// Invalid messages would fail again when redelivered, only the message whose registry can't be reached is
+	batch := testSQSBatch(t,
+		lambdaevents.SQSMessage{MessageId: "filtered", Body: testImageActionBody(t, "repo")},
+		lambdaevents.SQSMessage{MessageId: "invalid", Body: "{"},
+		lambdaevents.SQSMessage{MessageId: "filtered-too", Body: testImageActionBody(t, "repo2")},
+		lambdaevents.SQSMessage{MessageId: "no-account", Body: `{"detail-type": "ECR Image Action", "source": "aws.ecr", "detail": {}}`},
+		lambdaevents.SQSMessage{MessageId: "unreachable", Body: `{"registry": "127.0.0.1:1", "repository": "repo", "reference": "v1"}`},
+	)
+	result, err := HandleInvocation(context.Background(), batch)
+	if err != nil {
+		t.Fatalf("Unexpected error handling the batch: %v", err)
+	}
+	expected := []events.SQSBatchItemFailure{{ItemIdentifier: "unreachable"}}
+	if response, ok := result.(events.SQSBatchResponse); !ok || !reflect.DeepEqual(response.BatchItemFailures, expected) {
+		t.Fatalf("Expected batch item failures %v, got %v", expected, result)
+	}
+
+	t.Setenv(sqsConcurrencyEnv, "0")
+	if _, err := HandleInvocation(context.Background(), batch); err == nil {
+		t.Fatalf("Expected an error for an invalid concurrency")
+	}
+}
+
+func TestHandleInvocation(t *testing.T) {
+	t.Setenv(repositoryImageTagFiltersEnv, "other:*")
+	t.Setenv(repositoryImageTagExcludeFiltersEnv, "")
+	t.Setenv(sqsConcurrencyEnv, "")
+	t.Setenv("SOCI_ALLOWED_REGISTRIES", "harbor.example.com,localhost:5000,*.dkr.ecr.*.amazonaws.com")
+
+	filtered := "skipped: filtered: matched no include rule"
+	direct := `{"registry": "localhost:5000", "repository": "repo", "reference": "sha256:9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d"}`
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"EventBridge event", testImageActionBody(t, "repo")},
+		{"direct build request", direct},
+		{"CloudEvent", `{"specversion": "1.0", "id": "1", "source": "ci", "type": "build", "data": ` + direct + `}`},
+		{"SNS notification", `{"Records": [{"EventSource": "aws:sns", "Sns": {"MessageId": "1", "Message": ` + strconv.Quote(direct) + `}}]}`},
+	}
+	for _, test := range tests {
+		// Build requests name the image in their result
+		result, err := HandleInvocation(context.Background(), json.RawMessage(test.payload))
+		if err != nil || !strings.Contains(result.(string), filtered) {
+			t.Fatalf("Expected the %s to be handled, got %v, %v", test.name, result, err)
+		}
+	}
+
+	harbor := `{"type": "PUSH_ARTIFACT", "event_data": {"resources": [{"digest": "sha256:9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d9b1d", "tag": "v1", "resource_url": "harbor.example.com/repo:v1"}], "repository": {"repo_full_name": "repo"}}}`
+	if result, err := HandleInvocation(context.Background(), json.RawMessage(harbor)); err != nil || !strings.Contains(result.(string), `"tag":"v1"`) {
+		t.Fatalf("Expected the Harbor webhook to be handled with the pushed tag, got %v, %v", result, err)
+	}
+	// Retrying a notification of a registry which isn't allowed wouldn't help, it is skipped
+	notAllowed := strings.Replace(harbor, "harbor.example.com", "169.254.169.254", 1)
+	if result, err := HandleInvocation(context.Background(), json.RawMessage(notAllowed)); err != nil || !strings.Contains(result.(string), RegistryNotAllowedMessage) {
+		t.Fatalf("Expected the webhook of a registry which isn't allowed to be skipped, got %v, %v", result, err)
+	}
+	if result, err := HandleInvocation(context.Background(), json.RawMessage(`{"events": []}`)); err != nil || result != NoImagePushMessage {
+		t.Fatalf("Expected a notification without push to be skipped, got %v, %v", result, err)
+	}
+
+	if _, err := HandleInvocation(context.Background(), json.RawMessage(`{"image": "repo:tag"}`)); err == nil {
+		t.Fatalf("Expected an error for an unrecognized payload")
+	}
+
+	// EventBridge events name the ECR registry of their account and region, their builds are answered like the webhooks'
+	t.Setenv("SOCI_ALLOWED_REGISTRIES", "localhost:5000")
+	if result, err := HandleInvocation(context.Background(), json.RawMessage(testImageActionBody(t, "repo"))); err != nil || !strings.Contains(result.(string), RegistryNotAllowedMessage) {
+		t.Fatalf("Expected the event of an ECR registry which isn't allowed to be skipped, got %v, %v", result, err)
+	}
+}
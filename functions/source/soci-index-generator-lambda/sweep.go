@@ -0,0 +1,116 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+)
+
+// The SOCI indexes a repository sweep found to be garbage, and the ones it deleted
+type sweepReport struct {
+	RegistryURL string `json:"registryUrl"`
+	Repository  string `json:"repository"`
+	DryRun      bool   `json:"dryRun"`
+	IndexCount  int    `json:"indexCount"`
+	// Indexes whose image no longer exists
+	Orphaned []string `json:"orphaned"`
+	// Older indexes of an image which has a newer index
+	Duplicates []string `json:"duplicates"`
+	Deleted    []string `json:"deleted"`
+}
+
+// Find the orphaned and duplicate SOCI indexes of a repository, and delete them unless it is a dry run
+func sweepRepository(ctx context.Context, registry *registryutils.Registry, registryUrl string, repo string, dryRun bool) (sweepReport, error) {
+	report := sweepReport{RegistryURL: registryUrl, Repository: repo, DryRun: dryRun, Orphaned: []string{}, Duplicates: []string{}, Deleted: []string{}}
+
+	images, err := registry.ListImages(ctx, repo)
+	if err != nil {
+		return report, err
+	}
+	existing := map[string]bool{}
+	for _, image := range images {
+		existing[image.Digest] = true
+	}
+
+	indexes, err := registry.ListSociIndexes(ctx, repo)
+	if err != nil {
+		return report, err
+	}
+	report.IndexCount = len(indexes)
+
+	var garbage []registryutils.SociIndexManifest
+	indexesByImage := map[string][]registryutils.SociIndexManifest{}
+	for _, index := range indexes {
+		imageDigest := index.ImageManifestDigest()
+		if imageDigest == "" {
+			// Without a link to its image there is no telling whether the index is still in use
+			continue
+		}
+		if !existing[imageDigest] {
+			// The image may have been pushed after the listing, so make sure it is really gone
+			exists, err := registry.HasManifest(ctx, repo, imageDigest)
+			if err != nil {
+				return report, err
+			}
+			if !exists {
+				report.Orphaned = append(report.Orphaned, index.Descriptor.Digest.String())
+				garbage = append(garbage, index)
+				continue
+			}
+		}
+		indexesByImage[imageDigest] = append(indexesByImage[imageDigest], index)
+	}
+
+	for _, duplicates := range indexesByImage {
+		for _, index := range olderDuplicates(duplicates) {
+			report.Duplicates = append(report.Duplicates, index.Descriptor.Digest.String())
+			garbage = append(garbage, index)
+		}
+	}
+	sort.Strings(report.Duplicates)
+
+	if dryRun {
+		log.Info(ctx, fmt.Sprintf("Dry run: found %d orphaned and %d duplicate SOCI indexes", len(report.Orphaned), len(report.Duplicates)))
+		return report, nil
+	}
+
+	for _, index := range garbage {
+		indexCtx := log.With(ctx, log.SOCIIndexDigest, index.Descriptor.Digest.String())
+		if err := registry.DeleteManifest(indexCtx, repo, index.Descriptor); err != nil {
+			return report, err
+		}
+		log.Info(indexCtx, "Deleted SOCI index")
+		report.Deleted = append(report.Deleted, index.Descriptor.Digest.String())
+	}
+	return report, nil
+}
+
+// Returns every index but the newest one of the indexes built for the same image.
+// Tagged indexes are always kept, as someone chose to keep them.
+func olderDuplicates(indexes []registryutils.SociIndexManifest) []registryutils.SociIndexManifest {
+	if len(indexes) < 2 {
+		return nil
+	}
+	sorted := make([]registryutils.SociIndexManifest, len(indexes))
+	copy(sorted, indexes)
+	sort.Slice(sorted, func(i, j int) bool {
+		if !sorted[i].PushedAt.Equal(sorted[j].PushedAt) {
+			return sorted[i].PushedAt.After(sorted[j].PushedAt)
+		}
+		return sorted[i].Descriptor.Digest < sorted[j].Descriptor.Digest
+	})
+
+	var older []registryutils.SociIndexManifest
+	for _, index := range sorted[1:] {
+		if len(index.Tags) == 0 {
+			older = append(older, index)
+		}
+	}
+	return older
+}
@@ -0,0 +1,39 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+
+	registryutils "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/registry"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestOlderDuplicates(t *testing.T) {
+	now := time.Now()
+	index := func(name string, pushedAt time.Time, tags ...string) registryutils.SociIndexManifest {
+		return registryutils.SociIndexManifest{
+			Descriptor: ocispec.Descriptor{Digest: digest.Digest("sha256:" + name)},
+			PushedAt:   pushedAt,
+			Tags:       tags,
+		}
+	}
+
+	if older := olderDuplicates([]registryutils.SociIndexManifest{index("a", now)}); len(older) != 0 {
+		t.Fatalf("Expected no duplicates for a single index, got %v", older)
+	}
+
+	older := olderDuplicates([]registryutils.SociIndexManifest{
+		index("old", now.Add(-2*time.Hour)),
+		index("newest", now),
+		index("tagged", now.Add(-time.Hour), "soci-keep"),
+		index("older", now.Add(-time.Hour)),
+	})
+	if len(older) != 2 || older[0].Descriptor.Digest != "sha256:older" || older[1].Descriptor.Digest != "sha256:old" {
+		t.Fatalf("Expected the untagged older indexes to be duplicates, got %v", older)
+	}
+}
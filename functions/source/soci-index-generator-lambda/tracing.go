@@ -0,0 +1,66 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/tracing"
+)
+
+// Set up tracing, returning the function which exports the remaining spans once done. Nothing is traced if the
+// tracing configuration is invalid, rather than failing the builds.
+func initTracing(ctx context.Context) func() {
+	shutdown, err := tracing.Init(ctx)
+	if err != nil {
+		log.Error(ctx, "Tracing configuration error", err)
+		return func() {}
+	}
+	return func() {
+		if err := shutdown(ctx); err != nil {
+			log.Error(ctx, "Tracing shutdown error", err)
+		}
+	}
+}
+
+// Content store tracing the zTOC build of each layer in a span. The SOCI index builder reads a layer from the
+// store for as long as it builds its zTOC, and closes it once done.
+type ztocTracingStore struct {
+	content.Store
+}
+
+func (store ztocTracingStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	if !images.IsLayerType(desc.MediaType) {
+		return store.Store.ReaderAt(ctx, desc)
+	}
+	_, span := tracing.Start(ctx, "build zTOC",
+		attribute.String("oci.digest", desc.Digest.String()),
+		attribute.String("oci.media_type", desc.MediaType),
+		attribute.Int64("oci.size", desc.Size))
+	readerAt, err := store.Store.ReaderAt(ctx, desc)
+	if err != nil {
+		tracing.End(span, err)
+		return nil, err
+	}
+	return &spanReaderAt{ReaderAt: readerAt, span: span}, nil
+}
+
+// Layer reader ending the span of the zTOC build once closed
+type spanReaderAt struct {
+	content.ReaderAt
+	span trace.Span
+}
+
+func (reader *spanReaderAt) Close() error {
+	err := reader.ReaderAt.Close()
+	tracing.End(reader.span, err)
+	return err
+}
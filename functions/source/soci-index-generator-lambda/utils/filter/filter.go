@@ -0,0 +1,158 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package filter selects the images to index with include and exclude rules over "<repository>:<tag>".
+//
+// Rules are shell-style wildcard patterns, matched the way Python's fnmatch matches them: "*" matches any
+// characters, "/" and ":" included. An image is selected when it matches an include rule and no exclude rule.
+// Images pushed by digest only have an empty tag and are matched as "<repository>:", so "*:*" selects them,
+// "app:" selects only the digest-only pushes of app, and the exclude rule "*:" skips them all.
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Include rule selecting every image
+const IncludeAll = "*:*"
+
+type rule struct {
+	pattern string
+	regexp  *regexp.Regexp
+}
+
+// Include and exclude rules over "<repository>:<tag>"
+type Filter struct {
+	includes []rule
+	excludes []rule
+}
+
+// The decision of a filter for an image, with the rule it was made by
+type Decision struct {
+	Included bool
+	// The include rule selecting the image, or the exclude rule skipping it. Empty when the image is skipped
+	// because no include rule matches it.
+	Rule string
+	// Whether Rule is an exclude rule
+	Excluded bool
+}
+
+// Returns a readable reason for the decision
+func (decision Decision) String() string {
+	switch {
+	case decision.Excluded:
+		return fmt.Sprintf("matched exclude rule %q", decision.Rule)
+	case decision.Included:
+		return fmt.Sprintf("matched include rule %q", decision.Rule)
+	default:
+		return "matched no include rule"
+	}
+}
+
+// Create a filter from include and exclude rules. Blank rules are ignored, and no include rule at all
+// includes every image.
+func New(includes []string, excludes []string) (*Filter, error) {
+	filter := &Filter{}
+	var err error
+	if filter.includes, err = parseRules(includes); err != nil {
+		return nil, err
+	}
+	if filter.excludes, err = parseRules(excludes); err != nil {
+		return nil, err
+	}
+	if len(filter.includes) == 0 {
+		filter.includes, _ = parseRules([]string{IncludeAll})
+	}
+	return filter, nil
+}
+
+func parseRules(patterns []string) ([]rule, error) {
+	var rules []rule
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if !strings.Contains(pattern, ":") {
+			return nil, fmt.Errorf("Invalid filter rule %q, expected '<repository>:<tag>'", pattern)
+		}
+		re, err := regexp.Compile(translate(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid filter rule %q: %w", pattern, err)
+		}
+		rules = append(rules, rule{pattern: pattern, regexp: re})
+	}
+	return rules, nil
+}
+
+// Translate a shell-style wildcard pattern to a regexp matching whole strings, the way Python's fnmatch does
+func translate(pattern string) string {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return expr.String()
+}
+
+func firstMatch(rules []rule, value string) (string, bool) {
+	for _, rule := range rules {
+		if rule.regexp.MatchString(value) {
+			return rule.pattern, true
+		}
+	}
+	return "", false
+}
+
+// Decide whether the image pushed to a repository with a tag, empty for a digest-only push, is selected
+func (filter *Filter) Evaluate(repository string, tag string) Decision {
+	value := repository + ":" + tag
+	if pattern, ok := firstMatch(filter.excludes, value); ok {
+		return Decision{Rule: pattern, Excluded: true}
+	}
+	if pattern, ok := firstMatch(filter.includes, value); ok {
+		return Decision{Included: true, Rule: pattern}
+	}
+	return Decision{}
+}
+
+// Decide whether an image with any number of tags is selected, i.e. whether any of its tags is.
+// An untagged image is evaluated as a digest-only push.
+func (filter *Filter) EvaluateTags(repository string, tags []string) Decision {
+	if len(tags) == 0 {
+		return filter.Evaluate(repository, "")
+	}
+	var first Decision
+	for i, tag := range tags {
+		decision := filter.Evaluate(repository, tag)
+		if decision.Included {
+			return decision
+		}
+		if i == 0 || (decision.Excluded && !first.Excluded) {
+			first = decision
+		}
+	}
+	return first
+}
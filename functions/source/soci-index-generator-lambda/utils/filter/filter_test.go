@@ -0,0 +1,71 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package filter
+
+import "testing"
+
+func TestEvaluate(t *testing.T) {
+	filter, err := New([]string{"prod/*:v[0-9]*", "dev:latest", "cache:[!x]?", "digest-only:"}, []string{"prod/legacy:*", "*:*-rc"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating filter: %v", err)
+	}
+
+	tests := []struct {
+		repository string
+		tag        string
+		expected   Decision
+	}{
+		{"prod/app", "v1.2", Decision{Included: true, Rule: "prod/*:v[0-9]*"}},
+		{"prod/app", "v1.2-rc", Decision{Rule: "*:*-rc", Excluded: true}},
+		{"prod/legacy", "v1", Decision{Rule: "prod/legacy:*", Excluded: true}},
+		{"prod/app", "latest", Decision{}},
+		{"prod.app", "v1", Decision{}},
+		{"dev", "latest", Decision{Included: true, Rule: "dev:latest"}},
+		{"cache", "ab", Decision{Included: true, Rule: "cache:[!x]?"}},
+		{"cache", "xb", Decision{}},
+		// Digest-only pushes have an empty tag
+		{"digest-only", "", Decision{Included: true, Rule: "digest-only:"}},
+		{"prod/app", "", Decision{}},
+	}
+	for _, test := range tests {
+		if actual := filter.Evaluate(test.repository, test.tag); actual != test.expected {
+			t.Fatalf("Expected %s:%s to be %+v, got %+v", test.repository, test.tag, test.expected, actual)
+		}
+	}
+}
+
+func TestDefaultIncludesEverything(t *testing.T) {
+	filter, err := New(nil, []string{"*:"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating filter: %v", err)
+	}
+	if decision := filter.Evaluate("any/repo", "tag"); !decision.Included || decision.Rule != IncludeAll {
+		t.Fatalf("Expected every image to be included without include rules, got %+v", decision)
+	}
+	if decision := filter.Evaluate("any/repo", ""); !decision.Excluded || decision.Rule != "*:" {
+		t.Fatalf("Expected digest-only pushes to be excluded, got %+v", decision)
+	}
+	if decision := filter.EvaluateTags("any/repo", nil); !decision.Excluded {
+		t.Fatalf("Expected untagged images to be evaluated as digest-only pushes, got %+v", decision)
+	}
+}
+
+func TestEvaluateTags(t *testing.T) {
+	filter, err := New([]string{"app:v*"}, []string{"app:v*-rc"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating filter: %v", err)
+	}
+	if decision := filter.EvaluateTags("app", []string{"latest", "v2"}); !decision.Included {
+		t.Fatalf("Expected an image with an included tag to be included, got %+v", decision)
+	}
+	if decision := filter.EvaluateTags("app", []string{"latest", "v2-rc"}); !decision.Excluded || decision.Rule != "app:v*-rc" {
+		t.Fatalf("Expected the exclude rule to be reported, got %+v", decision)
+	}
+}
+
+func TestInvalidRule(t *testing.T) {
+	if _, err := New([]string{"no-tag-separator"}, nil); err == nil {
+		t.Fatalf("Expected an error for a rule without a tag")
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Key of a field added to every event logged with a context. Keys are typed so that they don't collide with the
+// values other packages store in the context.
+type Key string
+
+const (
+	EventId                Key = "EventId"
+	SQSMessageId           Key = "SQSMessageId"
+	JobId                  Key = "JobId"
+	RegistryURL            Key = "RegistryURL"
+	UpstreamRegistryURL    Key = "UpstreamRegistryURL"
+	ReplicationRegistryURL Key = "ReplicationRegistryURL"
+	RepositoryName         Key = "RepositoryName"
+	ImageDigest            Key = "ImageDigest"
+	ImageTag               Key = "ImageTag"
+	Platform               Key = "Platform"
+	Phase                  Key = "Phase"
+	SOCIIndexDigest        Key = "SOCIIndexDigest"
+	SOCIIndexEncoding      Key = "SOCIIndexEncoding"
+)
+
+// The context fields, in the order they are logged
+var contextKeys = []Key{
+	EventId,
+	SQSMessageId,
+	JobId,
+	RegistryURL,
+	UpstreamRegistryURL,
+	ReplicationRegistryURL,
+	RepositoryName,
+	ImageDigest,
+	ImageTag,
+	Platform,
+	Phase,
+	SOCIIndexDigest,
+	SOCIIndexEncoding,
+}
+
+// Returns a context in which the events are logged with a field
+func With(ctx context.Context, key Key, value string) context.Context {
+	return context.WithValue(ctx, key, value)
+}
+
+// Returns the value of a field of the context, empty if unset
+func Value(ctx context.Context, key Key) string {
+	value, _ := ctx.Value(key).(string)
+	return value
+}
+
+// Field of a single logged event
+type Field struct {
+	add func(logEvent *zerolog.Event)
+}
+
+func Str(key string, value string) Field {
+	return Field{func(logEvent *zerolog.Event) { logEvent.Str(key, Redact(value)) }}
+}
+
+func Int(key string, value int) Field {
+	return Field{func(logEvent *zerolog.Event) { logEvent.Int(key, value) }}
+}
+
+func Int64(key string, value int64) Field {
+	return Field{func(logEvent *zerolog.Event) { logEvent.Int64(key, value) }}
+}
+
+func Bool(key string, value bool) Field {
+	return Field{func(logEvent *zerolog.Event) { logEvent.Bool(key, value) }}
+}
+
+// Duration field, in milliseconds
+func Duration(key string, value time.Duration) Field {
+	return Field{func(logEvent *zerolog.Event) { logEvent.Int64(key, value.Milliseconds()) }}
+}
+
+// Field of any value, logged as JSON
+func Any(key string, value interface{}) Field {
+	return Field{func(logEvent *zerolog.Event) {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			logEvent.Str(key, Redact(fmt.Sprint(value)))
+			return
+		}
+		logEvent.RawJSON(key, []byte(Redact(string(encoded))))
+	}}
+}
@@ -6,45 +6,110 @@ package log
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 )
 
-func Error(ctx context.Context, msg string, err error) {
-	logEvent := log.Error().Err(err)
-	addContext(ctx, logEvent)
-	logEvent.Msg(msg)
+const (
+	// Minimum level of the logged events: "debug", "info", "warn" or "error"
+	levelEnv = "SOCI_LOG_LEVEL"
+	// Format of the logged events, "json" or "console". Defaults to JSON in Lambda and to the console on the command line.
+	formatEnv = "SOCI_LOG_FORMAT"
+
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+var (
+	output io.Writer = os.Stderr
+	logger           = newLogger(FormatJSON, zerolog.InfoLevel)
+)
+
+func newLogger(format string, level zerolog.Level) zerolog.Logger {
+	writer := output
+	if format == FormatConsole {
+		writer = zerolog.ConsoleWriter{Out: output, TimeFormat: time.RFC3339, NoColor: !isTerminal(output)}
+	}
+	return zerolog.New(writer).Level(level).With().Timestamp().Logger()
 }
 
-func Warn(ctx context.Context, msg string) {
-	logEvent := log.Warn()
-	addContext(ctx, logEvent)
-	logEvent.Msg(msg)
+// Colors are only written to terminals, not to redirected output
+func isTerminal(writer io.Writer) bool {
+	file, ok := writer.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
 
-func Info(ctx context.Context, msg string) {
-	logEvent := log.Info()
+// Configure the level and format of the logged events from the environment, with the format used unless one is
+// set. The configuration is left unchanged if invalid.
+func Configure(defaultFormat string) error {
+	level := zerolog.InfoLevel
+	if value := os.Getenv(levelEnv); value != "" {
+		parsed, err := zerolog.ParseLevel(value)
+		if err != nil || parsed < zerolog.DebugLevel || parsed > zerolog.ErrorLevel {
+			return fmt.Errorf("Invalid %s %q, expected debug, info, warn or error", levelEnv, value)
+		}
+		level = parsed
+	}
+
+	format := defaultFormat
+	if value := os.Getenv(formatEnv); value != "" {
+		format = value
+	}
+	if format != FormatJSON && format != FormatConsole {
+		return fmt.Errorf("Invalid %s %q, expected %s or %s", formatEnv, format, FormatJSON, FormatConsole)
+	}
+	logger = newLogger(format, level)
+	return nil
+}
+
+func Debug(ctx context.Context, msg string, fields ...Field) {
+	write(ctx, logger.Debug(), msg, fields)
+}
+
+func Info(ctx context.Context, msg string, fields ...Field) {
+	write(ctx, logger.Info(), msg, fields)
+}
+
+func Warn(ctx context.Context, msg string, fields ...Field) {
+	write(ctx, logger.Warn(), msg, fields)
+}
+
+func Error(ctx context.Context, msg string, err error, fields ...Field) {
+	write(ctx, logger.Error().Err(RedactError(err)), msg, fields)
+}
+
+// Write an event, with its message and fields redacted
+func write(ctx context.Context, logEvent *zerolog.Event, msg string, fields []Field) {
+	// The event is nil below the configured level
+	if logEvent == nil {
+		return
+	}
 	addContext(ctx, logEvent)
-	logEvent.Msg(msg)
+	for _, field := range fields {
+		field.add(logEvent)
+	}
+	logEvent.Msg(Redact(msg))
 }
 
 // Add more context to the log event
 func addContext(ctx context.Context, logEvent *zerolog.Event) {
-	contextKeys := []string{
-		"RegistryURL",
-		"RepositoryName",
-		"ImageDigest",
-		"ImageTag",
-		"SOCIIndexDigest"}
-
-	for _, contextKey := range contextKeys {
-		if value := ctx.Value(contextKey); value != nil {
-			logEvent.Str(contextKey, value.(string))
+	for _, key := range contextKeys {
+		if value := Value(ctx, key); value != "" {
+			logEvent.Str(string(key), Redact(value))
 		}
 	}
 
-	lambdaCtx, _ := lambdacontext.FromContext(ctx)
-	logEvent.Str("RequestId", lambdaCtx.AwsRequestID)
+	// There is no Lambda context when running from the command line
+	if lambdaCtx, ok := lambdacontext.FromContext(ctx); ok {
+		logEvent.Str("RequestId", lambdaCtx.AwsRequestID)
+	}
 }
@@ -0,0 +1,94 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Capture the logged events in a buffer, configured with the environment and the default format
+func testOutput(t *testing.T, defaultFormat string) *bytes.Buffer {
+	previousOutput, previousLogger := output, logger
+	t.Cleanup(func() { output, logger = previousOutput, previousLogger })
+
+	buffer := &bytes.Buffer{}
+	output = buffer
+	if err := Configure(defaultFormat); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return buffer
+}
+
+func TestConfigure(t *testing.T) {
+	for _, env := range []map[string]string{
+		{levelEnv: "verbose"},
+		{levelEnv: "trace"},
+		{formatEnv: "text"},
+	} {
+		t.Run(strings.Join([]string{env[levelEnv], env[formatEnv]}, ""), func(t *testing.T) {
+			for key, value := range env {
+				t.Setenv(key, value)
+			}
+			if err := Configure(FormatJSON); err == nil {
+				t.Fatalf("Expected an error with the configuration %v", env)
+			}
+		})
+	}
+}
+
+func TestFields(t *testing.T) {
+	buffer := testOutput(t, FormatJSON)
+	ctx := With(context.Background(), RepositoryName, "repo")
+	ctx = With(ctx, Phase, "pull")
+	// A bare string key is another key, the field isn't logged
+	ctx = context.WithValue(ctx, "ImageDigest", "sha256:1")
+
+	Debug(ctx, "Hidden below the default level")
+	Error(ctx, "Pull error", errors.New("timeout"), Int("Attempt", 2), Duration("Elapsed", 1500*time.Millisecond), Str("Layer", "sha256:2"))
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 logged event, got:\n%s", buffer)
+	}
+	event := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatalf("Expected a JSON event, got %q: %v", lines[0], err)
+	}
+	expected := map[string]interface{}{
+		"level":          "error",
+		"message":        "Pull error",
+		"error":          "timeout",
+		"RepositoryName": "repo",
+		"Phase":          "pull",
+		"Attempt":        float64(2),
+		"Elapsed":        float64(1500),
+		"Layer":          "sha256:2",
+	}
+	for key, value := range expected {
+		if event[key] != value {
+			t.Fatalf("Expected %s to be %v, got %v in %v", key, value, event[key], event)
+		}
+	}
+	if _, ok := event["ImageDigest"]; ok {
+		t.Fatalf("Expected no image digest, got %v", event)
+	}
+}
+
+func TestLevelAndFormat(t *testing.T) {
+	t.Setenv(levelEnv, "debug")
+	t.Setenv(formatEnv, "")
+	buffer := testOutput(t, FormatConsole)
+
+	Debug(With(context.Background(), JobId, "job-1"), "Checked the free space", Int64("FreeBytes", 42))
+	line := buffer.String()
+	if strings.HasPrefix(line, "{") || !strings.Contains(line, "Checked the free space") || !strings.Contains(line, "FreeBytes=42") || !strings.Contains(line, "JobId=job-1") {
+		t.Fatalf("Expected a debug event in the console format, got %q", line)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/tracing"
+)
+
+type buildKey struct{}
+
+// The measurements of a build, reported once it finishes. The build and each of its phases are traced in a span.
+type Build struct {
+	Repository string
+	Digest     string
+
+	start time.Time
+	span  trace.Span
+	// The current phase, timed until the next one starts or the build finishes
+	phase      string
+	phaseStart time.Time
+	phaseSpan  trace.Span
+
+	// Layers are pulled and pushed concurrently
+	mutex              sync.Mutex
+	phases             map[string]time.Duration
+	pulledBytes        int64
+	pushedBytes        int64
+	imageSize          int64
+	ztocs              int
+	skippedLayers      map[string]int
+	pushToIndexLatency time.Duration
+}
+
+// Start measuring the build of an image, returning a context in which the measurements are added to the build
+func StartBuild(ctx context.Context, repository string, digest string) (context.Context, *Build) {
+	build := &Build{
+		Repository:    repository,
+		Digest:        digest,
+		start:         time.Now(),
+		phases:        map[string]time.Duration{},
+		skippedLayers: map[string]int{},
+	}
+	ctx, build.span = tracing.Start(ctx, "build", attribute.String("soci.repository", repository), attribute.String("soci.image.digest", digest))
+	return context.WithValue(ctx, buildKey{}, build), build
+}
+
+func fromContext(ctx context.Context) *Build {
+	build, _ := ctx.Value(buildKey{}).(*Build)
+	return build
+}
+
+// Update the measurements of the build, if any
+func (build *Build) update(update func(build *Build)) {
+	if build == nil {
+		return
+	}
+	build.mutex.Lock()
+	defer build.mutex.Unlock()
+	update(build)
+}
+
+// End the current phase, if any, and start timing the next one. The returned context holds the span of the phase
+// in place of the span of the previous one, logs the events with the phase, and keeps the other values of ctx.
+func (build *Build) StartPhase(ctx context.Context, phase string) context.Context {
+	build.EndPhase(nil)
+	build.phase, build.phaseStart = phase, time.Now()
+	ctx, build.phaseSpan = tracing.Start(trace.ContextWithSpan(ctx, build.span), phase)
+	return log.With(ctx, log.Phase, phase)
+}
+
+// End the current phase, if any, recording the error it failed with
+func (build *Build) EndPhase(err error) {
+	if build.phase == "" {
+		return
+	}
+	duration := time.Since(build.phaseStart)
+	phaseDuration.WithLabelValues(build.phase).Observe(duration.Seconds())
+	build.update(func(build *Build) { build.phases[build.phase] += duration })
+	tracing.End(build.phaseSpan, err)
+	build.phase = ""
+}
+
+// Count the build with its outcome, and report its measurements in the Embedded Metric Format when running in Lambda
+func (build *Build) Finish(ctx context.Context, outcome string, err error) {
+	build.EndPhase(err)
+	builds.WithLabelValues(build.Repository, outcome).Inc()
+	build.span.SetAttributes(attribute.String("soci.outcome", outcome))
+	tracing.End(build.span, err)
+	writeEMF(ctx, build, outcome)
+}
@@ -0,0 +1,170 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+const (
+	// Whether builds report their measurements in the Embedded Metric Format, by default only when running in Lambda
+	emfEnabledEnv = "SOCI_EMF_ENABLED"
+	// CloudWatch namespace of the metrics
+	emfNamespaceEnv = "SOCI_EMF_NAMESPACE"
+	// Sets of dimensions separated by semicolons, each a comma separated list of "repository" and "outcome", or
+	// "none" for metrics without dimensions, e.g. "outcome;repository,outcome"
+	emfDimensionsEnv = "SOCI_EMF_DIMENSIONS"
+
+	defaultEMFNamespace  = "SOCIIndexBuilder"
+	defaultEMFDimensions = "repository,outcome"
+)
+
+// Names of the dimensions in the EMF records
+var emfDimensions = map[string]string{
+	"repository": "Repository",
+	"outcome":    "Outcome",
+}
+
+var (
+	// Lambda sends the function's standard output to CloudWatch Logs, which extracts the metrics from the records
+	emfOutput io.Writer = os.Stdout
+	// Builds of an SQS batch finish concurrently, each record must be written at once
+	emfMutex sync.Mutex
+)
+
+type emfConfig struct {
+	Enabled    bool
+	Namespace  string
+	Dimensions [][]string
+}
+
+func loadEMFConfig(ctx context.Context) (emfConfig, error) {
+	_, inLambda := lambdacontext.FromContext(ctx)
+	config := emfConfig{Enabled: inLambda, Namespace: defaultEMFNamespace}
+	if value := os.Getenv(emfEnabledEnv); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return config, fmt.Errorf("Invalid %s %q: %w", emfEnabledEnv, value, err)
+		}
+		config.Enabled = enabled
+	}
+	if value := os.Getenv(emfNamespaceEnv); value != "" {
+		config.Namespace = value
+	}
+
+	value := os.Getenv(emfDimensionsEnv)
+	if value == "" {
+		value = defaultEMFDimensions
+	}
+	for _, set := range strings.Split(value, ";") {
+		dimensions := []string{}
+		if strings.TrimSpace(set) != "none" {
+			for _, name := range strings.Split(set, ",") {
+				dimension, ok := emfDimensions[strings.TrimSpace(name)]
+				if !ok {
+					return config, fmt.Errorf("Invalid %s %q: unknown dimension %q, expected repository, outcome or none", emfDimensionsEnv, value, name)
+				}
+				dimensions = append(dimensions, dimension)
+			}
+		}
+		config.Dimensions = append(config.Dimensions, dimensions)
+	}
+	return config, nil
+}
+
+// Write the measurements of a finished build as an EMF record, if enabled
+func writeEMF(ctx context.Context, build *Build, outcome string) {
+	config, err := loadEMFConfig(ctx)
+	if err != nil {
+		log.Error(ctx, "Embedded metric format configuration error", err)
+		return
+	}
+	if !config.Enabled {
+		return
+	}
+
+	record, err := json.Marshal(emfRecord(build, outcome, config, time.Now()))
+	if err != nil {
+		log.Error(ctx, "Embedded metric format encoding error", err)
+		return
+	}
+	emfMutex.Lock()
+	defer emfMutex.Unlock()
+	if _, err := emfOutput.Write(append(record, '\n')); err != nil {
+		log.Error(ctx, "Embedded metric format write error", err)
+	}
+}
+
+// Returns the EMF record of a finished build. Only the measurements the build got to are reported, e.g. a skipped
+// build has no zTOCs rather than zero zTOCs.
+func emfRecord(build *Build, outcome string, config emfConfig, now time.Time) map[string]interface{} {
+	build.mutex.Lock()
+	defer build.mutex.Unlock()
+
+	record := map[string]interface{}{
+		"Repository":  build.Repository,
+		"Outcome":     outcome,
+		"ImageDigest": build.Digest,
+	}
+	var definitions []map[string]string
+	add := func(name string, unit string, value interface{}) {
+		record[name] = value
+		definitions = append(definitions, map[string]string{"Name": name, "Unit": unit})
+	}
+
+	add("Builds", "Count", 1)
+	add("Duration", "Milliseconds", now.Sub(build.start).Milliseconds())
+	phases := make([]string, 0, len(build.phases))
+	for phase := range build.phases {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	for _, phase := range phases {
+		add(strings.ToUpper(phase[:1])+phase[1:]+"Duration", "Milliseconds", build.phases[phase].Milliseconds())
+	}
+	if build.pulledBytes > 0 {
+		add("PulledBytes", "Bytes", build.pulledBytes)
+	}
+	if build.pushedBytes > 0 {
+		add("PushedBytes", "Bytes", build.pushedBytes)
+	}
+	if build.imageSize > 0 {
+		add("ImageSize", "Bytes", build.imageSize)
+	}
+	if build.ztocs > 0 || len(build.skippedLayers) > 0 {
+		add("Ztocs", "Count", build.ztocs)
+		skipped := 0
+		for _, count := range build.skippedLayers {
+			skipped += count
+		}
+		add("SkippedLayers", "Count", skipped)
+		record["SkippedLayersByReason"] = build.skippedLayers
+	}
+	if build.pushToIndexLatency > 0 {
+		add("PushToIndexLatency", "Milliseconds", build.pushToIndexLatency.Milliseconds())
+	}
+
+	record["_aws"] = map[string]interface{}{
+		"Timestamp": now.UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  config.Namespace,
+			"Dimensions": config.Dimensions,
+			"Metrics":    definitions,
+		}},
+	}
+	return record
+}
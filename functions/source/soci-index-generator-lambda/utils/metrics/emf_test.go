@@ -0,0 +1,125 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+func TestLoadEMFConfig(t *testing.T) {
+	lambdaCtx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "abcd-1234"})
+	tests := []struct {
+		ctx        context.Context
+		enabled    string
+		dimensions string
+		expected   emfConfig
+		err        string
+	}{
+		{lambdaCtx, "", "", emfConfig{Enabled: true, Namespace: defaultEMFNamespace, Dimensions: [][]string{{"Repository", "Outcome"}}}, ""},
+		{context.Background(), "", "", emfConfig{Enabled: false, Namespace: defaultEMFNamespace, Dimensions: [][]string{{"Repository", "Outcome"}}}, ""},
+		{context.Background(), "true", "outcome; repository, outcome;none", emfConfig{Enabled: true, Namespace: defaultEMFNamespace, Dimensions: [][]string{{"Outcome"}, {"Repository", "Outcome"}, {}}}, ""},
+		{lambdaCtx, "false", "", emfConfig{Enabled: false, Namespace: defaultEMFNamespace, Dimensions: [][]string{{"Repository", "Outcome"}}}, ""},
+		{lambdaCtx, "maybe", "", emfConfig{}, "Invalid SOCI_EMF_ENABLED"},
+		{lambdaCtx, "", "repository,digest", emfConfig{}, `unknown dimension "digest"`},
+	}
+	for _, test := range tests {
+		t.Setenv(emfEnabledEnv, test.enabled)
+		t.Setenv(emfDimensionsEnv, test.dimensions)
+		config, err := loadEMFConfig(test.ctx)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected an error containing %q, got %v", test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(config, test.expected) {
+			t.Fatalf("Expected %+v, got %+v", test.expected, config)
+		}
+	}
+}
+
+func TestWriteEMF(t *testing.T) {
+	t.Setenv(emfEnabledEnv, "")
+	t.Setenv(emfNamespaceEnv, "Test")
+	t.Setenv(emfDimensionsEnv, "outcome")
+	var output bytes.Buffer
+	stdout := emfOutput
+	emfOutput = &output
+	defer func() { emfOutput = stdout }()
+
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "abcd-1234"})
+	ctx, build := StartBuild(ctx, "repo", "sha256:1")
+	build.StartPhase(ctx, PhasePull)
+	SetImageSize(ctx, 3<<20)
+	AddZtocs(ctx, 1)
+	AddSkippedLayers(ctx, LayerSkippedMinLayerSize, 2)
+	ObservePushToIndexLatency(ctx, 90*time.Second)
+	build.Finish(ctx, OutcomeBuilt, nil)
+
+	var record struct {
+		AWS struct {
+			CloudWatchMetrics []struct {
+				Namespace  string
+				Dimensions [][]string
+				Metrics    []struct{ Name, Unit string }
+			}
+		} `json:"_aws"`
+		Outcome            string
+		Repository         string
+		Builds             int
+		PullDuration       *int64
+		ImageSize          int64
+		Ztocs              int
+		SkippedLayers      int
+		PushToIndexLatency int64
+		PushedBytes        *int64
+	}
+	if err := json.Unmarshal(output.Bytes(), &record); err != nil {
+		t.Fatalf("Unexpected error decoding the record %q: %v", output.String(), err)
+	}
+	if strings.Count(output.String(), "\n") != 1 {
+		t.Fatalf("Expected a single record line, got %q", output.String())
+	}
+	directive := record.AWS.CloudWatchMetrics[0]
+	if directive.Namespace != "Test" || !reflect.DeepEqual(directive.Dimensions, [][]string{{"Outcome"}}) {
+		t.Fatalf("Expected the configured namespace and dimensions, got %+v", directive)
+	}
+	if record.Outcome != OutcomeBuilt || record.Repository != "repo" || record.Builds != 1 || record.PullDuration == nil ||
+		record.ImageSize != 3<<20 || record.Ztocs != 1 || record.SkippedLayers != 2 || record.PushToIndexLatency != 90000 {
+		t.Fatalf("Unexpected record %s", output.String())
+	}
+	// Every metric is defined, and only the measured ones
+	if record.PushedBytes != nil {
+		t.Fatalf("Expected no pushed bytes, got %d", *record.PushedBytes)
+	}
+	var raw map[string]interface{}
+	json.Unmarshal(output.Bytes(), &raw)
+	for _, metric := range directive.Metrics {
+		if _, ok := raw[metric.Name]; !ok {
+			t.Fatalf("Expected the record to hold the value of metric %s", metric.Name)
+		}
+	}
+	if len(directive.Metrics) != 7 {
+		t.Fatalf("Expected 7 metrics, got %+v", directive.Metrics)
+	}
+
+	// Builds outside Lambda report no record by default
+	output.Reset()
+	ctx, build = StartBuild(context.Background(), "repo", "sha256:1")
+	build.Finish(ctx, OutcomeSkipped, nil)
+	if output.Len() != 0 {
+		t.Fatalf("Expected no record outside Lambda, got %q", output.String())
+	}
+}
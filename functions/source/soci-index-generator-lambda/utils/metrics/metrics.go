@@ -0,0 +1,162 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package metrics instruments the builds, exposes the measurements in the Prometheus format and reports the
+// measurements of each build in the CloudWatch Embedded Metric Format.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outcomes of a build
+const (
+	OutcomeBuilt   = "built"
+	OutcomeSkipped = "skipped"
+	OutcomeFailed  = "failed"
+)
+
+// Phases of a build
+const (
+	PhaseValidate  = "validate"
+	PhasePull      = "pull"
+	PhaseBuild     = "build"
+	PhasePush      = "push"
+	PhaseReplicate = "replicate"
+)
+
+// Reasons a layer has no zTOC
+const (
+	LayerSkippedMinLayerSize      = "min-layer-size"
+	LayerSkippedUnsupportedFormat = "unsupported-format"
+)
+
+const namespace = "soci_index_builder"
+
+var (
+	registry = prometheus.NewRegistry()
+
+	builds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "builds_total",
+		Help:      "Builds by repository and outcome.",
+	}, []string{"repository", "outcome"})
+	phaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "phase_duration_seconds",
+		Help:      "Duration of the phases of the builds.",
+		// From a manifest check to the pull of a multi-gigabyte image
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 16),
+	}, []string{"phase"})
+	pulledBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pulled_bytes_total",
+		Help:      "Bytes of the manifests, configs and layers pulled from the registries.",
+	})
+	pushedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pushed_bytes_total",
+		Help:      "Bytes of the SOCI indexes and zTOCs pushed to the registries.",
+	})
+	ztocs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ztocs_created_total",
+		Help:      "zTOCs created.",
+	})
+	skippedLayers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "layers_skipped_total",
+		Help:      "Layers no zTOC was created for, by reason.",
+	}, []string{"reason"})
+	pushToIndexLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "push_to_index_latency_seconds",
+		Help:      "Time from the push of an image to the push of its SOCI index.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+	registryResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "registry_responses_total",
+		Help:      "Responses of the registries, by request method and status code.",
+	}, []string{"method", "code"})
+	queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Builds queued by the server.",
+	})
+)
+
+func init() {
+	registry.MustRegister(builds, phaseDuration, pulledBytes, pushedBytes, ztocs, skippedLayers, pushToIndexLatency, registryResponses, queueDepth)
+	registry.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+}
+
+// Returns the handler serving the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// The measurements below are also added to the build in ctx, if any
+
+func AddPulledBytes(ctx context.Context, size int64) {
+	pulledBytes.Add(float64(size))
+	fromContext(ctx).update(func(build *Build) { build.pulledBytes += size })
+}
+
+func AddPushedBytes(ctx context.Context, size int64) {
+	pushedBytes.Add(float64(size))
+	fromContext(ctx).update(func(build *Build) { build.pushedBytes += size })
+}
+
+func AddZtocs(ctx context.Context, count int) {
+	ztocs.Add(float64(count))
+	fromContext(ctx).update(func(build *Build) { build.ztocs += count })
+}
+
+func AddSkippedLayers(ctx context.Context, reason string, count int) {
+	skippedLayers.WithLabelValues(reason).Add(float64(count))
+	fromContext(ctx).update(func(build *Build) { build.skippedLayers[reason] += count })
+}
+
+// Record the size of the image a build indexes, the size of its layers
+func SetImageSize(ctx context.Context, size int64) {
+	fromContext(ctx).update(func(build *Build) { build.imageSize = size })
+}
+
+// Record the time from the push of the image a build indexes to the push of its SOCI index
+func ObservePushToIndexLatency(ctx context.Context, latency time.Duration) {
+	pushToIndexLatency.Observe(latency.Seconds())
+	fromContext(ctx).update(func(build *Build) { build.pushToIndexLatency = latency })
+}
+
+func SetQueueDepth(depth int) {
+	queueDepth.Set(float64(depth))
+}
+
+// Returns a transport counting the responses of the registries by status code
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		response, err := base.RoundTrip(request)
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(response.StatusCode)
+		}
+		registryResponses.WithLabelValues(request.Method, code).Inc()
+		return response, err
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
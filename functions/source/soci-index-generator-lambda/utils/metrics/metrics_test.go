@@ -0,0 +1,92 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTransport(t *testing.T) {
+	registryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/missing/manifests/latest" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer registryServer.Close()
+
+	client := &http.Client{Transport: Transport(nil)}
+	before := testutil.ToFloat64(registryResponses.WithLabelValues(http.MethodGet, "404"))
+	for _, path := range []string{"/v2/", "/v2/missing/manifests/latest"} {
+		response, err := client.Get(registryServer.URL + path)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		response.Body.Close()
+	}
+	if _, err := client.Get("http://127.0.0.1:0/v2/"); err == nil {
+		t.Fatalf("Expected an error connecting to an invalid address")
+	}
+
+	if count := testutil.ToFloat64(registryResponses.WithLabelValues(http.MethodGet, "404")) - before; count != 1 {
+		t.Fatalf("Expected 1 response with status code 404, got %v", count)
+	}
+	if count := testutil.ToFloat64(registryResponses.WithLabelValues(http.MethodGet, "error")); count < 1 {
+		t.Fatalf("Expected the failed request to be counted, got %v", count)
+	}
+}
+
+func TestBuildPhases(t *testing.T) {
+	ctx, build := StartBuild(context.Background(), "repo", "sha256:1")
+	build.StartPhase(ctx, PhasePull)
+	build.StartPhase(ctx, PhaseBuild)
+	AddPulledBytes(ctx, 10)
+	AddPulledBytes(context.Background(), 5)
+	build.StartPhase(ctx, PhaseBuild)
+	build.EndPhase(nil)
+	build.EndPhase(nil)
+
+	if len(build.phases) != 2 || build.pulledBytes != 10 {
+		t.Fatalf("Expected 2 timed phases and the bytes pulled in the build's context, got %v and %d bytes", build.phases, build.pulledBytes)
+	}
+	if count := testutil.CollectAndCount(phaseDuration); count != 2 {
+		t.Fatalf("Expected the 2 phases to be timed, got %d", count)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	built := builds.WithLabelValues("handler", OutcomeBuilt)
+	unsupported := skippedLayers.WithLabelValues(LayerSkippedUnsupportedFormat)
+	before, skippedBefore := testutil.ToFloat64(built), testutil.ToFloat64(unsupported)
+	ctx, build := StartBuild(context.Background(), "handler", "sha256:1")
+	AddSkippedLayers(ctx, LayerSkippedUnsupportedFormat, 2)
+	build.Finish(ctx, OutcomeBuilt, nil)
+	SetQueueDepth(3)
+
+	if count := testutil.ToFloat64(built) - before; count != 1 {
+		t.Fatalf("Expected 1 build, got %v", count)
+	}
+	if count := testutil.ToFloat64(unsupported) - skippedBefore; count != 2 {
+		t.Fatalf("Expected 2 skipped layers, got %v", count)
+	}
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+	for _, expected := range []string{
+		`soci_index_builder_builds_total{outcome="built",repository="handler"}`,
+		`soci_index_builder_layers_skipped_total{reason="unsupported-format"}`,
+		`soci_index_builder_queue_depth 3`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("Expected the metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+}
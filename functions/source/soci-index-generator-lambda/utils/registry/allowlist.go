@@ -0,0 +1,90 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Comma-separated list of the registries images may be built for when the registry is named by a request rather
+// than the function's configuration, e.g. by a build request sent to the build API or a registry webhook. Hosts
+// may be patterns such as "*.dkr.ecr.us-east-1.amazonaws.com", and "*" allows any registry.
+const allowedRegistriesEnv = "SOCI_ALLOWED_REGISTRIES"
+
+// ECR registries, whose access is granted by the AWS role of the builder rather than by a registry host
+var ecrRegistryPatterns = []string{"*.dkr.ecr.*.amazonaws.com", "*.dkr.ecr.*.amazonaws.com.cn"}
+
+// Registries images may be built for, by host
+type Allowlist struct {
+	patterns []string
+}
+
+// Load the allowlist from SOCI_ALLOWED_REGISTRIES. When it is unset, ECR registries and the registries configured
+// with credentials or to be reached over plain HTTP are allowed.
+func LoadAllowlist() (Allowlist, error) {
+	value, set := os.LookupEnv(allowedRegistriesEnv)
+	if !set {
+		return configuredRegistries()
+	}
+	var allowlist Allowlist
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return Allowlist{}, fmt.Errorf("Invalid registry pattern %q in %s: %w", pattern, allowedRegistriesEnv, err)
+		}
+		allowlist.patterns = append(allowlist.patterns, pattern)
+	}
+	return allowlist, nil
+}
+
+// Returns the allowlist of ECR registries and the registries configured with credentials or to be reached over
+// plain HTTP
+func configuredRegistries() (Allowlist, error) {
+	credentials, err := loadCredentials()
+	if err != nil {
+		return Allowlist{}, err
+	}
+	allowlist := Allowlist{patterns: append([]string{}, ecrRegistryPatterns...)}
+	for host := range credentials {
+		allowlist.patterns = append(allowlist.patterns, strings.ToLower(host))
+	}
+	for _, registry := range strings.Split(os.Getenv(plainHTTPRegistriesEnv), ",") {
+		if registry = strings.ToLower(strings.TrimSpace(registry)); registry != "" {
+			allowlist.patterns = append(allowlist.patterns, registry)
+		}
+	}
+	sort.Strings(allowlist.patterns)
+	return allowlist, nil
+}
+
+// Check if images may be built for a registry, named by its host and optional port
+func (allowlist Allowlist) Allows(registry string) bool {
+	registry = strings.ToLower(registry)
+	if registry == "" || strings.ContainsAny(registry, "/?#@") {
+		return false
+	}
+	for _, pattern := range allowlist.patterns {
+		// Patterns match a host without its port unless they have one
+		host := registry
+		if !strings.Contains(pattern, ":") {
+			host, _, _ = strings.Cut(registry, ":")
+		}
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the allowlist allows no registry
+func (allowlist Allowlist) IsEmpty() bool {
+	return len(allowlist.patterns) == 0
+}
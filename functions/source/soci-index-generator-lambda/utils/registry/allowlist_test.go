@@ -0,0 +1,75 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAllowlist(t *testing.T) {
+	t.Setenv(allowedRegistriesEnv, " registry.example.com, *.dkr.ecr.us-east-1.amazonaws.com ,localhost:5000,")
+	allowlist, err := LoadAllowlist()
+	if err != nil {
+		t.Fatalf("Unexpected error loading the allowlist: %v", err)
+	}
+	for registry, allowed := range map[string]bool{
+		"registry.example.com":                         true,
+		"Registry.Example.com:8443":                    true,
+		"123456789012.dkr.ecr.us-east-1.amazonaws.com": true,
+		"123456789012.dkr.ecr.us-west-2.amazonaws.com": false,
+		"localhost:5000":                               true,
+		"localhost:5001":                               false,
+		"localhost":                                    false,
+		"169.254.169.254":                              false,
+		"registry.example.com.attacker.example":        false,
+		"registry.example.com/path":                    false,
+		"user@registry.example.com":                    false,
+		"":                                             false,
+	} {
+		if allowlist.Allows(registry) != allowed {
+			t.Fatalf("Expected %q to be allowed: %v", registry, allowed)
+		}
+	}
+
+	t.Setenv(allowedRegistriesEnv, "*")
+	if allowlist, err := LoadAllowlist(); err != nil || !allowlist.Allows("any.example.com:5000") {
+		t.Fatalf("Expected any registry to be allowed, got %v", err)
+	}
+	t.Setenv(allowedRegistriesEnv, "")
+	if allowlist, err := LoadAllowlist(); err != nil || !allowlist.IsEmpty() || allowlist.Allows("registry.example.com") {
+		t.Fatalf("Expected no registry to be allowed, got %v", err)
+	}
+	t.Setenv(allowedRegistriesEnv, "[registry")
+	if _, err := LoadAllowlist(); err == nil {
+		t.Fatalf("Expected an error with an invalid pattern")
+	}
+}
+
+func TestAllowlistOfConfiguredRegistries(t *testing.T) {
+	// Restored once the test is done
+	t.Setenv(allowedRegistriesEnv, "")
+	os.Unsetenv(allowedRegistriesEnv)
+	t.Setenv(registryAuthFileEnv, "")
+	t.Setenv(registryAuthEnv, `{"auths": {"https://harbor.example.com/v2/": {"auth": "cm9ib3Q6c2VjcmV0"}}}`)
+	t.Setenv(plainHTTPRegistriesEnv, "localhost:5000, registry.internal:5000")
+	allowlist, err := LoadAllowlist()
+	if err != nil {
+		t.Fatalf("Unexpected error loading the allowlist: %v", err)
+	}
+	for registry, allowed := range map[string]bool{
+		"harbor.example.com":                                       true,
+		"localhost:5000":                                           true,
+		"registry.internal:5000":                                   true,
+		"registry.example.com":                                     false,
+		"localhost:6000":                                           false,
+		"123456789012.dkr.ecr.us-east-1.amazonaws.com":             true,
+		"123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn":         true,
+		"123456789012.dkr.ecr.us-east-1.amazonaws.com.example.com": false,
+	} {
+		if allowlist.Allows(registry) != allowed {
+			t.Fatalf("Expected %q to be allowed: %v", registry, allowed)
+		}
+	}
+}
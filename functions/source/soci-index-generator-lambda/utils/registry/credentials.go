@@ -0,0 +1,94 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+const (
+	// Docker config file holding the credentials of registries other than ECR, in the "auths" format of
+	// ~/.docker/config.json
+	registryAuthFileEnv = "SOCI_REGISTRY_AUTH_FILE"
+	// The same content inline, e.g. from a secret
+	registryAuthEnv = "SOCI_REGISTRY_AUTH"
+	// Comma-separated list of registries reached over plain HTTP rather than HTTPS
+	plainHTTPRegistriesEnv = "SOCI_PLAIN_HTTP_REGISTRIES"
+)
+
+type dockerConfig struct {
+	Auths map[string]struct {
+		// Base64 of "<username>:<password>"
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+}
+
+// Read the credentials of registries other than ECR from the environment, by registry host
+func loadCredentials() (map[string]auth.Credential, error) {
+	content := []byte(os.Getenv(registryAuthEnv))
+	source := registryAuthEnv
+	if path := os.Getenv(registryAuthFileEnv); path != "" {
+		var err error
+		if content, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+		source = path
+	}
+	credentials := map[string]auth.Credential{}
+	if len(content) == 0 {
+		return credentials, nil
+	}
+
+	var config dockerConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("Invalid registry credentials in %s: %w", source, err)
+	}
+	for server, entry := range config.Auths {
+		credential := auth.Credential{Username: entry.Username, Password: entry.Password, RefreshToken: entry.IdentityToken}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			username, password, found := strings.Cut(string(decoded), ":")
+			if err != nil || !found {
+				return nil, fmt.Errorf("Invalid registry credentials for %s in %s: 'auth' must be the base64 of '<username>:<password>'", server, source)
+			}
+			credential.Username, credential.Password = username, password
+		}
+		credentials[registryHost(server)] = credential
+	}
+	return credentials, nil
+}
+
+// Returns the host of a Docker config server, which may be a URL such as "https://index.docker.io/v1/"
+func registryHost(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	host, _, _ := strings.Cut(server, "/")
+	return host
+}
+
+// Returns the credential function of an auth client, which resolves the credentials of a host from the given ones
+func credentialFunc(credentials map[string]auth.Credential) func(context.Context, string) (auth.Credential, error) {
+	return func(ctx context.Context, host string) (auth.Credential, error) {
+		return credentials[host], nil
+	}
+}
+
+// Check if a registry is configured to be reached over plain HTTP
+func isPlainHTTPRegistry(registryUrl string) bool {
+	for _, registry := range strings.Split(os.Getenv(plainHTTPRegistriesEnv), ",") {
+		if strings.TrimSpace(registry) == registryUrl {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+func TestLoadCredentials(t *testing.T) {
+	t.Setenv(registryAuthFileEnv, "")
+	t.Setenv(registryAuthEnv, `{"auths": {
+		"https://harbor.example.com/v2/": {"auth": "cm9ib3Q6c2VjcmV0"},
+		"registry.example.com:5000": {"username": "user", "password": "password"},
+		"token.example.com": {"identitytoken": "token"}}}`)
+	credentials, err := loadCredentials()
+	if err != nil {
+		t.Fatalf("Unexpected error loading the credentials: %v", err)
+	}
+	expected := map[string]auth.Credential{
+		"harbor.example.com":        {Username: "robot", Password: "secret"},
+		"registry.example.com:5000": {Username: "user", Password: "password"},
+		"token.example.com":         {RefreshToken: "token"},
+	}
+	for host, credential := range expected {
+		if actual, _ := credentialFunc(credentials)(context.Background(), host); actual != credential {
+			t.Fatalf("Expected the credential of %s to be %+v, got %+v", host, credential, actual)
+		}
+	}
+	if actual, _ := credentialFunc(credentials)(context.Background(), "other.example.com"); actual != auth.EmptyCredential {
+		t.Fatalf("Expected no credential for an unknown registry, got %+v", actual)
+	}
+
+	// The file takes precedence
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"auths": {"file.example.com": {"auth": "bm8tY29sb24="}}}`), 0600); err != nil {
+		t.Fatalf("Unexpected error writing the config: %v", err)
+	}
+	t.Setenv(registryAuthFileEnv, path)
+	if _, err := loadCredentials(); err == nil {
+		t.Fatalf("Expected an error for an auth without a colon")
+	}
+}
+
+func TestIsPlainHTTPRegistry(t *testing.T) {
+	t.Setenv(plainHTTPRegistriesEnv, "localhost:5000, registry.internal")
+	if !isPlainHTTPRegistry("registry.internal") || !isPlainHTTPRegistry("localhost:5000") || isPlainHTTPRegistry("registry.example.com") {
+		t.Fatalf("Unexpected plain HTTP registries")
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// Digest used to probe the referrers API, which must answer with an empty list for a manifest that doesn't exist
+const zeroDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+type referrersCapability struct {
+	mutex     sync.Mutex
+	probed    bool
+	supported bool
+}
+
+// Create a repository client. Once the referrers API capability of the registry is known, the repository
+// uses it directly instead of probing the registry again.
+func (registry *Registry) repository(ctx context.Context, repositoryName string) (*remote.Repository, error) {
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+	remoteRepo := repo.(*remote.Repository)
+
+	registry.referrers.mutex.Lock()
+	defer registry.referrers.mutex.Unlock()
+	if registry.referrers.probed {
+		if err := remoteRepo.SetReferrersCapability(registry.referrers.supported); err != nil {
+			return nil, err
+		}
+	}
+	return remoteRepo, nil
+}
+
+// Check if the registry supports the OCI 1.1 referrers API.
+// The registry is probed through the given repository the first time, the answer is reused afterwards.
+func (registry *Registry) ReferrersSupported(ctx context.Context, repositoryName string) (bool, error) {
+	registry.referrers.mutex.Lock()
+	defer registry.referrers.mutex.Unlock()
+	if registry.referrers.probed {
+		return registry.referrers.supported, nil
+	}
+
+	supported, err := registry.probeReferrers(ctx, repositoryName)
+	if err != nil {
+		return false, err
+	}
+	registry.referrers.probed = true
+	registry.referrers.supported = supported
+	if supported {
+		log.Info(ctx, "Registry supports the referrers API")
+	} else {
+		log.Info(ctx, "Registry doesn't support the referrers API, falling back to the referrers tag schema")
+	}
+	return supported, nil
+}
+
+func (registry *Registry) probeReferrers(ctx context.Context, repositoryName string) (bool, error) {
+	scheme := "https"
+	if registry.registry.PlainHTTP {
+		scheme = "http"
+	}
+	url := fmt.Sprintf("%s://%s/v2/%s/referrers/%s", scheme, registry.registry.Reference.Registry, repositoryName, zeroDigest)
+
+	ref := registry.registry.Reference
+	ref.Repository = repositoryName
+	ctx = auth.AppendScopes(ctx, auth.ScopeRepository(ref.Repository, auth.ActionPull))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+
+	var client remote.Client = auth.DefaultClient
+	if registry.registry.RepositoryOptions.Client != nil {
+		client = registry.registry.RepositoryOptions.Client
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	// Registries without the referrers API answer 404, but also 400 or 405 depending on how they route unknown
+	// endpoints. Any other answer, e.g. denied access, throttling or a server error, says nothing about the API
+	// and fails the probe, for the next build to probe again rather than falling back to the tag schema.
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound, http.StatusBadRequest, http.StatusMethodNotAllowed:
+		log.Debug(ctx, "Referrers API probe answered without a referrers list", log.Int("StatusCode", resp.StatusCode))
+		return false, nil
+	}
+	return false, fmt.Errorf("Referrers API probe of %s failed with status %d", url, resp.StatusCode)
+}
+
+// Push a SOCI index which references its image manifest with a subject, so that it can be found with the
+// referrers API. When the registry doesn't support the API, the index is added to the referrers tag
+// of the image, i.e. sha256-<image digest hex>, instead.
+func (registry *Registry) PushReferrer(ctx context.Context, sociStore *store.SociStore, indexDesc ocispec.Descriptor, repositoryName string) error {
+	if _, err := registry.ReferrersSupported(ctx, repositoryName); err != nil {
+		return err
+	}
+	return registry.Push(ctx, sociStore, indexDesc, repositoryName)
+}
@@ -0,0 +1,104 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+func TestReferrersSupportedIsProbedOnce(t *testing.T) {
+	doTest := func(status int, expected bool) {
+		probes := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/v2/repo/referrers/") {
+				probes++
+				if status == http.StatusOK {
+					w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+					w.WriteHeader(status)
+					w.Write([]byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`))
+					return
+				}
+				w.WriteHeader(status)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+
+		remoteRegistry, err := remote.NewRegistry(strings.TrimPrefix(server.URL, "http://"))
+		if err != nil {
+			t.Fatalf("Unexpected error creating registry: %v", err)
+		}
+		remoteRegistry.PlainHTTP = true
+		registry := &Registry{registry: remoteRegistry}
+
+		for i := 0; i < 3; i++ {
+			supported, err := registry.ReferrersSupported(context.Background(), "repo")
+			if err != nil {
+				t.Fatalf("Unexpected error probing the referrers API: %v", err)
+			}
+			if supported != expected {
+				t.Fatalf("Unexpected referrers API capability for status %d. Expected %t but got %t", status, expected, supported)
+			}
+		}
+		if probes != 1 {
+			t.Fatalf("Expected the referrers API to be probed once, got %d probes", probes)
+		}
+	}
+
+	doTest(http.StatusOK, true)
+	doTest(http.StatusNotFound, false)
+	doTest(http.StatusBadRequest, false)
+	doTest(http.StatusMethodNotAllowed, false)
+}
+
+func TestReferrersProbeError(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		probes := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			probes++
+			w.WriteHeader(status)
+		}))
+		remoteRegistry, err := remote.NewRegistry(strings.TrimPrefix(server.URL, "http://"))
+		if err != nil {
+			t.Fatalf("Unexpected error creating registry: %v", err)
+		}
+		remoteRegistry.PlainHTTP = true
+
+		registry := &Registry{registry: remoteRegistry}
+		for i := 0; i < 2; i++ {
+			if _, err := registry.ReferrersSupported(context.Background(), "repo"); err == nil {
+				t.Fatalf("Expected an error when the probe is answered with status %d", status)
+			}
+		}
+		if registry.referrers.probed || probes != 2 {
+			t.Fatalf("Expected the probe answered with status %d to be retried, got %d probes", status, probes)
+		}
+		server.Close()
+	}
+}
+
+func TestReferrersProbeTransportError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	remoteRegistry, err := remote.NewRegistry(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Unexpected error creating registry: %v", err)
+	}
+	remoteRegistry.PlainHTTP = true
+	server.Close()
+
+	registry := &Registry{registry: remoteRegistry}
+	if _, err := registry.ReferrersSupported(context.Background(), "repo"); err == nil {
+		t.Fatalf("Expected an error probing an unreachable registry")
+	}
+	if registry.referrers.probed {
+		t.Fatalf("Expected the probe to be retried after a transport error")
+	}
+}
@@ -13,17 +13,27 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
 	"oras.land/oras-go/v2/registry/remote"
 	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/errcode"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/awslabs/soci-snapshotter/soci/store"
 
 	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/metrics"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/tracing"
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/version"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -41,36 +51,70 @@ var ImageConfigMediaTypes = []string{MediaTypeDockerImageConfig, MediaTypeOCIIma
 
 type Registry struct {
 	registry *remote.Registry
+	// ECR API client and registry id, only set for ECR registries
+	ecrClient  *ecr.ECR
+	registryId string
+	// Referrers API capability, probed at most once per registry
+	referrers referrersCapability
 }
 
 var RegistryNotSupportingOciArtifacts = errors.New("Registry does not support OCI artifacts")
 
-// Initialize a remote registry
+// Exception codes ECR returns when a pull through cache repository can't reach its upstream registry, with or
+// without the "Exception" suffix. The codes are matched as whole words of the error messages of the registry API.
+var upstreamErrorCodes = regexp.MustCompile(`\b(?:UnableToGetUpstreamImage|UnableToGetUpstreamLayer|UnableToAccessSecret)(?:Exception)?\b`)
+
+// Initialize a remote registry, or reuse its client if the context shares registry clients
 func Init(ctx context.Context, registryUrl string) (*Registry, error) {
-	log.Info(ctx, "Initializing registry client")
+	if clients, ok := ctx.Value(sharedClientsKey{}).(*sharedClients); ok {
+		return clients.get(ctx, registryUrl)
+	}
+	return newRegistry(ctx, registryUrl)
+}
+
+func newRegistry(ctx context.Context, registryUrl string) (*Registry, error) {
+	log.Debug(ctx, "Initializing registry client")
 	registry, err := remote.NewRegistry(registryUrl)
 	if err != nil {
 		return nil, err
 	}
 	if isEcrRegistry(registryUrl) {
-		err := authorizeEcr(registry)
+		ecrClient := newEcrClient(ecrRegion(registryUrl))
+		authCtx, span := tracing.Start(ctx, "authorize ECR")
+		err := authorizeEcr(authCtx, registry, ecrClient)
+		tracing.End(span, err)
 		if err != nil {
 			return nil, err
 		}
+		return &Registry{registry: registry, ecrClient: ecrClient, registryId: ecrRegistryId(registryUrl)}, nil
+	}
+	credentials, err := loadCredentials()
+	if err != nil {
+		return nil, err
+	}
+	registry.RepositoryOptions.Client = &auth.Client{
+		Client:     instrumentedClient(),
+		Header:     http.Header{"User-Agent": {version.UserAgent()}},
+		Cache:      auth.DefaultCache,
+		Credential: credentialFunc(credentials),
 	}
-	return &Registry{registry}, nil
+	registry.PlainHTTP = isPlainHTTPRegistry(registryUrl)
+	return &Registry{registry: registry}, nil
 }
 
 // Pull an image from the remote registry to a local OCI Store
 // imageReference can be either a digest or a tag
 func (registry *Registry) Pull(ctx context.Context, repositoryName string, sociStore *store.SociStore, imageReference string) (*ocispec.Descriptor, error) {
 	log.Info(ctx, "Pulling image")
-	repo, err := registry.registry.Repository(ctx, repositoryName)
+	repo, err := registry.repository(ctx, repositoryName)
 	if err != nil {
 		return nil, err
 	}
 
-	imageDescriptor, err := oras.Copy(ctx, repo, imageReference, sociStore, imageReference, oras.DefaultCopyOptions)
+	options := oras.DefaultCopyOptions
+	endCopy := instrumentCopy(&options.CopyGraphOptions, "pull blob", metrics.AddPulledBytes)
+	imageDescriptor, err := oras.Copy(ctx, repo, imageReference, sociStore, imageReference, options)
+	endCopy(err)
 	if err != nil {
 		return nil, err
 	}
@@ -84,12 +128,15 @@ func (registry *Registry) Pull(ctx context.Context, repositoryName string, sociS
 func (registry *Registry) Push(ctx context.Context, sociStore *store.SociStore, indexDesc ocispec.Descriptor, repositoryName string) error {
 	log.Info(ctx, "Pushing artifact")
 
-	repo, err := registry.registry.Repository(ctx, repositoryName)
+	repo, err := registry.repository(ctx, repositoryName)
 	if err != nil {
 		return err
 	}
 
-	err = oras.CopyGraph(ctx, sociStore, repo, indexDesc, oras.DefaultCopyGraphOptions)
+	options := oras.DefaultCopyGraphOptions
+	endCopy := instrumentCopy(&options, "push blob", metrics.AddPushedBytes)
+	err = oras.CopyGraph(ctx, sociStore, repo, indexDesc, options)
+	endCopy(err)
 	if err != nil {
 		// TODO: There might be a better way to check if a registry supporting OCI or not
 		if strings.Contains(err.Error(), "Response status code 405: unsupported: Invalid parameter at 'ImageManifest' failed to satisfy constraint: 'Invalid JSON syntax'") {
@@ -101,9 +148,73 @@ func (registry *Registry) Push(ctx context.Context, sociStore *store.SociStore,
 	return nil
 }
 
+// Copy a manifest and the content it references to the same repository of another registry. Content the
+// destination already has, e.g. the image a SOCI index references as its subject, isn't copied again.
+func (registry *Registry) Copy(ctx context.Context, repositoryName string, desc ocispec.Descriptor, destination *Registry) error {
+	log.Info(ctx, "Copying artifact")
+
+	source, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return err
+	}
+	// Manifests with a subject are added to the referrers tag of destinations without the referrers API
+	if _, err := destination.ReferrersSupported(ctx, repositoryName); err != nil {
+		return err
+	}
+	target, err := destination.repository(ctx, repositoryName)
+	if err != nil {
+		return err
+	}
+
+	options := oras.DefaultCopyGraphOptions
+	endCopy := instrumentCopy(&options, "copy blob", metrics.AddPushedBytes)
+	err = oras.CopyGraph(ctx, source, target, desc, options)
+	endCopy(err)
+	return err
+}
+
+// Trace the copy of each blob of a graph in a span, and count the bytes copied. The returned function ends the
+// spans of the blobs whose copy didn't complete once the copy of the graph fails.
+func instrumentCopy(options *oras.CopyGraphOptions, spanName string, addBytes func(context.Context, int64)) func(error) {
+	// Blobs are copied concurrently
+	var spans sync.Map
+	options.PreCopy = func(ctx context.Context, desc ocispec.Descriptor) error {
+		_, span := tracing.Start(ctx, spanName,
+			attribute.String("oci.digest", desc.Digest.String()),
+			attribute.String("oci.media_type", desc.MediaType),
+			attribute.Int64("oci.size", desc.Size))
+		spans.Store(desc.Digest, span)
+		return nil
+	}
+	options.PostCopy = func(ctx context.Context, desc ocispec.Descriptor) error {
+		if span, ok := spans.LoadAndDelete(desc.Digest); ok {
+			tracing.End(span.(trace.Span), nil)
+		}
+		addBytes(ctx, desc.Size)
+		return nil
+	}
+	return func(err error) {
+		spans.Range(func(digest, span interface{}) bool {
+			tracing.End(span.(trace.Span), err)
+			return true
+		})
+	}
+}
+
+// Tag a manifest which was already pushed to the remote registry
+func (registry *Registry) Tag(ctx context.Context, repositoryName string, descriptor ocispec.Descriptor, tag string) error {
+	log.Info(ctx, fmt.Sprintf("Tagging artifact as %s", tag))
+
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return err
+	}
+	return repo.Tag(ctx, descriptor, tag)
+}
+
 // Call registry's headManifest and return the manifest's descriptor
 func (registry *Registry) HeadManifest(ctx context.Context, repositoryName string, reference string) (ocispec.Descriptor, error) {
-	repo, err := registry.registry.Repository(ctx, repositoryName)
+	repo, err := registry.repository(ctx, repositoryName)
 	if err != nil {
 		return ocispec.Descriptor{}, err
 	}
@@ -116,31 +227,81 @@ func (registry *Registry) HeadManifest(ctx context.Context, repositoryName strin
 	return descriptor, nil
 }
 
+// Check if a manifest exists in a repository
+func (registry *Registry) HasManifest(ctx context.Context, repositoryName string, reference string) (bool, error) {
+	_, err := registry.HeadManifest(ctx, repositoryName, reference)
+	if err != nil {
+		if errors.Is(err, errdef.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
 // Call registry's getManifest and return the image's manifest
 // The image reference must be a digest because that's what oras-go FetchReference takes
 func (registry *Registry) GetManifest(ctx context.Context, repositoryName string, digest string) (ocispec.Manifest, error) {
-	repo, err := registry.registry.Repository(ctx, repositoryName)
+	_, manifest, err := registry.fetchManifest(ctx, repositoryName, digest)
+	return manifest, err
+}
+
+// Fetch the config of an image manifest, which holds the image's platform and labels
+func (registry *Registry) GetImageConfig(ctx context.Context, repositoryName string, manifest ocispec.Manifest) (ocispec.Image, error) {
+	var config ocispec.Image
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return config, err
+	}
+
+	bytes, err := content.FetchAll(ctx, repo, manifest.Config)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(bytes, &config)
+	return config, err
+}
+
+// Fetch a manifest, returning both its descriptor and its content
+func (registry *Registry) fetchManifest(ctx context.Context, repositoryName string, reference string) (ocispec.Descriptor, ocispec.Manifest, error) {
 	var manifest ocispec.Manifest
+	descriptor, err := registry.fetchReference(ctx, repositoryName, reference, &manifest)
+	return descriptor, manifest, err
+}
+
+// Fetch the manifest or image index a reference names, decoding it into v
+func (registry *Registry) fetchReference(ctx context.Context, repositoryName string, reference string, v interface{}) (ocispec.Descriptor, error) {
+	repo, err := registry.repository(ctx, repositoryName)
 	if err != nil {
-		return manifest, err
+		return ocispec.Descriptor{}, err
 	}
 
-	_, rc, err := repo.FetchReference(ctx, digest)
+	descriptor, rc, err := repo.FetchReference(ctx, reference)
 	if err != nil {
-		return manifest, err
+		return descriptor, err
 	}
+	defer rc.Close()
 
 	bytes, err := io.ReadAll(rc)
 	if err != nil {
-		return manifest, err
+		return descriptor, err
 	}
 
-	err = json.Unmarshal(bytes, &manifest)
+	return descriptor, json.Unmarshal(bytes, v)
+}
+
+// Delete a manifest from a repository. Deleting a manifest which doesn't exist is not an error.
+func (registry *Registry) DeleteManifest(ctx context.Context, repositoryName string, descriptor ocispec.Descriptor) error {
+	repo, err := registry.repository(ctx, repositoryName)
 	if err != nil {
-		return manifest, err
+		return err
 	}
 
-	return manifest, nil
+	err = repo.Manifests().Delete(ctx, descriptor)
+	if err != nil && !errors.Is(err, errdef.ErrNotFound) {
+		return err
+	}
+	return nil
 }
 
 // Validate if a digest is a valid image manifest
@@ -163,6 +324,30 @@ func (registry *Registry) ValidateImageManifest(ctx context.Context, repositoryN
 	return fmt.Errorf("Unexpected config media type: %s, expected one of: %v.", manifest.Config.MediaType, ImageConfigMediaTypes)
 }
 
+// Check if an error was caused by the upstream registry of a pull through cache repository
+// rather than by the private registry itself
+func IsUpstreamError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// Errors of the ECR API carry their exception code
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return upstreamErrorCodes.MatchString(awsErr.Code())
+	}
+	// Errors of the registry API carry the error codes of the response body, ECR reports the exception in the
+	// response status text otherwise
+	var response *errcode.ErrorResponse
+	if errors.As(err, &response) {
+		for _, responseErr := range response.Errors {
+			if upstreamErrorCodes.MatchString(responseErr.Code) || upstreamErrorCodes.MatchString(responseErr.Message) {
+				return true
+			}
+		}
+	}
+	return upstreamErrorCodes.MatchString(err.Error())
+}
+
 // Check if a registry is an ECR registry
 func isEcrRegistry(registryUrl string) bool {
 	ecrRegistryUrlRegex := "\\d{12}\\.dkr\\.ecr\\.\\S+\\.amazonaws\\.com"
@@ -173,18 +358,44 @@ func isEcrRegistry(registryUrl string) bool {
 	return match
 }
 
-// Authorize ECR registry
-func authorizeEcr(ecrRegistry *remote.Registry) error {
-	// getting ecr auth token
-	input := &ecr.GetAuthorizationTokenInput{}
-	var ecrClient *ecr.ECR
+// Returns the registry id, i.e. the AWS account id, of an ECR registry url
+func ecrRegistryId(registryUrl string) string {
+	return regexp.MustCompile(`\d{12}`).FindString(registryUrl)
+}
+
+// Returns the region of an ECR registry url, or an empty string if the url has none
+func ecrRegion(registryUrl string) string {
+	match := regexp.MustCompile(`\d{12}\.dkr\.ecr\.([a-z0-9-]+)\.amazonaws\.com`).FindStringSubmatch(registryUrl)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// Returns the HTTP client of the registry clients, tracing their requests and counting the registries' responses
+func instrumentedClient() *http.Client {
+	return &http.Client{Transport: tracing.Transport(metrics.Transport(http.DefaultTransport))}
+}
+
+// Create an ECR API client for a region
+// ECR authorization tokens are regional, so the client must be in the registry's own region
+func newEcrClient(region string) *ecr.ECR {
+	config := &aws.Config{HTTPClient: &http.Client{Transport: tracing.Transport(http.DefaultTransport)}}
+	if region != "" {
+		config.Region = aws.String(region)
+	}
 	ecrEndpoint := os.Getenv("ECR_ENDPOINT") // set this env var for custom, i.e. non default, aws ecr endpoint
 	if ecrEndpoint != "" {
-		ecrClient = ecr.New(session.New(&aws.Config{Endpoint: aws.String(ecrEndpoint)}))
-	} else {
-		ecrClient = ecr.New(session.New())
+		config.Endpoint = aws.String(ecrEndpoint)
 	}
-	getAuthorizationTokenResponse, err := ecrClient.GetAuthorizationToken(input)
+	return ecr.New(session.New(config))
+}
+
+// Authorize ECR registry
+func authorizeEcr(ctx context.Context, ecrRegistry *remote.Registry, ecrClient *ecr.ECR) error {
+	// getting ecr auth token
+	input := &ecr.GetAuthorizationTokenInput{}
+	getAuthorizationTokenResponse, err := ecrClient.GetAuthorizationTokenWithContext(ctx, input)
 	if err != nil {
 		return err
 	}
@@ -199,9 +410,10 @@ func authorizeEcr(ecrRegistry *remote.Registry) error {
 	}
 
 	ecrRegistry.RepositoryOptions.Client = &auth.Client{
+		Client: instrumentedClient(),
 		Header: http.Header{
 			"Authorization": {"Basic " + *ecrAuthorizationToken},
-			"User-Agent":    {"SOCI Index Builder (oras-go)"},
+			"User-Agent":    {version.UserAgent()},
 		},
 	}
 	return nil
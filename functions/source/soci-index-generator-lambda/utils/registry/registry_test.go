@@ -5,10 +5,15 @@ package registry
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"testing"
 
 	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/registry/remote/errcode"
 )
 
 type ExpectedResponse struct {
@@ -113,3 +118,31 @@ func TestGetManifest(t *testing.T) {
 	}
 	doTest("docker.io", "library/redis", "sha256:afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187", expected)
 }
+
+func TestIsUpstreamError(t *testing.T) {
+	doTest := func(err error, expected bool) {
+		if IsUpstreamError(err) != expected {
+			t.Fatalf("Unexpected upstream classification of %v. Expected %t", err, expected)
+		}
+	}
+
+	doTest(nil, false)
+	doTest(errors.New("GET https://123456789012.dkr.ecr.us-west-2.amazonaws.com/v2/docker-hub/library/redis/blobs/sha256:abc: response status code 500: UnableToGetUpstreamLayerException"), true)
+	doTest(awserr.New("UnableToGetUpstreamImageException", "image not found upstream", nil), true)
+	doTest(awserr.New("RepositoryNotFoundException", "repository not found, check the upstream registry", nil), false)
+	doTest(fmt.Errorf("pull: %w", &errcode.ErrorResponse{
+		Method:     http.MethodGet,
+		StatusCode: http.StatusNotFound,
+		Errors:     errcode.Errors{{Code: "UnableToGetUpstreamImage", Message: "unable to reach the upstream registry"}},
+	}), true)
+	doTest(&errcode.ErrorResponse{
+		Method:     http.MethodGet,
+		StatusCode: http.StatusNotFound,
+		Errors:     errcode.Errors{{Code: errcode.ErrorCodeManifestUnknown, Message: "manifest unknown"}},
+	}, false)
+	// Free text mentioning the upstream registry isn't an ECR exception
+	doTest(errors.New("failed to reach upstream registry registry-1.docker.io"), false)
+	doTest(fmt.Errorf("Image manifest fetch error: %w", errors.New("upstream registry unreachable")), false)
+	doTest(errors.New("UnableToGetUpstreamImageCache"), false)
+	doTest(errors.New("response status code 404: manifest unknown"), false)
+}
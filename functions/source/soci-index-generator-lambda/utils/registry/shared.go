@@ -0,0 +1,44 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"sync"
+)
+
+type sharedClientsKey struct{}
+
+// Registry clients shared by the builds of an invocation, by registry URL
+type sharedClients struct {
+	mutex      sync.Mutex
+	registries map[string]*Registry
+}
+
+// Returns a context in which Init initializes each registry once, sharing its client between concurrent builds
+func WithSharedClients(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sharedClientsKey{}, &sharedClients{registries: map[string]*Registry{}})
+}
+
+// Returns a context sharing registry clients, keeping the clients ctx already shares, e.g. those of an SQS batch
+func EnsureSharedClients(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(sharedClientsKey{}).(*sharedClients); ok {
+		return ctx
+	}
+	return WithSharedClients(ctx)
+}
+
+func (clients *sharedClients) get(ctx context.Context, registryUrl string) (*Registry, error) {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+	if registry, ok := clients.registries[registryUrl]; ok {
+		return registry, nil
+	}
+	registry, err := newRegistry(ctx, registryUrl)
+	if err != nil {
+		return nil, err
+	}
+	clients.registries[registryUrl] = registry
+	return registry, nil
+}
@@ -0,0 +1,45 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSharedClients(t *testing.T) {
+	ctx := context.Background()
+	first, err := Init(ctx, "localhost:5000")
+	if err != nil {
+		t.Fatalf("Unexpected error initializing the registry: %v", err)
+	}
+	second, _ := Init(ctx, "localhost:5000")
+	if first == second {
+		t.Fatalf("Expected a new client without shared clients")
+	}
+
+	ctx = WithSharedClients(ctx)
+	first, _ = Init(ctx, "localhost:5000")
+	second, _ = Init(ctx, "localhost:5000")
+	other, _ := Init(ctx, "localhost:5001")
+	if first != second || first == other {
+		t.Fatalf("Expected the client of each registry to be shared")
+	}
+}
+
+func TestEnsureSharedClients(t *testing.T) {
+	batchCtx := WithSharedClients(context.Background())
+	first, _ := Init(batchCtx, "localhost:5000")
+	second, _ := Init(EnsureSharedClients(batchCtx), "localhost:5000")
+	if first != second {
+		t.Fatalf("Expected the clients of the context to be kept")
+	}
+
+	ctx := EnsureSharedClients(context.Background())
+	first, _ = Init(ctx, "localhost:5000")
+	second, _ = Init(ctx, "localhost:5000")
+	if first != second {
+		t.Fatalf("Expected clients to be shared in a context without shared clients")
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/errdef"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+const (
+	// Annotation naming the image manifest a SOCI index belongs to, for indexes that aren't linked to it by a subject
+	AnnotationSociImageManifestDigest = "com.amazon.soci.image-manifest-digest"
+	// Annotation naming the SOCI index manifest v2 bound to an image manifest
+	ImageAnnotationSociIndexDigest = "com.amazon.soci.index-digest"
+
+	// Artifact type of SOCI index manifest v2, which is bound to its image by an image index rather than a subject
+	SociIndexArtifactTypeV2 = "application/vnd.amazon.soci.index.v2+json"
+)
+
+var ErrManifestListingNotSupported = errors.New("Listing every manifest of a repository is only supported for ECR registries")
+
+// Most SOCI index manifests fetched when scanning a repository for the indexes of a single image, newest first.
+// Each push looks for an existing index, scanning a whole repository would throttle on large ones.
+const maxScannedSociIndexes = 100
+
+// A SOCI index manifest stored in a repository
+type SociIndexManifest struct {
+	Descriptor ocispec.Descriptor
+	Manifest   ocispec.Manifest
+	// Tags and push time are only known when the index was found by listing the repository
+	Tags     []string
+	PushedAt time.Time
+}
+
+// Returns the digest of the image manifest the SOCI index belongs to, or an empty string if it is unknown
+func (index SociIndexManifest) ImageManifestDigest() string {
+	if index.Manifest.Subject != nil {
+		return index.Manifest.Subject.Digest.String()
+	}
+	return index.Manifest.Annotations[AnnotationSociImageManifestDigest]
+}
+
+// Check if a manifest is a SOCI index
+func IsSociIndexManifest(manifest ocispec.Manifest) bool {
+	return isSociIndexType(manifest.ArtifactType) || isSociIndexType(manifest.Config.MediaType)
+}
+
+func isSociIndexType(mediaType string) bool {
+	return mediaType == soci.SociIndexArtifactType || mediaType == SociIndexArtifactTypeV2
+}
+
+// An image, or any other manifest, stored in an ECR repository
+type ImageDetail struct {
+	Digest            string
+	Tags              []string
+	MediaType         string
+	ArtifactMediaType string
+	Size              int64
+	PushedAt          time.Time
+}
+
+// List every manifest in a repository, tagged or not.
+// The distribution API can only list tags, so this requires the ECR API.
+func (registry *Registry) ListImages(ctx context.Context, repositoryName string) ([]ImageDetail, error) {
+	if registry.ecrClient == nil {
+		return nil, ErrManifestListingNotSupported
+	}
+
+	var images []ImageDetail
+	input := &ecr.DescribeImagesInput{
+		RegistryId:     aws.String(registry.registryId),
+		RepositoryName: aws.String(repositoryName),
+	}
+	err := registry.ecrClient.DescribeImagesPagesWithContext(ctx, input, func(page *ecr.DescribeImagesOutput, lastPage bool) bool {
+		images = append(images, imageDetails(page)...)
+		return true
+	})
+	return images, err
+}
+
+// A page of the manifests of a repository
+type ImagePage struct {
+	Images []ImageDetail
+	// Token to list the next page, empty on the last page
+	NextToken string
+}
+
+// List a page of the manifests in a repository, starting at the given token or at the beginning if it is empty.
+// ECR registries list every manifest, tagged or not. Other registries only list tagged manifests, with the tags
+// API, and the token is the last tag of the previous page.
+func (registry *Registry) ListImagesPage(ctx context.Context, repositoryName string, token string, pageSize int) (ImagePage, error) {
+	if registry.ecrClient == nil {
+		return registry.listTaggedImagesPage(ctx, repositoryName, token, pageSize)
+	}
+
+	input := &ecr.DescribeImagesInput{
+		RegistryId:     aws.String(registry.registryId),
+		RepositoryName: aws.String(repositoryName),
+		MaxResults:     aws.Int64(int64(pageSize)),
+	}
+	if token != "" {
+		input.NextToken = aws.String(token)
+	}
+	output, err := registry.ecrClient.DescribeImagesWithContext(ctx, input)
+	if err != nil {
+		return ImagePage{}, err
+	}
+	return ImagePage{Images: imageDetails(output), NextToken: aws.StringValue(output.NextToken)}, nil
+}
+
+// Stops listing tags after the first page
+var errTagPageListed = errors.New("tag page listed")
+
+func (registry *Registry) listTaggedImagesPage(ctx context.Context, repositoryName string, last string, pageSize int) (ImagePage, error) {
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return ImagePage{}, err
+	}
+	repo.TagListPageSize = pageSize
+
+	var tags []string
+	err = repo.Tags(ctx, last, func(page []string) error {
+		tags = page
+		return errTagPageListed
+	})
+	if err != nil && !errors.Is(err, errTagPageListed) {
+		return ImagePage{}, err
+	}
+
+	var page ImagePage
+	for _, tag := range tags {
+		descriptor, err := repo.Resolve(ctx, tag)
+		if err != nil {
+			return ImagePage{}, err
+		}
+		page.Images = append(page.Images, ImageDetail{
+			Digest:    descriptor.Digest.String(),
+			Tags:      []string{tag},
+			MediaType: descriptor.MediaType,
+			Size:      descriptor.Size,
+		})
+	}
+	// A short page is the last one
+	if len(tags) >= pageSize {
+		page.NextToken = tags[len(tags)-1]
+	}
+	return page, nil
+}
+
+// List every image of a repository a page at a time, with the ECR API or the tags API
+func (registry *Registry) ListAllImages(ctx context.Context, repositoryName string, pageSize int) ([]ImageDetail, error) {
+	var images []ImageDetail
+	token := ""
+	for {
+		page, err := registry.ListImagesPage(ctx, repositoryName, token, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, page.Images...)
+		if page.NextToken == "" {
+			return images, nil
+		}
+		token = page.NextToken
+	}
+}
+
+// List the names of the repositories of a registry, with the ECR API or the catalog API
+func (registry *Registry) ListRepositories(ctx context.Context) ([]string, error) {
+	var names []string
+	if registry.ecrClient == nil {
+		err := registry.registry.Repositories(ctx, "", func(page []string) error {
+			names = append(names, page...)
+			return nil
+		})
+		return names, err
+	}
+
+	input := &ecr.DescribeRepositoriesInput{RegistryId: aws.String(registry.registryId)}
+	err := registry.ecrClient.DescribeRepositoriesPagesWithContext(ctx, input, func(page *ecr.DescribeRepositoriesOutput, lastPage bool) bool {
+		for _, repository := range page.Repositories {
+			names = append(names, aws.StringValue(repository.RepositoryName))
+		}
+		return true
+	})
+	return names, err
+}
+
+func imageDetails(page *ecr.DescribeImagesOutput) []ImageDetail {
+	var images []ImageDetail
+	for _, detail := range page.ImageDetails {
+		images = append(images, ImageDetail{
+			Digest:            aws.StringValue(detail.ImageDigest),
+			Tags:              aws.StringValueSlice(detail.ImageTags),
+			MediaType:         aws.StringValue(detail.ImageManifestMediaType),
+			ArtifactMediaType: aws.StringValue(detail.ArtifactMediaType),
+			Size:              aws.Int64Value(detail.ImageSizeInBytes),
+			PushedAt:          aws.TimeValue(detail.ImagePushedAt),
+		})
+	}
+	return images
+}
+
+// List every SOCI index manifest in a repository. Manifests deleted since the repository was listed are logged
+// and skipped, any other error fetching a manifest fails the listing, which would otherwise be incomplete.
+func (registry *Registry) ListSociIndexes(ctx context.Context, repositoryName string) ([]SociIndexManifest, error) {
+	images, err := registry.ListImages(ctx, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+	return registry.fetchSociIndexes(ctx, repositoryName, images, len(images))
+}
+
+// Fetch the SOCI index manifests among the listed images, fetching at most limit manifests. Manifests which no
+// longer exist are skipped.
+func (registry *Registry) fetchSociIndexes(ctx context.Context, repositoryName string, images []ImageDetail, limit int) ([]SociIndexManifest, error) {
+	var indexes []SociIndexManifest
+	fetched := 0
+	for _, image := range images {
+		// ECR reports the config media type as the artifact media type, so images can be skipped without fetching them
+		if image.ArtifactMediaType != "" && !isSociIndexType(image.ArtifactMediaType) {
+			continue
+		}
+		if fetched == limit {
+			log.Warn(ctx, fmt.Sprintf("Stopped scanning the repository for SOCI indexes after %d manifests", limit))
+			break
+		}
+		fetched++
+		descriptor, manifest, err := registry.fetchManifest(ctx, repositoryName, image.Digest)
+		if errors.Is(err, errdef.ErrNotFound) {
+			log.Warn(ctx, fmt.Sprintf("Skipping manifest %s, deleted since the repository was listed", image.Digest))
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error fetching manifest %s: %w", image.Digest, err)
+		}
+		if IsSociIndexManifest(manifest) {
+			indexes = append(indexes, SociIndexManifest{Descriptor: descriptor, Manifest: manifest, Tags: image.Tags, PushedAt: image.PushedAt})
+		}
+	}
+	return indexes, nil
+}
+
+// Find the SOCI indexes in a repository belonging to an image manifest, whether the image still exists or not.
+// Indexes linked by a subject are found through the referrers API, or its tag schema fallback. Registries without
+// the referrers API may hold indexes only linked by an annotation, pushed with the legacy registry encoding, so
+// ECR repositories are also scanned for the newest of them when the registry lacks the API. SOCI index manifests
+// v2 are only linked by an annotation too, they are found through the image index they're tagged with instead.
+func (registry *Registry) FindSociIndexes(ctx context.Context, repositoryName string, imageDigest string) ([]SociIndexManifest, error) {
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+
+	dgst, err := digest.Parse(imageDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	var indexes []SociIndexManifest
+	seen := map[digest.Digest]bool{}
+
+	subject := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: dgst}
+	err = repo.Referrers(ctx, subject, soci.SociIndexArtifactType, func(referrers []ocispec.Descriptor) error {
+		for _, referrer := range referrers {
+			if seen[referrer.Digest] {
+				continue
+			}
+			descriptor, manifest, err := registry.fetchManifest(ctx, repositoryName, referrer.Digest.String())
+			if err != nil {
+				return err
+			}
+			seen[referrer.Digest] = true
+			indexes = append(indexes, SociIndexManifest{Descriptor: descriptor, Manifest: manifest})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if registry.ecrClient == nil {
+		return indexes, nil
+	}
+	supported, err := registry.ReferrersSupported(ctx, repositoryName)
+	if err != nil || supported {
+		return indexes, err
+	}
+
+	images, err := registry.ListImages(ctx, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(images, func(i, j int) bool { return images[i].PushedAt.After(images[j].PushedAt) })
+	scanned, err := registry.fetchSociIndexes(ctx, repositoryName, images, maxScannedSociIndexes)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range scanned {
+		if !seen[index.Descriptor.Digest] && index.ImageManifestDigest() == imageDigest {
+			seen[index.Descriptor.Digest] = true
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes, nil
+}
+
+// Find the SOCI index manifests v2 of an image in the image index a tag names, e.g. the tag the image index of a
+// SOCI index manifest v2 is pushed with. Returns no indexes if the tag doesn't exist.
+// Both the descriptor of an index in the image index and the index itself name the image the index was built for,
+// i.e. the original image rather than the image converted for SOCI index manifest v2.
+func (registry *Registry) FindSociIndexesV2(ctx context.Context, repositoryName string, tag string, imageDigest string) ([]SociIndexManifest, error) {
+	var imageIndex ocispec.Index
+	if _, err := registry.fetchReference(ctx, repositoryName, tag, &imageIndex); err != nil {
+		if errors.Is(err, errdef.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var indexes []SociIndexManifest
+	for _, descriptor := range imageIndex.Manifests {
+		if descriptor.ArtifactType != SociIndexArtifactTypeV2 || descriptor.Annotations[AnnotationSociImageManifestDigest] != imageDigest {
+			continue
+		}
+		descriptor, manifest, err := registry.fetchManifest(ctx, repositoryName, descriptor.Digest.String())
+		if err != nil {
+			return nil, err
+		}
+		index := SociIndexManifest{Descriptor: descriptor, Manifest: manifest}
+		if IsSociIndexManifest(manifest) && index.ImageManifestDigest() == imageDigest {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes, nil
+}
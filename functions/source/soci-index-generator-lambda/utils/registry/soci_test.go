@@ -0,0 +1,366 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+const testImageDigest = "sha256:afd1957d6b59bfff9615d7ec07001afb4eeea39eb341fc777c0caac3fcf52187"
+
+func TestSociIndexManifestImageManifestDigest(t *testing.T) {
+	bySubject := SociIndexManifest{Manifest: ocispec.Manifest{
+		Config:  ocispec.Descriptor{MediaType: soci.SociIndexArtifactType},
+		Subject: &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: testImageDigest},
+	}}
+	if bySubject.ImageManifestDigest() != testImageDigest {
+		t.Fatalf("Expected the image manifest digest from the subject, got %q", bySubject.ImageManifestDigest())
+	}
+
+	byAnnotation := SociIndexManifest{Manifest: ocispec.Manifest{
+		Config:      ocispec.Descriptor{MediaType: soci.SociIndexArtifactType},
+		Annotations: map[string]string{AnnotationSociImageManifestDigest: testImageDigest},
+	}}
+	if byAnnotation.ImageManifestDigest() != testImageDigest {
+		t.Fatalf("Expected the image manifest digest from the annotation, got %q", byAnnotation.ImageManifestDigest())
+	}
+
+	if (SociIndexManifest{}).ImageManifestDigest() != "" {
+		t.Fatalf("Expected no image manifest digest for an index without subject or annotation")
+	}
+}
+
+func TestIsSociIndexManifest(t *testing.T) {
+	if !IsSociIndexManifest(ocispec.Manifest{Config: ocispec.Descriptor{MediaType: soci.SociIndexArtifactType}}) {
+		t.Fatalf("Expected a manifest with the SOCI index config media type to be a SOCI index")
+	}
+	if !IsSociIndexManifest(ocispec.Manifest{ArtifactType: soci.SociIndexArtifactType}) {
+		t.Fatalf("Expected a manifest with the SOCI index artifact type to be a SOCI index")
+	}
+	if IsSociIndexManifest(ocispec.Manifest{Config: ocispec.Descriptor{MediaType: MediaTypeOCIImageConfig}}) {
+		t.Fatalf("Expected an image manifest not to be a SOCI index")
+	}
+}
+
+func TestListTaggedImagesPage(t *testing.T) {
+	tags := []string{"a", "b", "c"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/repo/tags/list":
+			var page []string
+			for _, tag := range tags {
+				if tag > r.URL.Query().Get("last") {
+					page = append(page, tag)
+				}
+			}
+			if len(page) > 2 {
+				page = page[:2]
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"name": "repo", "tags": page})
+		case strings.HasPrefix(r.URL.Path, "/v2/repo/manifests/"):
+			tag := strings.TrimPrefix(r.URL.Path, "/v2/repo/manifests/")
+			w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+			w.Header().Set("Docker-Content-Digest", digest.FromString(tag).String())
+			w.Header().Set("Content-Length", "42")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	remoteRegistry, err := remote.NewRegistry(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Unexpected error creating registry: %v", err)
+	}
+	remoteRegistry.PlainHTTP = true
+	registry := &Registry{registry: remoteRegistry}
+
+	page, err := registry.ListImagesPage(context.Background(), "repo", "", 2)
+	if err != nil {
+		t.Fatalf("Unexpected error listing the first page: %v", err)
+	}
+	if len(page.Images) != 2 || page.NextToken != "b" {
+		t.Fatalf("Expected two images and a next token, got %+v", page)
+	}
+	if page.Images[0].Digest != digest.FromString("a").String() || page.Images[0].Tags[0] != "a" {
+		t.Fatalf("Unexpected image %+v", page.Images[0])
+	}
+
+	page, err = registry.ListImagesPage(context.Background(), "repo", page.NextToken, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error listing the last page: %v", err)
+	}
+	if len(page.Images) != 1 || page.Images[0].Tags[0] != "c" || page.NextToken != "" {
+		t.Fatalf("Expected the last image without a next token, got %+v", page)
+	}
+}
+
+// A SOCI index manifest of an image, linked by a subject or by an annotation, and its content
+func testSociIndex(t *testing.T, imageDigest string, bySubject bool) (digest.Digest, []byte) {
+	index := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: soci.SociIndexArtifactType, Digest: digest.FromString("{}"), Size: 2},
+	}
+	index.SchemaVersion = 2
+	if bySubject {
+		index.Subject = &ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.Digest(imageDigest), Size: 42}
+	} else {
+		index.Annotations = map[string]string{AnnotationSociImageManifestDigest: imageDigest}
+	}
+	content, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("Unexpected error encoding the SOCI index: %v", err)
+	}
+	return digest.FromBytes(content), content
+}
+
+// Fake registry serving manifests and the DescribeImages action of the ECR API, with the images of a repository
+type testEcrServer struct {
+	images    []ImageDetail
+	manifests map[digest.Digest][]byte
+	tags      map[string]digest.Digest
+	// Referrers answered by the referrers API, which is unsupported when nil
+	referrers []ocispec.Descriptor
+	// Status of the manifest fetches which fail, by digest
+	failures map[digest.Digest]int
+	// Manifest fetches, by reference, and DescribeImages calls
+	fetches        map[string]int
+	describeImages int
+}
+
+func (server *testEcrServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/v2/repo/referrers/") {
+		if server.referrers == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		index := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: server.referrers}
+		index.SchemaVersion = 2
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+		json.NewEncoder(w).Encode(index)
+		return
+	}
+	if strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".DescribeImages") {
+		server.describeImages++
+		var details []map[string]interface{}
+		for _, image := range server.images {
+			details = append(details, map[string]interface{}{
+				"imageDigest":       image.Digest,
+				"imageTags":         image.Tags,
+				"artifactMediaType": image.ArtifactMediaType,
+				"imagePushedAt":     image.PushedAt.Unix(),
+			})
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		json.NewEncoder(w).Encode(map[string]interface{}{"imageDetails": details})
+		return
+	}
+	if reference := strings.TrimPrefix(r.URL.Path, "/v2/repo/manifests/"); reference != r.URL.Path {
+		server.fetches[reference]++
+		dgst := digest.Digest(reference)
+		if tagged, ok := server.tags[reference]; ok {
+			dgst = tagged
+		}
+		if status, ok := server.failures[dgst]; ok {
+			w.WriteHeader(status)
+			return
+		}
+		content, ok := server.manifests[dgst]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var mediaType struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(content, &mediaType)
+		w.Header().Set("Content-Type", mediaType.MediaType)
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// Registry client of a fake ECR registry, using the server for both the registry and the ECR APIs
+func testEcrRegistry(t *testing.T, server *httptest.Server) *Registry {
+	remoteRegistry, err := remote.NewRegistry(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Unexpected error creating registry: %v", err)
+	}
+	remoteRegistry.PlainHTTP = true
+	ecrSession, err := session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating the ECR session: %v", err)
+	}
+	return &Registry{registry: remoteRegistry, ecrClient: ecr.New(ecrSession), registryId: "123456789012"}
+}
+
+func TestListSociIndexesSkipsDeletedManifests(t *testing.T) {
+	firstDigest, firstIndex := testSociIndex(t, testImageDigest, true)
+	secondDigest, secondIndex := testSociIndex(t, testImageDigest, false)
+	deletedDigest := digest.FromString("deleted")
+	fake := &testEcrServer{
+		images: []ImageDetail{
+			{Digest: firstDigest.String(), ArtifactMediaType: soci.SociIndexArtifactType},
+			{Digest: deletedDigest.String(), ArtifactMediaType: soci.SociIndexArtifactType},
+			{Digest: secondDigest.String(), ArtifactMediaType: soci.SociIndexArtifactType},
+			{Digest: testImageDigest, ArtifactMediaType: MediaTypeOCIImageConfig},
+		},
+		manifests: map[digest.Digest][]byte{firstDigest: firstIndex, secondDigest: secondIndex},
+		fetches:   map[string]int{},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	indexes, err := testEcrRegistry(t, server).ListSociIndexes(context.Background(), "repo")
+	if err != nil {
+		t.Fatalf("Expected the manifest which can't be fetched to be skipped, got %v", err)
+	}
+	if len(indexes) != 2 || indexes[0].Descriptor.Digest != firstDigest || indexes[1].Descriptor.Digest != secondDigest {
+		t.Fatalf("Expected the 2 SOCI indexes which can be fetched, got %+v", indexes)
+	}
+	if fake.fetches[testImageDigest] != 0 {
+		t.Fatalf("Expected the image not to be fetched, its artifact media type isn't a SOCI index")
+	}
+
+	// Any other error would make the listing incomplete
+	fake.failures = map[digest.Digest]int{secondDigest: http.StatusForbidden}
+	if indexes, err := testEcrRegistry(t, server).ListSociIndexes(context.Background(), "repo"); err == nil {
+		t.Fatalf("Expected an error for a manifest which can't be fetched, got %+v", indexes)
+	}
+}
+
+func TestFindSociIndexes(t *testing.T) {
+	subjectDigest, subjectIndex := testSociIndex(t, testImageDigest, true)
+	// Indexes pushed with the legacy registry encoding, only linked by an annotation
+	newDigest, newIndex := testSociIndex(t, testImageDigest, false)
+	otherDigest, otherIndex := testSociIndex(t, "sha256:"+strings.Repeat("1", 64), false)
+	now := time.Now()
+	images := []ImageDetail{{Digest: otherDigest.String(), ArtifactMediaType: soci.SociIndexArtifactType, PushedAt: now.Add(-time.Hour)}}
+	for i := 0; i < maxScannedSociIndexes; i++ {
+		images = append(images, ImageDetail{Digest: digest.FromString(strconv.Itoa(i)).String(), ArtifactMediaType: soci.SociIndexArtifactType, PushedAt: now.Add(-2 * time.Hour)})
+	}
+	images = append(images, ImageDetail{Digest: newDigest.String(), ArtifactMediaType: soci.SociIndexArtifactType, PushedAt: now})
+	manifests := map[digest.Digest][]byte{subjectDigest: subjectIndex, newDigest: newIndex, otherDigest: otherIndex}
+
+	t.Run("referrers API", func(t *testing.T) {
+		fake := &testEcrServer{
+			images:    images,
+			manifests: manifests,
+			referrers: []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageManifest, ArtifactType: soci.SociIndexArtifactType, Digest: subjectDigest, Size: int64(len(subjectIndex))}},
+			fetches:   map[string]int{},
+		}
+		server := httptest.NewServer(fake)
+		defer server.Close()
+
+		indexes, err := testEcrRegistry(t, server).FindSociIndexes(context.Background(), "repo", testImageDigest)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(indexes) != 1 || indexes[0].Descriptor.Digest != subjectDigest {
+			t.Fatalf("Expected the index found with the referrers API, got %+v", indexes)
+		}
+		if fake.describeImages != 0 {
+			t.Fatalf("Expected the repository not to be scanned when the registry supports the referrers API")
+		}
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		fake := &testEcrServer{images: images, manifests: manifests, fetches: map[string]int{}}
+		server := httptest.NewServer(fake)
+		defer server.Close()
+
+		indexes, err := testEcrRegistry(t, server).FindSociIndexes(context.Background(), "repo", testImageDigest)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(indexes) != 1 || indexes[0].Descriptor.Digest != newDigest {
+			t.Fatalf("Expected the newest index linked by an annotation, got %+v", indexes)
+		}
+		fetched := 0
+		for reference, count := range fake.fetches {
+			if strings.HasPrefix(reference, "sha256:") {
+				fetched += count
+			}
+		}
+		if fetched != maxScannedSociIndexes {
+			t.Fatalf("Expected the scan to stop after %d manifests, fetched %d", maxScannedSociIndexes, fetched)
+		}
+	})
+}
+
+func TestFindSociIndexesV2(t *testing.T) {
+	v2Index := ocispec.Manifest{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: SociIndexArtifactTypeV2,
+		Config:       ocispec.Descriptor{MediaType: SociIndexArtifactTypeV2, Digest: digest.FromString("{}"), Size: 2},
+		Annotations:  map[string]string{AnnotationSociImageManifestDigest: testImageDigest},
+	}
+	v2Index.SchemaVersion = 2
+	v2Content, _ := json.Marshal(v2Index)
+	v2Digest := digest.FromBytes(v2Content)
+	imageIndex := ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("converted image"), Size: 42},
+			{MediaType: ocispec.MediaTypeImageManifest, ArtifactType: SociIndexArtifactTypeV2, Digest: v2Digest, Size: int64(len(v2Content)),
+				Annotations: map[string]string{AnnotationSociImageManifestDigest: testImageDigest}},
+			// The index of another image isn't fetched
+			{MediaType: ocispec.MediaTypeImageManifest, ArtifactType: SociIndexArtifactTypeV2, Digest: digest.FromString("other index"), Size: 42,
+				Annotations: map[string]string{AnnotationSociImageManifestDigest: digest.FromString("other image").String()}},
+		},
+	}
+	imageIndex.SchemaVersion = 2
+	imageIndexContent, _ := json.Marshal(imageIndex)
+	imageIndexDigest := digest.FromBytes(imageIndexContent)
+
+	fake := &testEcrServer{
+		manifests: map[digest.Digest][]byte{v2Digest: v2Content, imageIndexDigest: imageIndexContent},
+		tags:      map[string]digest.Digest{"v1-soci": imageIndexDigest},
+		fetches:   map[string]int{},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	registry := testEcrRegistry(t, server)
+
+	indexes, err := registry.FindSociIndexesV2(context.Background(), "repo", "v1-soci", testImageDigest)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(indexes) != 1 || indexes[0].Descriptor.Digest != v2Digest {
+		t.Fatalf("Expected the SOCI index manifest v2 of the image index, got %+v", indexes)
+	}
+	if indexes[0].ImageManifestDigest() != testImageDigest || fake.fetches[digest.FromString("other index").String()] != 0 {
+		t.Fatalf("Expected only the SOCI index of the image to be fetched, got fetches %v", fake.fetches)
+	}
+	if indexes, err := registry.FindSociIndexesV2(context.Background(), "repo", "v1-soci", "sha256:"+strings.Repeat("1", 64)); err != nil || len(indexes) != 0 {
+		t.Fatalf("Expected no index of another image, got %+v and %v", indexes, err)
+	}
+	if indexes, err := registry.FindSociIndexesV2(context.Background(), "repo", "missing-soci", testImageDigest); err != nil || len(indexes) != 0 {
+		t.Fatalf("Expected no index without the tag, got %+v and %v", indexes, err)
+	}
+}
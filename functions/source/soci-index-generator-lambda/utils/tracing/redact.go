@@ -0,0 +1,69 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/log"
+)
+
+// Exporter redacting the secrets of the spans, e.g. the presigned URLs layers are pulled from, recorded by the
+// instrumented transport, or the errors of the registries
+type redactingExporter struct {
+	sdktrace.SpanExporter
+}
+
+func (exporter redactingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	redactedSpans := make([]sdktrace.ReadOnlySpan, len(spans))
+	for i, span := range spans {
+		redactedSpans[i] = redactedSpan{span}
+	}
+	return exporter.SpanExporter.ExportSpans(ctx, redactedSpans)
+}
+
+type redactedSpan struct {
+	sdktrace.ReadOnlySpan
+}
+
+func (span redactedSpan) Attributes() []attribute.KeyValue {
+	return redactAttributes(span.ReadOnlySpan.Attributes())
+}
+
+func (span redactedSpan) Events() []sdktrace.Event {
+	events := span.ReadOnlySpan.Events()
+	redactedEvents := make([]sdktrace.Event, len(events))
+	for i, event := range events {
+		event.Attributes = redactAttributes(event.Attributes)
+		redactedEvents[i] = event
+	}
+	return redactedEvents
+}
+
+func (span redactedSpan) Status() sdktrace.Status {
+	status := span.ReadOnlySpan.Status()
+	status.Description = log.Redact(status.Description)
+	return status
+}
+
+func redactAttributes(attributes []attribute.KeyValue) []attribute.KeyValue {
+	redactedAttributes := make([]attribute.KeyValue, len(attributes))
+	for i, kv := range attributes {
+		switch kv.Value.Type() {
+		case attribute.STRING:
+			kv.Value = attribute.StringValue(log.Redact(kv.Value.AsString()))
+		case attribute.STRINGSLICE:
+			values := kv.Value.AsStringSlice()
+			for j := range values {
+				values[j] = log.Redact(values[j])
+			}
+			kv.Value = attribute.StringSliceValue(values)
+		}
+		redactedAttributes[i] = kv
+	}
+	return redactedAttributes
+}
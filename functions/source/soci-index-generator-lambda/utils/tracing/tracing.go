@@ -0,0 +1,137 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package tracing traces the builds with OpenTelemetry. Nothing is traced unless an exporter is configured.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda/utils/version"
+)
+
+const (
+	// Exporter of the spans: "none", "stdout", "file" or "otlp". The OTLP exporter is configured with the standard
+	// OTEL_EXPORTER_OTLP_* environment variables, e.g. OTEL_EXPORTER_OTLP_ENDPOINT.
+	exporterEnv = "SOCI_TRACES_EXPORTER"
+	// File the "file" exporter appends the spans to
+	fileEnv = "SOCI_TRACES_FILE"
+
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+	ExporterOTLP   = "otlp"
+
+	// Header the Lambda runtime passes the X-Ray trace context in
+	lambdaTraceHeader = "X-Amzn-Trace-Id"
+	// Key of the X-Ray trace context in the context of a Lambda invocation
+	lambdaTraceContextKey = "x-amzn-trace-id"
+
+	tracerName  = "github.com/aws-ia/cfn-aws-soci-index-builder/soci-index-generator-lambda"
+	serviceName = "soci-index-builder"
+)
+
+var provider *sdktrace.TracerProvider
+
+// Set up the exporter of the spans. The returned function flushes the spans and shuts the exporter down.
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	// Trace contexts are accepted in the W3C and X-Ray formats, and propagated in both
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}, xray.Propagator{}))
+
+	exporter, err := newExporter(ctx)
+	if err != nil || exporter == nil {
+		return func(context.Context) error { return nil }, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(version.Builder()),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(redactingExporter{exporter}), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func newExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	switch exporter := os.Getenv(exporterEnv); exporter {
+	case "", ExporterNone:
+		return nil, nil
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		path := os.Getenv(fileEnv)
+		if path == "" {
+			return nil, fmt.Errorf("%s must be set with the %q exporter", fileEnv, ExporterFile)
+		}
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(file))
+	case ExporterOTLP:
+		return otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("Invalid %s %q, expected %s, %s, %s or %s", exporterEnv, exporter, ExporterNone, ExporterStdout, ExporterFile, ExporterOTLP)
+	}
+}
+
+// Export the spans ended so far. A Lambda function is frozen between invocations, so each invocation flushes its
+// spans before returning.
+func Flush(ctx context.Context) {
+	if provider != nil {
+		provider.ForceFlush(ctx)
+	}
+}
+
+// Returns a context continuing the trace of a Lambda invocation, traced by X-Ray
+func FromLambda(ctx context.Context) context.Context {
+	header, ok := ctx.Value(lambdaTraceContextKey).(string)
+	if !ok || header == "" {
+		return ctx
+	}
+	return xray.Propagator{}.Extract(ctx, propagation.MapCarrier{lambdaTraceHeader: header})
+}
+
+// Returns a context continuing the trace of an HTTP request, in the W3C or X-Ray format
+func FromHeaders(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Start a span, as a child of the span in ctx if any
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End a span, recording its error if any
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Returns a transport tracing the requests it sends, and propagating their trace context
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base, otelhttp.WithSpanNameFormatter(func(_ string, request *http.Request) string {
+		return "HTTP " + request.Method
+	}))
+}
@@ -0,0 +1,84 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInvalidExporter(t *testing.T) {
+	t.Setenv(exporterEnv, "jaeger")
+	if _, err := Init(context.Background()); err == nil {
+		t.Fatalf("Expected an error with an invalid exporter")
+	}
+	t.Setenv(exporterEnv, ExporterFile)
+	t.Setenv(fileEnv, "")
+	if _, err := Init(context.Background()); err == nil {
+		t.Fatalf("Expected an error with the file exporter and no file")
+	}
+}
+
+func TestTraceContext(t *testing.T) {
+	t.Setenv(exporterEnv, ExporterNone)
+	if _, err := Init(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	spanContext := trace.SpanContextFromContext(FromHeaders(context.Background(), header))
+	if spanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || !spanContext.IsRemote() {
+		t.Fatalf("Expected the W3C trace context of the headers, got %v", spanContext)
+	}
+
+	ctx := context.WithValue(context.Background(), lambdaTraceContextKey, "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1")
+	spanContext = trace.SpanContextFromContext(FromLambda(ctx))
+	if spanContext.TraceID().String() != "5759e988bd862e3fe1be46a994272793" || !spanContext.IsSampled() {
+		t.Fatalf("Expected the X-Ray trace context of the invocation, got %v", spanContext)
+	}
+	if spanContext := trace.SpanContextFromContext(FromLambda(context.Background())); spanContext.IsValid() {
+		t.Fatalf("Expected no trace context outside of an invocation, got %v", spanContext)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	t.Setenv(exporterEnv, ExporterFile)
+	t.Setenv(fileEnv, path)
+	shutdown, err := Init(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	signature := "fe5f80f77d5fa3beca038a248ff027d0445342fe2855ddc963176630326f1024"
+	ctx, parent := Start(context.Background(), "build")
+	_, child := Start(ctx, "pull blob", attribute.String("http.url", "https://bucket.s3.amazonaws.com/layer?X-Amz-Signature="+signature))
+	End(child, errors.New("connection reset by https://bucket.s3.amazonaws.com/layer?X-Amz-Signature="+signature))
+	End(parent, nil)
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	traces, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, expected := range []string{`"Name":"build"`, `"Name":"pull blob"`, "connection reset", "X-Amz-Signature=[REDACTED]", serviceName} {
+		if !strings.Contains(string(traces), expected) {
+			t.Fatalf("Expected the exported spans to contain %q, got:\n%s", expected, traces)
+		}
+	}
+	if strings.Contains(string(traces), signature) {
+		t.Fatalf("Expected the signature to be redacted from the exported spans, got:\n%s", traces)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package version reports the versions of the SOCI index builder and of the SOCI library it's built with.
+package version
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+const (
+	sociModulePath = "github.com/awslabs/soci-snapshotter"
+	unknown        = "unknown"
+)
+
+// Set at link time with -ldflags "-X .../utils/version.version=<version>", otherwise taken from the build info
+var version string
+
+// Returns the version of the builder: the version set at link time, the module version, or the VCS revision
+func Builder() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return unknown
+	}
+	return builderVersion(info)
+}
+
+func builderVersion(info *debug.BuildInfo) string {
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if revision == "" {
+		return unknown
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified == "true" {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// Returns the version of the SOCI library the builder is built with
+func Soci() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return unknown
+	}
+	return sociVersion(info)
+}
+
+func sociVersion(info *debug.BuildInfo) string {
+	for _, dep := range info.Deps {
+		if dep.Path == sociModulePath {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return unknown
+}
+
+// Returns the User-Agent the builder sends to registries
+func UserAgent() string {
+	return fmt.Sprintf("SOCI Index Builder/%s (oras-go)", Builder())
+}
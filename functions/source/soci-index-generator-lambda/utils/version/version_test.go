@@ -0,0 +1,54 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package version
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestBuilderVersion(t *testing.T) {
+	tests := []struct {
+		info     debug.BuildInfo
+		expected string
+	}{
+		{
+			info:     debug.BuildInfo{Main: debug.Module{Version: "v1.2.0"}},
+			expected: "v1.2.0",
+		},
+		{
+			info: debug.BuildInfo{
+				Main: debug.Module{Version: "(devel)"},
+				Settings: []debug.BuildSetting{
+					{Key: "vcs.revision", Value: "0123456789abcdef0123"},
+					{Key: "vcs.modified", Value: "true"},
+				},
+			},
+			expected: "0123456789ab-dirty",
+		},
+		{
+			info:     debug.BuildInfo{Main: debug.Module{Version: "(devel)"}},
+			expected: unknown,
+		},
+	}
+
+	for _, test := range tests {
+		if actual := builderVersion(&test.info); actual != test.expected {
+			t.Fatalf("Expected builder version %q, got %q", test.expected, actual)
+		}
+	}
+}
+
+func TestSociVersion(t *testing.T) {
+	info := debug.BuildInfo{Deps: []*debug.Module{
+		{Path: "oras.land/oras-go/v2", Version: "v2.2.1"},
+		{Path: sociModulePath, Version: "v0.4.0"},
+	}}
+	if actual := sociVersion(&info); actual != "v0.4.0" {
+		t.Fatalf("Unexpected SOCI version %q", actual)
+	}
+	if actual := sociVersion(&debug.BuildInfo{}); actual != unknown {
+		t.Fatalf("Expected an unknown SOCI version, got %q", actual)
+	}
+}